@@ -0,0 +1,207 @@
+// Command bench measures how many feed polls the database serves while mail
+// is being ingested, with reads sharing the writer connection and with the
+// read pool.
+//
+//	go run ./cmd/bench -duration 5s -pollers 8
+//
+// A poll makes the queries of serving an uncached feed document: it loads the
+// feed, its validators and visualization count, its newest entries and their
+// enclosures. Rendering isn't included, as it doesn't use the database.
+// Ingestion stores entries in the same kind of transaction as the SMTP
+// server, one every -ingest-interval.
+//
+// Pollers that no longer wait for the writer connection compete with
+// ingestion for CPU instead, so on machines with few CPUs more polls come at
+// the cost of ingestion throughput.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/config"
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+	"github.com/jtsang4/kill-the-newsletter/internal/feed"
+	"github.com/jtsang4/kill-the-newsletter/internal/retention"
+	"github.com/jtsang4/kill-the-newsletter/internal/util"
+)
+
+func main() {
+	duration := flag.Duration("duration", 5*time.Second, "how long to measure each configuration")
+	pollers := flag.Int("pollers", 2*runtime.NumCPU(), "number of concurrent pollers")
+	feeds := flag.Int("feeds", 20, "number of feeds")
+	entries := flag.Int("entries", 100, "entries stored in each feed beforehand")
+	interval := flag.Duration("ingest-interval", 2*time.Millisecond, "pause between ingested messages")
+	readers := flag.String("readers", "0,"+strconv.Itoa(max(4, runtime.NumCPU())), "comma-separated read pool sizes to compare; 0 shares the writer connection")
+	flag.Parse()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "READ POOL\tPOLLS/S\tP50\tP99\tINGESTED/S")
+	for _, field := range strings.Split(*readers, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 0 {
+			log.Fatalf("invalid read pool size %q", field)
+		}
+		r, err := run(n, *feeds, *entries, *pollers, *interval, *duration)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pool := strconv.Itoa(n)
+		if n == 0 {
+			pool = "shared writer"
+		}
+		fmt.Fprintf(w, "%s\t%.0f\t%s\t%s\t%.0f\n", pool, r.polls, r.p50.Round(time.Microsecond), r.p99.Round(time.Microsecond), r.ingested)
+	}
+	w.Flush()
+}
+
+type result struct {
+	polls, ingested float64
+	p50, p99        time.Duration
+}
+
+func run(readConnections, feedCount, entryCount, pollers int, interval, duration time.Duration) (result, error) {
+	dir, err := os.MkdirTemp("", "ktn-bench-*")
+	if err != nil {
+		return result{}, err
+	}
+	defer os.RemoveAll(dir)
+	dbx, err := db.Open(dir, db.WithReadConnections(readConnections))
+	if err != nil {
+		return result{}, err
+	}
+	defer dbx.Close()
+	ctx := context.Background()
+
+	var tokens []string
+	for i := 0; i < feedCount; i++ {
+		token, _ := util.RandID(20)
+		err := dbx.Tx(ctx, func(tx *db.Tx) error {
+			id, err := db.CreateFeed(ctx, tx, token, token, token, token, fmt.Sprintf("Feed %d", i))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < entryCount; j++ {
+				if err := insertEntry(ctx, tx, id, j); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return result{}, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var ingested atomic.Int64
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			token := tokens[rand.IntN(len(tokens))]
+			err := dbx.Tx(ctx, func(tx *db.Tx) error {
+				f, err := db.GetFeedByReadToken(ctx, tx, token)
+				if err != nil {
+					return err
+				}
+				if err := insertEntry(ctx, tx, f.ID, i); err != nil {
+					return err
+				}
+				_, err = retention.Apply(ctx, tx, f.ID, retention.For(config.Retention{MaxEntries: int64(entryCount)}, f), time.Now())
+				return err
+			})
+			if err != nil {
+				log.Fatalf("ingest: %v", err)
+			}
+			ingested.Add(1)
+			time.Sleep(interval)
+		}
+	}()
+	latencies := make([][]time.Duration, pollers)
+	for p := 0; p < pollers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				start := time.Now()
+				if err := poll(ctx, dbx, tokens[rand.IntN(len(tokens))]); err != nil {
+					log.Fatalf("poll: %v", err)
+				}
+				latencies[p] = append(latencies[p], time.Since(start))
+			}
+		}()
+	}
+	time.Sleep(duration)
+	close(stop)
+	wg.Wait()
+
+	all := slices.Concat(latencies...)
+	slices.Sort(all)
+	r := result{
+		polls:    float64(len(all)) / duration.Seconds(),
+		ingested: float64(ingested.Load()) / duration.Seconds(),
+	}
+	if len(all) > 0 {
+		r.p50, r.p99 = all[len(all)/2], all[len(all)*99/100]
+	}
+	return r, nil
+}
+
+var content = strings.Repeat("<p>Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore.</p>\n", 40)
+
+func insertEntry(ctx context.Context, tx *db.Tx, feedID int64, n int) error {
+	pid, _ := util.RandID(20)
+	_, err := db.InsertEntry(ctx, tx, pid, feedID, time.Now().UTC().Format(time.RFC3339Nano), db.EntryContent{
+		Author:          "Sender",
+		AuthorEmail:     "sender@example.com",
+		Title:           fmt.Sprintf("Issue %d", n),
+		OriginalContent: content,
+		CleanPrivacy:    true,
+	})
+	return err
+}
+
+// poll loads a feed document like an uncached poll does.
+func poll(ctx context.Context, dbx *db.DB, token string) error {
+	f, err := db.GetFeedByReadToken(ctx, dbx.Read, token)
+	if err != nil {
+		return err
+	}
+	if _, err := db.GetFeedValidators(ctx, dbx.Read, f.ID); err != nil {
+		return err
+	}
+	if _, err := db.CountRecentVisualizations(ctx, dbx.Read, f.ID, time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+	entries, err := db.GetFeedEntriesNewest(ctx, dbx.Read, f.ID, config.DefaultFeedPageSize)
+	if err != nil {
+		return err
+	}
+	_, err = feed.EntriesFromDB(ctx, dbx.Read, "localhost", f, entries)
+	return err
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/atom"
+	"github.com/jtsang4/kill-the-newsletter/internal/config"
+	"github.com/jtsang4/kill-the-newsletter/internal/feed"
+)
+
+const atomNS = "http://www.w3.org/2005/Atom"
+
+// atomChildren lists the Atom elements allowed in feeds and entries (RFC 4287
+// sections 4.1.1 and 4.1.2), with the maximum number of occurrences (0 for
+// unbounded).
+var atomChildren = map[string]map[string]int{
+	"feed": {
+		"author": 0, "category": 0, "contributor": 0, "generator": 1, "icon": 1, "id": 1, "link": 0,
+		"logo": 1, "rights": 1, "subtitle": 1, "title": 1, "updated": 1, "entry": 0,
+	},
+	"entry": {
+		"author": 0, "category": 0, "content": 1, "contributor": 0, "id": 1, "link": 0,
+		"published": 1, "rights": 1, "source": 1, "summary": 1, "title": 1, "updated": 1,
+	},
+	"author": {"name": 1, "uri": 1, "email": 1},
+}
+
+// atomRequired lists the elements that feeds and entries must contain. Entries
+// need an author because feeds don't have one.
+var atomRequired = map[string][]string{
+	"feed":   {"id", "title", "updated"},
+	"entry":  {"id", "title", "updated", "author"},
+	"author": {"name"},
+}
+
+type atomFrame struct {
+	name   string
+	attrs  map[string]string
+	counts map[string]int
+	text   strings.Builder
+}
+
+// validateAtom checks that doc is well-formed XML and a valid Atom feed
+// document: element structure and cardinality, text constructs that are
+// escaped rather than embedded markup, dates, ids, emails and links.
+func validateAtom(doc []byte) error {
+	d := xml.NewDecoder(bytes.NewReader(doc))
+	d.Strict = true
+	var stack []*atomFrame
+	skip := 0 // depth inside extension elements and XHTML content
+	sawFeed := false
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("not well-formed: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if skip > 0 {
+				skip++
+				continue
+			}
+			var parent *atomFrame
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1]
+			}
+			if parent != nil && parent.attrs["type"] == "xhtml" {
+				skip = 1 // XHTML content is only checked for well-formedness
+				continue
+			}
+			if t.Name.Space != atomNS {
+				if parent == nil || (parent.name != "feed" && parent.name != "entry") {
+					return fmt.Errorf("unexpected element %s:%s", t.Name.Space, t.Name.Local)
+				}
+				skip = 1
+				continue
+			}
+			if parent == nil {
+				if t.Name.Local != "feed" || sawFeed {
+					return fmt.Errorf("root element is %s, want feed", t.Name.Local)
+				}
+				sawFeed = true
+			} else {
+				allowed, ok := atomChildren[parent.name]
+				if !ok {
+					return fmt.Errorf("%s can't contain elements, found %s", parent.name, t.Name.Local)
+				}
+				limit, ok := allowed[t.Name.Local]
+				if !ok {
+					return fmt.Errorf("%s isn't allowed in %s", t.Name.Local, parent.name)
+				}
+				parent.counts[t.Name.Local]++
+				if limit > 0 && parent.counts[t.Name.Local] > limit {
+					return fmt.Errorf("%s has more than %d %s", parent.name, limit, t.Name.Local)
+				}
+			}
+			f := &atomFrame{name: t.Name.Local, attrs: map[string]string{}, counts: map[string]int{}}
+			for _, a := range t.Attr {
+				key := a.Name.Local
+				if a.Name.Space == "http://www.w3.org/XML/1998/namespace" {
+					key = "xml:" + key
+				}
+				f.attrs[key] = a.Value
+			}
+			stack = append(stack, f)
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			f := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if err := checkAtomElement(f); err != nil {
+				return err
+			}
+		case xml.CharData:
+			if skip == 0 && len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		}
+	}
+	if !sawFeed {
+		return fmt.Errorf("no feed element")
+	}
+	return nil
+}
+
+func checkAtomElement(f *atomFrame) error {
+	for _, name := range atomRequired[f.name] {
+		if f.counts[name] == 0 {
+			return fmt.Errorf("%s without %s", f.name, name)
+		}
+	}
+	text := f.text.String()
+	switch f.name {
+	case "feed":
+		if base, ok := f.attrs["xml:base"]; ok {
+			if u, err := url.Parse(base); err != nil || !u.IsAbs() {
+				return fmt.Errorf("xml:base %q isn't absolute", base)
+			}
+		}
+	case "id":
+		if u, err := url.Parse(strings.TrimSpace(text)); err != nil || !u.IsAbs() {
+			return fmt.Errorf("id %q isn't an absolute IRI", text)
+		}
+	case "updated", "published":
+		if _, err := time.Parse(time.RFC3339, strings.TrimSpace(text)); err != nil {
+			return fmt.Errorf("%s %q isn't an RFC 3339 date", f.name, text)
+		}
+	case "name":
+		if strings.TrimSpace(text) == "" {
+			return fmt.Errorf("empty author name")
+		}
+	case "email":
+		if a, err := mail.ParseAddress(text); err != nil || a.Address != text {
+			return fmt.Errorf("email %q isn't an addr-spec", text)
+		}
+	case "title", "summary", "content", "subtitle", "rights":
+		switch f.attrs["type"] {
+		case "", "text", "html", "xhtml":
+		default:
+			return fmt.Errorf("%s has type %q", f.name, f.attrs["type"])
+		}
+		if f.name == "title" && strings.TrimSpace(text) == "" {
+			return fmt.Errorf("empty title")
+		}
+	case "link":
+		if _, ok := f.attrs["href"]; !ok {
+			return fmt.Errorf("link without href")
+		}
+		if _, err := url.Parse(f.attrs["href"]); err != nil {
+			return fmt.Errorf("link href %q: %w", f.attrs["href"], err)
+		}
+		if length, ok := f.attrs["length"]; ok {
+			if _, err := strconv.ParseUint(length, 10, 64); err != nil {
+				return fmt.Errorf("link length %q", length)
+			}
+		}
+	case "icon":
+		if _, err := url.Parse(strings.TrimSpace(text)); err != nil {
+			return fmt.Errorf("icon %q: %w", text, err)
+		}
+	}
+	return nil
+}
+
+// trickyEmails are bodies that used to break the Atom output, by subject.
+var trickyEmails = []struct {
+	subject string
+	headers []string
+	body    string
+}{
+	{"Stray ampersand & <brackets>", nil, `<p>Fish & chips < 5 > 3 &nbsp; &copy; &bogus;</p>`},
+	{"Unclosed tags", nil, `<div><p>One<p>Two<table><tr><td>Cell`},
+	{"CDATA end ]]>", nil, `<p>]]> and <![CDATA[ inside ]]></p>`},
+	{"Control characters", nil, "<p>Bell \a form feed \f vertical tab \v</p>"},
+	{"=?UTF-8?B?8J+Ukg==?= Encoded subject", []string{"From: =?UTF-8?Q?Caf=C3=A9_\"Quoted\"?= <cafe@example.com>"}, `<p>Emoji 📰 and RTL עברית</p>`},
+	{"Latin-1 body", []string{"Content-Type: text/html; charset=iso-8859-1"}, "<p>Caf\xe9 cr\xe8me</p>"},
+	{"Plain text", []string{"Content-Type: text/plain; charset=utf-8"}, "if a < b && c > d { return \"x\" }"},
+	{"Empty body", nil, ""},
+	{"Odd sender", []string{"From: Not An Address"}, `<p>No parsable From header</p>`},
+	{"Relative links", nil, `<p><a href="/about">About</a> <img src="logo.png"></p>`},
+}
+
+// verifyAtomCorpus sends tricky emails to a new feed and validates the Atom
+// document, then validates documents built from tricky model values that
+// emails can't produce.
+func verifyAtomCorpus(httpAddr string, cfg config.Config) error {
+	created := createFeed(httpAddr)
+	for _, m := range trickyEmails {
+		sendMessageWithHeaders(cfg.SMTPPort, created.Email, cfg.Hostname, m.subject, m.body, m.headers)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", httpAddr, path(created.Feed)))
+	if err != nil {
+		return err
+	}
+	doc, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if err := validateAtom(doc); err != nil {
+		return fmt.Errorf("feed of tricky emails: %w\n%s", err, doc)
+	}
+	var parsed struct {
+		Entries []struct {
+			Content string `xml:"content"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal(doc, &parsed); err != nil {
+		return err
+	}
+	if len(parsed.Entries) != len(trickyEmails) {
+		return fmt.Errorf("feed has %d entries, want %d", len(parsed.Entries), len(trickyEmails))
+	}
+	// Content round-trips as HTML text rather than being parsed as markup.
+	if !strings.Contains(string(doc), "Fish &amp;amp; chips") {
+		return fmt.Errorf("content isn't escaped")
+	}
+
+	author, badEmail := "", "not an email"
+	title := "Entry\x00with NUL"
+	doc2, err := atom.BuildFeedXML(feed.Feed{
+		ID:      "urn:kill-the-newsletter:test",
+		Title:   "Feed & <Title>",
+		BaseURL: "https://example.com/",
+		URL:     "https://example.com/feeds/test",
+	}, []feed.Entry{
+		{ID: "urn:kill-the-newsletter:a", URL: "https://example.com/a.html", CreatedAt: "2024-01-02T03:04:05.678Z", PublishedAt: "2024-01-02T03:04:05.678Z", UpdatedAt: "2024-01-02T03:04:05.678Z", Title: title, Content: "<p>x]]>y"},
+		{ID: "urn:kill-the-newsletter:b", URL: "https://example.com/b.html", CreatedAt: "2024-01-02T03:04:05Z", PublishedAt: "2024-01-01T00:00:00Z", UpdatedAt: "2024-01-03T00:00:00Z", Author: &author, AuthorEmail: &badEmail, Title: "B"},
+	})
+	if err != nil {
+		return err
+	}
+	if err := validateAtom([]byte(doc2)); err != nil {
+		return fmt.Errorf("feed of tricky values: %w\n%s", err, doc2)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/config"
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+	"github.com/jtsang4/kill-the-newsletter/internal/feedcache"
+)
+
+// verifyFeedCache checks that feed documents are served from the cache until
+// ingestion, settings changes or entry deletion invalidate it.
+func verifyFeedCache(httpAddr string, dbx *db.DB, cfg config.Config) error {
+	ctx := context.Background()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	created := createFeed(httpAddr)
+	readToken := strings.TrimSuffix(strings.TrimPrefix(path(created.Feed), "/feeds/"), ".xml")
+	get := func() (string, error) {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", httpAddr, path(created.Feed)))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	sendMessage(cfg.SMTPPort, created.Email, cfg.Hostname, "Cached One", "<p>Cached one</p>")
+	first, err := get()
+	if err != nil {
+		return err
+	}
+	if cached, _ := filepath.Glob(filepath.Join(cfg.DataDirectory, "cache", "feeds", readToken, "*", "xml")); len(cached) != 1 {
+		return fmt.Errorf("document wasn't cached: %v", cached)
+	}
+	// A change that bypasses invalidation isn't visible until the feed is
+	// invalidated, as by another process sharing the data directory.
+	f, err := db.GetFeedByReadToken(ctx, dbx.Read, readToken)
+	if err != nil || f == nil {
+		return fmt.Errorf("load feed: %v", err)
+	}
+	if _, err := dbx.Write.ExecContext(ctx, `UPDATE feeds SET title = 'Renamed Behind The Cache' WHERE id=?`, f.ID); err != nil {
+		return err
+	}
+	if again, err := get(); err != nil || again != first {
+		return fmt.Errorf("document wasn't served from the cache: %v", err)
+	}
+	if err := feedcache.New(cfg.DataDirectory).Invalidate(readToken); err != nil {
+		return err
+	}
+	if again, err := get(); err != nil || !strings.Contains(again, "Renamed Behind The Cache") {
+		return fmt.Errorf("invalidated document is still served: %v", err)
+	}
+
+	// Ingestion invalidates the feed.
+	sendMessage(cfg.SMTPPort, created.Email, cfg.Hostname, "Cached Two", "<p>Cached two</p>")
+	doc, err := get()
+	if err != nil || !strings.Contains(doc, "Cached Two") {
+		return fmt.Errorf("new entry missing after ingestion: %v", err)
+	}
+	// So does deleting an entry.
+	entries, err := db.GetFeedEntriesDesc(ctx, dbx.Read, f.ID)
+	if err != nil || len(entries) != 2 {
+		return fmt.Errorf("entries: %d, %v", len(entries), err)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s%s/entries/%s", httpAddr, path(created.Settings), entries[0].PublicID), nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if doc, err := get(); err != nil || strings.Contains(doc, "Cached Two") {
+		return fmt.Errorf("deleted entry still served: %v", err)
+	}
+	// Deleting the feed removes its documents.
+	req, _ = http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s%s", httpAddr, path(created.Settings)), nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if _, err := os.Stat(filepath.Join(cfg.DataDirectory, "cache", "feeds", readToken)); !os.IsNotExist(err) {
+		return fmt.Errorf("documents of deleted feed remain: %v", err)
+	}
+	return nil
+}
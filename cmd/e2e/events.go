@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/config"
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+)
+
+// streamEvent is an event received from a feed's live stream.
+type streamEvent struct {
+	ID   string
+	Type string
+	Data struct {
+		EntryID string `json:"entryId"`
+		Title   string `json:"title"`
+		URL     string `json:"url"`
+	}
+}
+
+// eventStream is a connection to a feed's live stream.
+type eventStream struct {
+	cancel context.CancelFunc
+	events chan streamEvent
+	// done is closed when the server ends the stream.
+	done chan struct{}
+}
+
+// openEventStream connects to a stream, resuming after lastEventID unless it
+// is empty, and returns once the server sent the response headers.
+func openEventStream(streamURL, lastEventID string) (*eventStream, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, streamURL, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("stream: %s %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	s := &eventStream{cancel: cancel, events: make(chan streamEvent, 16), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		defer resp.Body.Close()
+		sc := bufio.NewScanner(resp.Body)
+		var ev streamEvent
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case line == "":
+				if ev.Type != "" {
+					s.events <- ev
+				}
+				ev = streamEvent{}
+			case strings.HasPrefix(line, "id: "):
+				ev.ID = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				ev.Type = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.Data)
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *eventStream) Close() { s.cancel() }
+
+// next returns the next event, of type typ.
+func (s *eventStream) next(typ string) (streamEvent, error) {
+	select {
+	case ev := <-s.events:
+		if ev.Type != typ {
+			return ev, fmt.Errorf("got a %s event, want %s: %+v", ev.Type, typ, ev)
+		}
+		return ev, nil
+	case <-time.After(10 * time.Second):
+		return streamEvent{}, fmt.Errorf("no %s event after 10s", typ)
+	}
+}
+
+// verifyEvents checks that feeds' live streams send created and deleted
+// entries right away, resume from Last-Event-ID, end with their feed, and
+// poll for changes made by other processes.
+func verifyEvents(httpAddr string, dbx *db.DB, cfg config.Config) error {
+	ctx := context.Background()
+	const token = "e2e-api-token"
+	created := createFeed(httpAddr)
+	streamPath := strings.TrimSuffix(path(created.Feed), ".xml") + "/events"
+	stream, err := openEventStream("http://"+httpAddr+streamPath, "")
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	sendMessage(cfg.SMTPPort, created.Email, cfg.Hostname, "Live Event", "<p>Streamed</p>")
+	createdEv, err := stream.next("entry-created")
+	if err != nil {
+		return err
+	}
+	if createdEv.ID == "" || createdEv.Data.EntryID == "" || createdEv.Data.Title != "Live Event" || !strings.HasSuffix(createdEv.Data.URL, "/entries/"+createdEv.Data.EntryID+".html") {
+		return fmt.Errorf("created event: %+v", createdEv)
+	}
+	entryURL := fmt.Sprintf("http://%s/api/v1/feeds/%s/entries/%s", httpAddr, created.FeedID, createdEv.Data.EntryID)
+	if status, err := apiRequest(http.MethodDelete, entryURL, token, nil, nil); err != nil || status != http.StatusNoContent {
+		return fmt.Errorf("delete entry: %d %v", status, err)
+	}
+	deletedEv, err := stream.next("entry-deleted")
+	if err != nil {
+		return err
+	}
+	if deletedEv.Data.EntryID != createdEv.Data.EntryID || deletedEv.Data.Title != "" {
+		return fmt.Errorf("deleted event: %+v", deletedEv)
+	}
+
+	// Clients that reconnect get the events they missed.
+	resumed, err := openEventStream("http://"+httpAddr+streamPath, createdEv.ID)
+	if err != nil {
+		return err
+	}
+	defer resumed.Close()
+	if ev, err := resumed.next("entry-deleted"); err != nil || ev.ID != deletedEv.ID {
+		return fmt.Errorf("resumed stream: %+v %v", ev, err)
+	}
+
+	// Changes made by other processes aren't announced, and are polled.
+	sendMessage(cfg.SMTPPort, created.Email, cfg.Hostname, "Polled Event", "<p>Polled</p>")
+	ev, err := stream.next("entry-created")
+	if err != nil {
+		return err
+	}
+	if _, err := dbx.Write.ExecContext(ctx, `DELETE FROM feedEntries WHERE publicId = ?`, ev.Data.EntryID); err != nil {
+		return err
+	}
+	if polled, err := stream.next("entry-deleted"); err != nil || polled.Data.EntryID != ev.Data.EntryID {
+		return fmt.Errorf("polled deletion: %+v %v", polled, err)
+	}
+
+	// Streams end when their feed is deleted.
+	sendMessage(cfg.SMTPPort, created.Email, cfg.Hostname, "Last Event", "<p>Last</p>")
+	last, err := stream.next("entry-created")
+	if err != nil {
+		return err
+	}
+	if status, err := apiRequest(http.MethodDelete, fmt.Sprintf("http://%s/api/v1/feeds/%s", httpAddr, created.FeedID), token, nil, nil); err != nil || status != http.StatusNoContent {
+		return fmt.Errorf("delete feed: %d %v", status, err)
+	}
+	if ev, err := stream.next("entry-deleted"); err != nil || ev.Data.EntryID != last.Data.EntryID {
+		return fmt.Errorf("deleted feed's entry: %+v %v", ev, err)
+	}
+	select {
+	case <-stream.done:
+	case <-time.After(10 * time.Second):
+		return fmt.Errorf("stream of a deleted feed is still open after 10s")
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/config"
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+	"github.com/jtsang4/kill-the-newsletter/internal/jobs"
+	"github.com/jtsang4/kill-the-newsletter/internal/worker"
+)
+
+// jobState is the part of a background job that retries are checked on.
+type jobState struct {
+	ID        int64
+	Status    string
+	Retries   int
+	StartAt   string
+	LastError string
+}
+
+// dispatchJob returns the newest dispatch job of a subscription.
+func dispatchJob(ctx context.Context, dbx *db.DB, subscriptionID int64) (jobState, error) {
+	var j jobState
+	err := dbx.Read.QueryRowContext(ctx, `SELECT id, status, retries, startAt, COALESCE(lastError, '') FROM backgroundJobs WHERE type = 'feedWebSubSubscriptions.dispatch' AND json_extract(parameters, '$.feedWebSubSubscriptionId') = ? ORDER BY id DESC LIMIT 1`, subscriptionID).Scan(&j.ID, &j.Status, &j.Retries, &j.StartAt, &j.LastError)
+	return j, err
+}
+
+// waitForJob polls a subscription's newest dispatch job until it has status.
+func waitForJob(ctx context.Context, dbx *db.DB, subscriptionID int64, status string) (jobState, error) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		j, err := dispatchJob(ctx, dbx, subscriptionID)
+		if err == nil && j.Status == status {
+			return j, nil
+		}
+		if time.Now().After(deadline) {
+			return j, fmt.Errorf("job is %q after 10s, want %q: %v", j.Status, status, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// subscribeLocally creates a feed with a WebSub subscription to callback.
+// It subscribes directly, without the hub's verification request.
+func subscribeLocally(ctx context.Context, dbx *db.DB, httpAddr, callback string) (createdFeed, int64, error) {
+	created := createFeed(httpAddr)
+	readToken := strings.TrimSuffix(strings.TrimPrefix(path(created.Feed), "/feeds/"), ".xml")
+	f, err := db.GetFeedByReadToken(ctx, dbx.Read, readToken)
+	if err != nil || f == nil {
+		return created, 0, fmt.Errorf("load feed: %v", err)
+	}
+	err = dbx.Tx(ctx, func(tx *db.Tx) error {
+		now := time.Now().UTC()
+		return db.UpsertWebSubSubscription(ctx, tx, f.ID, now.Format(time.RFC3339Nano), callback, "xml", nil, now.Add(24*time.Hour).Format(time.RFC3339Nano))
+	})
+	if err != nil {
+		return created, 0, err
+	}
+	subs, err := db.GetWebSubSubscriptionsRecent(ctx, dbx.Read, f.ID, "1970-01-01T00:00:00Z")
+	if err != nil || len(subs) != 1 {
+		return created, 0, fmt.Errorf("subscription: %d, %v", len(subs), err)
+	}
+	return created, subs[0].ID, nil
+}
+
+// verifyJobRetries checks that WebSub notifications that fail are retried
+// with backoff, that client errors and exhausted retries leave jobs dead, and
+// that dead jobs can be requeued.
+func verifyJobRetries(dbx *db.DB, cfg config.Config, httpAddr string) error {
+	ctx := context.Background()
+	var status atomic.Int32
+	var delivered atomic.Int32
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := int(status.Load())
+		if code == http.StatusOK {
+			delivered.Add(1)
+		}
+		w.WriteHeader(code)
+	}))
+	defer subscriber.Close()
+
+	created, subID, err := subscribeLocally(ctx, dbx, httpAddr, subscriber.URL)
+	if err != nil {
+		return err
+	}
+
+	// A server error is retried later.
+	status.Store(http.StatusServiceUnavailable)
+	sendMessage(cfg.SMTPPort, created.Email, cfg.Hostname, "Retried", "<p>Retried</p>")
+	deadline := time.Now().Add(10 * time.Second)
+	var j jobState
+	for j.Retries == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		j, _ = dispatchJob(ctx, dbx, subID)
+	}
+	if j.Status != "pending" || j.Retries != 1 || !strings.Contains(j.LastError, "503") {
+		return fmt.Errorf("failed job wasn't rescheduled: %+v", j)
+	}
+	if startAt, err := time.Parse(time.RFC3339Nano, j.StartAt); err != nil || time.Until(startAt) < 10*time.Second {
+		return fmt.Errorf("failed job is retried too soon: %s", j.StartAt)
+	}
+	// Once due, the retry succeeds.
+	status.Store(http.StatusOK)
+	if _, err := dbx.Write.ExecContext(ctx, `UPDATE backgroundJobs SET startAt = ? WHERE id = ?`, time.Now().UTC().Format(time.RFC3339Nano), j.ID); err != nil {
+		return err
+	}
+	db.NotifyJobs("feedWebSubSubscriptions.dispatch")
+	if _, err := waitForJob(ctx, dbx, subID, "done"); err != nil {
+		return fmt.Errorf("retry: %w", err)
+	}
+	if delivered.Load() != 1 {
+		return fmt.Errorf("delivered %d times, want 1", delivered.Load())
+	}
+
+	// A client error isn't retried.
+	status.Store(http.StatusBadRequest)
+	sendMessage(cfg.SMTPPort, created.Email, cfg.Hostname, "Rejected", "<p>Rejected</p>")
+	if j, err = waitForJob(ctx, dbx, subID, "dead"); err != nil || !strings.Contains(j.LastError, "400") {
+		return fmt.Errorf("rejected job: %+v, %v", j, err)
+	}
+	// Neither is a job whose retries are exhausted.
+	status.Store(http.StatusBadGateway)
+	sendMessage(cfg.SMTPPort, created.Email, cfg.Hostname, "Exhausted", "<p>Exhausted</p>")
+	exhausted, err := waitForJob(ctx, dbx, subID, "pending")
+	for err == nil && exhausted.Retries == 0 {
+		time.Sleep(50 * time.Millisecond)
+		exhausted, err = dispatchJob(ctx, dbx, subID)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := dbx.Write.ExecContext(ctx, `UPDATE backgroundJobs SET retries = 100, startAt = ? WHERE id = ?`, time.Now().UTC().Format(time.RFC3339Nano), exhausted.ID); err != nil {
+		return err
+	}
+	db.NotifyJobs("feedWebSubSubscriptions.dispatch")
+	if j, err = waitForJob(ctx, dbx, subID, "dead"); err != nil || j.ID != exhausted.ID {
+		return fmt.Errorf("exhausted job: %+v, %v", j, err)
+	}
+	dead, err := db.ListDeadJobs(ctx, dbx.Read, 100)
+	if err != nil || len(dead) != 2 {
+		return fmt.Errorf("dead jobs: %d, %v", len(dead), err)
+	}
+
+	// Requeued dead jobs run again.
+	status.Store(http.StatusOK)
+	var n int64
+	err = dbx.Tx(ctx, func(tx *db.Tx) error {
+		n, err = db.RequeueDeadJobs(ctx, tx, 0, time.Now().UTC().Format(time.RFC3339Nano))
+		return err
+	})
+	if err != nil || n != 2 {
+		return fmt.Errorf("requeued %d jobs: %v", n, err)
+	}
+	if _, err := waitForJob(ctx, dbx, subID, "done"); err != nil {
+		return fmt.Errorf("requeued: %w", err)
+	}
+	deadline = time.Now().Add(10 * time.Second)
+	for delivered.Load() != 3 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if delivered.Load() != 3 {
+		return fmt.Errorf("delivered %d times after requeueing, want 3", delivered.Load())
+	}
+	return nil
+}
+
+// verifyJobLeases checks that a worker takes back the jobs of a worker that
+// died while running them, and that a worker that lost a job's lease can't
+// record its outcome.
+func verifyJobLeases(dbx *db.DB, cfg config.Config, httpAddr string) error {
+	ctx := context.Background()
+	var delivered atomic.Int32
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered.Add(1)
+	}))
+	defer subscriber.Close()
+	created, subID, err := subscribeLocally(ctx, dbx, httpAddr, subscriber.URL)
+	if err != nil {
+		return err
+	}
+	sendMessage(cfg.SMTPPort, created.Email, cfg.Hostname, "Leased", "<p>Leased</p>")
+	done, err := waitForJob(ctx, dbx, subID, "done")
+	if err != nil {
+		return err
+	}
+	// The same notification, taken by a worker that crashed a while ago.
+	var id int64
+	err = dbx.Write.QueryRowContext(ctx, `INSERT INTO backgroundJobs (type, startAt, parameters, status, leasedBy, leaseExpiresAt)
+		SELECT type, startAt, parameters, 'running', 'crashed-worker', ? FROM backgroundJobs WHERE id = ? RETURNING id`,
+		time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano), done.ID).Scan(&id)
+	if err != nil {
+		return err
+	}
+	// The worker that lost the lease can't complete it.
+	var held bool
+	err = dbx.Tx(ctx, func(tx *db.Tx) error {
+		held, err = db.CompleteJob(ctx, tx, id, "another-worker")
+		return err
+	})
+	if err != nil || held {
+		return fmt.Errorf("job completed by a worker without its lease: %v", err)
+	}
+	// A worker starting up reclaims it, counting the crash as a failure.
+	workerCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	worker.Start(workerCtx, cfg, dbx)
+	j, err := dispatchJob(ctx, dbx, subID)
+	if err != nil || j.ID != id || j.Status != "pending" || j.Retries != 1 || !strings.Contains(j.LastError, "crashed-worker") {
+		return fmt.Errorf("expired job wasn't reclaimed: %+v, %v", j, err)
+	}
+	// Once due, one of the workers runs it.
+	if _, err := dbx.Write.ExecContext(ctx, `UPDATE backgroundJobs SET startAt = ? WHERE id = ?`, time.Now().UTC().Format(time.RFC3339Nano), id); err != nil {
+		return err
+	}
+	db.NotifyJobs("feedWebSubSubscriptions.dispatch")
+	if _, err := waitForJob(ctx, dbx, subID, "done"); err != nil {
+		return fmt.Errorf("reclaimed job: %w", err)
+	}
+	var leasedBy sql.NullString
+	if err := dbx.Read.QueryRowContext(ctx, `SELECT leasedBy FROM backgroundJobs WHERE id = ?`, id).Scan(&leasedBy); err != nil || leasedBy.Valid {
+		return fmt.Errorf("finished job is still leased: %v, %v", leasedBy, err)
+	}
+	if delivered.Load() != 2 {
+		return fmt.Errorf("delivered %d times, want 2", delivered.Load())
+	}
+	return nil
+}
+
+// verifyJobRunner checks that a registered job type runs as soon as its jobs
+// are committed, without waiting for the runner to poll, and no more of its
+// jobs at a time than its concurrency.
+func verifyJobRunner(dbx *db.DB) error {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	const typ, total = "e2e.blocking", 5
+	var (
+		mu            sync.Mutex
+		running, peak int
+		ran           atomic.Int32
+	)
+	counts := func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return running, peak
+	}
+	release := make(chan struct{})
+	runner := jobs.NewRunner(dbx)
+	runner.Register(typ, jobs.HandlerFunc(func(ctx context.Context, job *db.Job) error {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		ran.Add(1)
+		return nil
+	}), 2, jobs.RetryPolicy{})
+	runner.Start(ctx)
+
+	err := dbx.Tx(ctx, func(tx *db.Tx) error {
+		for i := 0; i < total; i++ {
+			if err := db.EnqueueJobTx(ctx, tx, typ, time.Now().UTC().Format(time.RFC3339Nano), "{}"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Well within the poll interval.
+	deadline := time.Now().Add(2 * time.Second)
+	for n, _ := counts(); n < 2 && time.Now().Before(deadline); n, _ = counts() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n, _ := counts(); n != 2 {
+		return fmt.Errorf("%d jobs running after enqueueing, want 2", n)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, p := counts(); p != 2 {
+		return fmt.Errorf("%d jobs ran at the same time, want 2", p)
+	}
+	close(release)
+	deadline = time.Now().Add(2 * time.Second)
+	for ran.Load() < total && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ran.Load() != total {
+		return fmt.Errorf("%d of %d jobs ran", ran.Load(), total)
+	}
+	return nil
+}
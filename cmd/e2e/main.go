@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"net"
@@ -12,6 +14,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"syscall"
 	"time"
@@ -39,11 +42,18 @@ func main() {
 	smtpPort := freePort()
 
 	cfg := config.Config{
-		Hostname:      "127.0.0.1",
+		// Not the loopback address, which the fake WebSub subscribers
+		// and webhook endpoints listen on.
+		Hostname:      "ktn.test",
 		TLS:           config.TLS{},
 		DataDirectory: filepath.Join(tmpDir, "data"),
 		Environment:   string(config.EnvDevelopment),
 		SMTPPort:      smtpPort,
+		FeedPageSize:  12,
+		// The fake WebSub subscribers listen on loopback, which is blocked
+		// by default.
+		OutboundBlockedNetworks: []string{"169.254.0.0/16"},
+		WebSub:                  config.WebSub{SignatureAlgorithm: "sha512"},
 	}
 	if err := os.MkdirAll(cfg.DataDirectory, 0o755); err != nil {
 		log.Fatalf("mkdir data: %v", err)
@@ -83,23 +93,138 @@ func main() {
 	waitForHTTP(httpAddr)
 	waitForSMTP(cfg.SMTPPort)
 
-	feedID := createFeed(httpAddr)
-	log.Printf("created feed %s", feedID)
+	feed := createFeed(httpAddr)
+	log.Printf("created feed %s", feed.FeedID)
 
-	sendEmail(cfg.SMTPPort, feedID, cfg.Hostname)
-	log.Printf("sent email to %s@%s", feedID, cfg.Hostname)
+	if err := verifySeparateSecrets(httpAddr, feed); err != nil {
+		log.Fatalf("feed secrets: %v", err)
+	}
+	log.Println("feed secrets verified")
+
+	sendEmail(cfg.SMTPPort, feed.Email, cfg.Hostname)
+	log.Printf("sent email to %s", feed.Email)
 
 	entryTitle := "Test Newsletter"
-	if err := waitForFeed(httpAddr, feedID, entryTitle, 10*time.Second); err != nil {
+	if err := waitForFeed(httpAddr, feed, entryTitle, 10*time.Second); err != nil {
 		log.Fatalf("feed wait: %v", err)
 	}
 	log.Printf("feed entry with title %q detected", entryTitle)
 
-	if err := verifyEntryHTML(httpAddr, dbx, feedID); err != nil {
+	if err := verifyFeedFormats(httpAddr, feed, entryTitle); err != nil {
+		log.Fatalf("feed formats: %v", err)
+	}
+	log.Println("RSS and JSON Feed verified")
+
+	if err := verifySearch(httpAddr, feed); err != nil {
+		log.Fatalf("search: %v", err)
+	}
+	log.Println("search verified")
+
+	if err := verifyConditionalGET(httpAddr, dbx, feed); err != nil {
+		log.Fatalf("conditional get: %v", err)
+	}
+	log.Println("conditional GET verified")
+
+	if err := verifyEntryHTML(httpAddr, dbx, feed); err != nil {
 		log.Fatalf("entry html: %v", err)
 	}
 	log.Println("entry HTML verified")
 
+	if err := verifyAPI(httpAddr, dbx, feed); err != nil {
+		log.Fatalf("api: %v", err)
+	}
+	log.Println("API verified")
+
+	if err := verifyRetention(httpAddr, dbx, cfg, feed); err != nil {
+		log.Fatalf("retention: %v", err)
+	}
+	log.Println("retention verified")
+
+	if err := verifyEntryBrowsing(httpAddr, feed); err != nil {
+		log.Fatalf("entry browsing: %v", err)
+	}
+	log.Println("entry browsing verified")
+
+	if err := verifyDeduplication(httpAddr, dbx, cfg, feed); err != nil {
+		log.Fatalf("deduplication: %v", err)
+	}
+	log.Println("deduplication verified")
+
+	if err := verifyHeaderMetadata(httpAddr, cfg, feed); err != nil {
+		log.Fatalf("header metadata: %v", err)
+	}
+	log.Println("header metadata verified")
+
+	if err := verifyInlineImages(httpAddr, cfg, feed); err != nil {
+		log.Fatalf("inline images: %v", err)
+	}
+	log.Println("inline images verified")
+
+	if err := verifySanitization(httpAddr, dbx, cfg, feed); err != nil {
+		log.Fatalf("sanitization: %v", err)
+	}
+	log.Println("sanitization verified")
+
+	if err := verifyPrivacyCleaning(httpAddr, dbx, cfg, feed); err != nil {
+		log.Fatalf("privacy cleaning: %v", err)
+	}
+	log.Println("privacy cleaning verified")
+
+	if err := verifyAtomCorpus(httpAddr, cfg); err != nil {
+		log.Fatalf("atom corpus: %v", err)
+	}
+	log.Println("atom corpus verified")
+
+	if err := verifyPaging(httpAddr, cfg); err != nil {
+		log.Fatalf("paging: %v", err)
+	}
+	log.Println("paging verified")
+
+	if err := verifyFeedCache(httpAddr, dbx, cfg); err != nil {
+		log.Fatalf("feed cache: %v", err)
+	}
+	log.Println("feed cache verified")
+
+	if err := verifyOutbound(cfg, httpAddr); err != nil {
+		log.Fatalf("outbound requests: %v", err)
+	}
+	log.Println("outbound requests verified")
+
+	if err := verifyJobRetries(dbx, cfg, httpAddr); err != nil {
+		log.Fatalf("job retries: %v", err)
+	}
+	log.Println("job retries verified")
+
+	if err := verifyJobLeases(dbx, cfg, httpAddr); err != nil {
+		log.Fatalf("job leases: %v", err)
+	}
+	log.Println("job leases verified")
+
+	if err := verifyJobRunner(dbx); err != nil {
+		log.Fatalf("job runner: %v", err)
+	}
+	log.Println("job runner verified")
+
+	if err := verifyWebSub(httpAddr, dbx, cfg); err != nil {
+		log.Fatalf("websub: %v", err)
+	}
+	log.Println("WebSub verified")
+
+	if err := verifyWebhooks(httpAddr, dbx, cfg); err != nil {
+		log.Fatalf("webhooks: %v", err)
+	}
+	log.Println("webhooks verified")
+
+	if err := verifyEvents(httpAddr, dbx, cfg); err != nil {
+		log.Fatalf("events: %v", err)
+	}
+	log.Println("events verified")
+
+	if err := verifyMigrations(tmpDir); err != nil {
+		log.Fatalf("migrations: %v", err)
+	}
+	log.Println("migrations verified")
+
 	log.Println("E2E test passed")
 }
 
@@ -138,7 +263,24 @@ func waitForSMTP(port int) {
 	log.Fatalf("smtp server not reachable at %s", addr)
 }
 
-func createFeed(httpAddr string) string {
+type createdFeed struct {
+	FeedID   string `json:"feedId"`
+	Email    string `json:"email"`
+	Feed     string `json:"feed"`
+	Settings string `json:"settings"`
+}
+
+// path returns the path of a URL returned by the create feed endpoint, so it
+// can be requested from the local test server.
+func path(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		log.Fatalf("parse url %q: %v", rawURL, err)
+	}
+	return u.Path
+}
+
+func createFeed(httpAddr string) createdFeed {
 	endpoint := fmt.Sprintf("http://%s/", httpAddr)
 	form := url.Values{}
 	form.Set("title", "Example Feed")
@@ -157,18 +299,61 @@ func createFeed(httpAddr string) string {
 		body, _ := io.ReadAll(resp.Body)
 		log.Fatalf("create feed status=%d body=%s", resp.StatusCode, string(body))
 	}
-	var payload struct {
-		FeedID string `json:"feedId"`
-	}
+	var payload createdFeed
 	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
 		log.Fatalf("decode create feed: %v", err)
 	}
-	return payload.FeedID
+	return payload
 }
 
-func sendEmail(port int, feedID, hostname string) {
+// verifySeparateSecrets checks that the inbound address, the feed URL and the
+// settings page use different secrets, and that the read token doesn't grant
+// access to the settings page.
+func verifySeparateSecrets(httpAddr string, feed createdFeed) error {
+	emailID := strings.Split(feed.Email, "@")[0]
+	readToken := strings.TrimSuffix(strings.TrimPrefix(path(feed.Feed), "/feeds/"), ".xml")
+	manageToken := strings.TrimPrefix(path(feed.Settings), "/feeds/")
+	if emailID == readToken || emailID == manageToken || readToken == manageToken {
+		return fmt.Errorf("secrets are not independent: email=%s read=%s manage=%s", emailID, readToken, manageToken)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/feeds/%s", httpAddr, manageToken))
+	if err != nil {
+		return fmt.Errorf("get settings: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("settings status=%d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s/feeds/%s", httpAddr, readToken), nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("delete with read token: %w", err)
+	}
+	resp.Body.Close()
+	resp, err = http.Get(fmt.Sprintf("http://%s%s", httpAddr, path(feed.Feed)))
+	if err != nil {
+		return fmt.Errorf("get feed: %w", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "<feed") {
+		return fmt.Errorf("feed was deleted using its read token")
+	}
+	return nil
+}
+
+func sendEmail(port int, recipient, hostname string) {
+	sendMessage(port, recipient, hostname, "Test Newsletter", "<p>Hello <strong>World</strong></p>")
+}
+
+func sendMessage(port int, recipient, hostname, subject, htmlBody string) {
+	sendMessageWithHeaders(port, recipient, hostname, subject, htmlBody, nil)
+}
+
+// sendMessageWithHeaders is sendMessage with extra header lines, such as
+// Message-ID. With a Content-Type header, htmlBody is the raw MIME body.
+func sendMessageWithHeaders(port int, recipient, hostname, subject, htmlBody string, headers []string) {
 	addr := fmt.Sprintf("127.0.0.1:%d", port)
-	recipient := fmt.Sprintf("%s@%s", feedID, hostname)
 	log.Printf("connecting to SMTP %s", addr)
 	d := &net.Dialer{Timeout: 5 * time.Second}
 	conn, err := d.Dial("tcp", addr)
@@ -198,15 +383,19 @@ func sendEmail(port int, feedID, hostname string) {
 	if err != nil {
 		log.Fatalf("smtp DATA: %v", err)
 	}
-	msg := strings.Join([]string{
-		"From: \"Sender\" <sender@example.com>",
+	lines := []string{
 		"To: \"Feed\" <" + recipient + ">",
-		"Subject: Test Newsletter",
+		"Subject: " + subject,
 		"MIME-Version: 1.0",
-		"Content-Type: text/html; charset=utf-8",
-		"",
-		"<p>Hello <strong>World</strong></p>",
-	}, "\r\n") + "\r\n"
+	}
+	if !hasHeader(headers, "Content-Type") {
+		lines = append(lines, "Content-Type: text/html; charset=utf-8")
+	}
+	if !hasHeader(headers, "From") {
+		lines = append(lines, "From: \"Sender\" <sender@example.com>")
+	}
+	lines = append(lines, headers...)
+	msg := strings.Join(append(lines, "", htmlBody), "\r\n") + "\r\n"
 	if _, err := io.WriteString(wc, msg); err != nil {
 		log.Fatalf("smtp write body: %v", err)
 	}
@@ -218,8 +407,8 @@ func sendEmail(port int, feedID, hostname string) {
 	}
 }
 
-func waitForFeed(httpAddr, feedID, title string, timeout time.Duration) error {
-	url := fmt.Sprintf("http://%s/feeds/%s.xml", httpAddr, feedID)
+func waitForFeed(httpAddr string, feed createdFeed, title string, timeout time.Duration) error {
+	url := fmt.Sprintf("http://%s%s", httpAddr, path(feed.Feed))
 	deadline := time.Now().Add(timeout)
 	for time.Now().Before(deadline) {
 		resp, err := http.Get(url)
@@ -232,25 +421,180 @@ func waitForFeed(httpAddr, feedID, title string, timeout time.Duration) error {
 		}
 		time.Sleep(200 * time.Millisecond)
 	}
-	return fmt.Errorf("feed %s did not contain %q within %s", feedID, title, timeout)
+	return fmt.Errorf("feed %s did not contain %q within %s", feed.FeedID, title, timeout)
 }
 
-func verifyEntryHTML(httpAddr string, dbx *db.DB, feedID string) error {
+// verifyFeedFormats checks the RSS 2.0 and JSON Feed renderings of the feed.
+func verifyFeedFormats(httpAddr string, feed createdFeed, title string) error {
+	base := fmt.Sprintf("http://%s%s", httpAddr, strings.TrimSuffix(path(feed.Feed), ".xml"))
+	resp, err := http.Get(base + ".rss")
+	if err != nil {
+		return fmt.Errorf("get rss: %w", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/rss+xml") {
+		return fmt.Errorf("rss content type %q", ct)
+	}
+	var rss struct {
+		Version string `xml:"version,attr"`
+		Channel struct {
+			Items []struct {
+				Title   string `xml:"title"`
+				PubDate string `xml:"pubDate"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&rss); err != nil {
+		return fmt.Errorf("decode rss: %w", err)
+	}
+	if rss.Version != "2.0" || len(rss.Channel.Items) != 1 || rss.Channel.Items[0].Title != title {
+		return fmt.Errorf("unexpected rss: %+v", rss)
+	}
+	if _, err := time.Parse(time.RFC1123Z, rss.Channel.Items[0].PubDate); err != nil {
+		return fmt.Errorf("rss pubDate: %w", err)
+	}
+
+	resp2, err := http.Get(base + ".json")
+	if err != nil {
+		return fmt.Errorf("get json feed: %w", err)
+	}
+	defer resp2.Body.Close()
+	var jf struct {
+		Version string `json:"version"`
+		FeedURL string `json:"feed_url"`
+		Items   []struct {
+			Title       string `json:"title"`
+			ContentHTML string `json:"content_html"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp2.Body).Decode(&jf); err != nil {
+		return fmt.Errorf("decode json feed: %w", err)
+	}
+	if jf.Version != "https://jsonfeed.org/version/1.1" || len(jf.Items) != 1 || jf.Items[0].Title != title || !strings.HasSuffix(jf.FeedURL, ".json") {
+		return fmt.Errorf("unexpected json feed: %+v", jf)
+	}
+	return nil
+}
+
+// verifySearch checks full-text search on the settings page and as a feed.
+func verifySearch(httpAddr string, created createdFeed) error {
+	get := func(u string) (string, error) {
+		resp, err := http.Get(u)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+	page, err := get(fmt.Sprintf("http://%s%s?q=%s", httpAddr, path(created.Settings), url.QueryEscape("wor")))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(page, "Test Newsletter") {
+		return fmt.Errorf("settings page search didn't find the entry")
+	}
+	feedURL := fmt.Sprintf("http://%s%s", httpAddr, path(created.Feed))
+	for q, want := range map[string]bool{"world": true, `"unmatched -term`: false} {
+		doc, err := get(feedURL + "?q=" + url.QueryEscape(q))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(doc, "<feed") {
+			return fmt.Errorf("search feed for %q is not a feed: %s", q, doc)
+		}
+		if strings.Contains(doc, "<entry>") != want {
+			return fmt.Errorf("search feed for %q: found=%v, want %v", q, !want, want)
+		}
+	}
+	return nil
+}
+
+// verifyConditionalGET checks the feed validators, that unchanged polls get a
+// 304 that isn't counted as a visualization, and HEAD support.
+func verifyConditionalGET(httpAddr string, dbx *db.DB, created createdFeed) error {
+	feedURL := fmt.Sprintf("http://%s%s", httpAddr, path(created.Feed))
+	resp, err := http.Get(feedURL)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag == "" || lastModified == "" || resp.Header.Get("Cache-Control") == "" {
+		return fmt.Errorf("missing validators: %v", resp.Header)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	feed, err := db.GetFeedByPublicID(ctx, dbx.Read, created.FeedID)
+	if err != nil {
+		return err
+	}
+	since := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+	before, err := db.CountRecentVisualizations(ctx, dbx.Read, feed.ID, since)
+	if err != nil {
+		return err
+	}
+	for _, h := range [][2]string{{"If-None-Match", etag}, {"If-Modified-Since", lastModified}} {
+		req, _ := http.NewRequest(http.MethodGet, feedURL, nil)
+		req.Header.Set(h[0], h[1])
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotModified {
+			return fmt.Errorf("%s: status=%d, want 304", h[0], resp.StatusCode)
+		}
+	}
+	after, err := db.CountRecentVisualizations(ctx, dbx.Read, feed.ID, since)
+	if err != nil {
+		return err
+	}
+	if after != before {
+		return fmt.Errorf("304 responses counted as visualizations: %d -> %d", before, after)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, feedURL, nil)
+	req.Header.Set("If-None-Match", `"stale"`)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("stale etag status=%d, want 200", resp.StatusCode)
+	}
+
+	resp, err = http.Head(feedURL)
+	if err != nil {
+		return err
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(body) != 0 || resp.Header.Get("ETag") != etag {
+		return fmt.Errorf("head status=%d body=%d etag=%q", resp.StatusCode, len(body), resp.Header.Get("ETag"))
+	}
+	return nil
+}
+
+func verifyEntryHTML(httpAddr string, dbx *db.DB, created createdFeed) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	feed, err := db.GetFeedByPublicID(ctx, dbx.SQL, feedID)
+	feed, err := db.GetFeedByPublicID(ctx, dbx.Read, created.FeedID)
 	if err != nil {
 		return fmt.Errorf("load feed: %w", err)
 	}
-	entries, err := db.GetFeedEntriesDesc(ctx, dbx.SQL, feed.ID)
+	entries, err := db.GetFeedEntriesDesc(ctx, dbx.Read, feed.ID)
 	if err != nil {
 		return fmt.Errorf("entries: %w", err)
 	}
 	if len(entries) == 0 {
-		return fmt.Errorf("no entries found for feed %s", feedID)
+		return fmt.Errorf("no entries found for feed %s", created.FeedID)
 	}
 	entry := entries[0]
-	url := fmt.Sprintf("http://%s/feeds/%s/entries/%s.html", httpAddr, feedID, entry.PublicID)
+	url := fmt.Sprintf("http://%s/feeds/%s/entries/%s.html", httpAddr, feed.ReadToken, entry.PublicID)
 	resp, err := http.Get(url)
 	if err != nil {
 		return fmt.Errorf("get entry html: %w", err)
@@ -267,5 +611,529 @@ func verifyEntryHTML(httpAddr string, dbx *db.DB, feedID string) error {
 	if !strings.Contains(string(body), "Hello") {
 		return fmt.Errorf("entry html missing expected content: %s", string(body))
 	}
+	if !strings.Contains(string(body), "<iframe") || !strings.Contains(string(body), `sandbox="`) || !strings.Contains(string(body), html.EscapeString(entry.Title)) {
+		return fmt.Errorf("entry html missing wrapper: %s", string(body))
+	}
+	// Missing feeds and entries are 404s everywhere.
+	for _, missing := range []string{
+		fmt.Sprintf("/feeds/%s/entries/missing.html", feed.ReadToken),
+		"/feeds/missing/entries/missing.html",
+		"/feeds/missing.xml",
+		"/feeds/missing.json",
+		"/feeds/missing",
+	} {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", httpAddr, missing))
+		if err != nil {
+			return err
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound || !strings.Contains(string(body), "Not Found") {
+			return fmt.Errorf("%s status=%d, want 404 page", missing, resp.StatusCode)
+		}
+	}
+	return nil
+}
+
+func apiRequest(method, url, token string, body io.Reader, out any) (int, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("decode %s %s: %w", method, url, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func verifyAPI(httpAddr string, dbx *db.DB, feed createdFeed) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	token := "e2e-api-token"
+	if err := dbx.Tx(ctx, func(tx *db.Tx) error {
+		_, err := db.CreateAPIToken(ctx, tx, "e2e", httpserver.HashAPIToken(token), time.Now().UTC().Format(time.RFC3339Nano))
+		return err
+	}); err != nil {
+		return fmt.Errorf("create token: %w", err)
+	}
+	base := fmt.Sprintf("http://%s/api/v1", httpAddr)
+
+	var apiErr struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	status, err := apiRequest(http.MethodGet, base+"/feeds", "wrong", nil, &apiErr)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusUnauthorized || apiErr.Error.Code != "unauthorized" {
+		return fmt.Errorf("invalid token status=%d code=%q", status, apiErr.Error.Code)
+	}
+
+	var feeds struct {
+		Feeds []struct {
+			ID    string `json:"id"`
+			Title string `json:"title"`
+			Email string `json:"email"`
+		} `json:"feeds"`
+	}
+	if _, err := apiRequest(http.MethodGet, base+"/feeds", token, nil, &feeds); err != nil {
+		return err
+	}
+	if len(feeds.Feeds) != 1 || feeds.Feeds[0].ID != feed.FeedID || feeds.Feeds[0].Email != feed.Email {
+		return fmt.Errorf("unexpected feeds: %+v", feeds.Feeds)
+	}
+
+	var updated struct {
+		Title string  `json:"title"`
+		Icon  *string `json:"icon"`
+	}
+	status, err = apiRequest(http.MethodPatch, base+"/feeds/"+feed.FeedID, token, strings.NewReader(`{"title":"Renamed Feed","icon":"https://example.com/icon.png"}`), &updated)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK || updated.Title != "Renamed Feed" || updated.Icon == nil {
+		return fmt.Errorf("patch feed status=%d body=%+v", status, updated)
+	}
+
+	var entries struct {
+		Entries []struct {
+			ID    string `json:"id"`
+			Title string `json:"title"`
+		} `json:"entries"`
+		NextBefore *string `json:"nextBefore"`
+	}
+	if _, err := apiRequest(http.MethodGet, base+"/feeds/"+feed.FeedID+"/entries?limit=10", token, nil, &entries); err != nil {
+		return err
+	}
+	if len(entries.Entries) != 1 || entries.NextBefore != nil {
+		return fmt.Errorf("unexpected entries: %+v", entries)
+	}
+	entryURL := base + "/feeds/" + feed.FeedID + "/entries/" + entries.Entries[0].ID
+
+	var enclosures struct {
+		Enclosures []any `json:"enclosures"`
+	}
+	status, err = apiRequest(http.MethodGet, entryURL+"/enclosures", token, nil, &enclosures)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK || enclosures.Enclosures == nil {
+		return fmt.Errorf("enclosures status=%d", status)
+	}
+
+	status, err = apiRequest(http.MethodGet, base+"/feeds/"+feed.FeedID+"/entries/missing", token, nil, &apiErr)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusNotFound || apiErr.Error.Code != "not_found" {
+		return fmt.Errorf("missing entry status=%d code=%q", status, apiErr.Error.Code)
+	}
+	return nil
+}
+
+// verifyRetention sets a per-feed entry limit from the settings page and
+// checks that older entries are trimmed when new mail arrives.
+func verifyRetention(httpAddr string, dbx *db.DB, cfg config.Config, created createdFeed) error {
+	form := url.Values{}
+	form.Set("title", "Example Feed")
+	form.Set("retentionMaxEntries", "2")
+	form.Set("privacyCleaning", "on")
+	req, _ := http.NewRequest(http.MethodPatch, fmt.Sprintf("http://%s%s", httpAddr, path(created.Settings)), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		return fmt.Errorf("update settings status=%d", resp.StatusCode)
+	}
+	for _, subject := range []string{"Retention One", "Retention Two"} {
+		sendMessage(cfg.SMTPPort, created.Email, cfg.Hostname, subject, "<p>"+subject+"</p>")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	feed, err := db.GetFeedByPublicID(ctx, dbx.Read, created.FeedID)
+	if err != nil {
+		return err
+	}
+	if !feed.RetentionMaxEntries.Valid || feed.RetentionMaxEntries.Int64 != 2 {
+		return fmt.Errorf("retention override not stored: %+v", feed.RetentionMaxEntries)
+	}
+	entries, err := db.GetFeedEntriesDesc(ctx, dbx.Read, feed.ID)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 2 || entries[0].Title != "Retention Two" || entries[1].Title != "Retention One" {
+		return fmt.Errorf("unexpected entries after retention: %d", len(entries))
+	}
+	return nil
+}
+
+// verifyEntryBrowsing checks the entry list on the settings page and deleting
+// an entry from it.
+func verifyEntryBrowsing(httpAddr string, created createdFeed) error {
+	settingsURL := fmt.Sprintf("http://%s%s", httpAddr, path(created.Settings))
+	resp, err := http.Get(settingsURL)
+	if err != nil {
+		return err
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), "Retention Two") || !strings.Contains(string(page), "Sender") {
+		return fmt.Errorf("settings page doesn't list entries")
+	}
+	m := regexp.MustCompile(`/feeds/[a-z0-9]+/entries/([a-z0-9]+)\.html`).FindStringSubmatch(string(page))
+	if m == nil {
+		return fmt.Errorf("settings page has no open links")
+	}
+	req, _ := http.NewRequest(http.MethodDelete, settingsURL+"/entries/"+m[1], nil)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err = client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		return fmt.Errorf("delete entry status=%d", resp.StatusCode)
+	}
+	// The read token doesn't grant access to deleting entries.
+	req, _ = http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s%s/entries/%s", httpAddr, strings.TrimSuffix(path(created.Feed), ".xml"), m[1]), nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("delete with read token status=%d", resp.StatusCode)
+	}
+	resp, err = http.Get(settingsURL)
+	if err != nil {
+		return err
+	}
+	page, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(page), m[1]) {
+		return fmt.Errorf("deleted entry still listed")
+	}
+	return nil
+}
+
+// verifyDeduplication checks that redelivered messages, with or without a
+// Message-ID, are ignored and that messages with new content for the same
+// Message-ID, or superseding an earlier one, update its entry.
+func verifyDeduplication(httpAddr string, dbx *db.DB, cfg config.Config, created createdFeed) error {
+	ctx := context.Background()
+	f, err := db.GetFeedByPublicID(ctx, dbx.Read, created.FeedID)
+	if err != nil {
+		return err
+	}
+	count := func() (int, error) {
+		entries, err := db.GetFeedEntriesDesc(ctx, dbx.Read, f.ID)
+		return len(entries), err
+	}
+	before, err := count()
+	if err != nil {
+		return err
+	}
+	first := []string{"Message-ID: <dedup-1@example.com>"}
+	sendMessageWithHeaders(cfg.SMTPPort, created.Email, cfg.Hostname, "Dedup", "<p>Dedup one</p>", first)
+	sendMessageWithHeaders(cfg.SMTPPort, created.Email, cfg.Hostname, "Dedup", "<p>Dedup one</p>", first)
+	if n, err := count(); err != nil || n != before+1 {
+		return fmt.Errorf("after redelivery: %d entries, want %d (%v)", n, before+1, err)
+	}
+
+	// Without a Message-ID, redeliveries are recognized by their content. The
+	// feed above keeps two entries, so this uses another one.
+	anonymous := createFeed(httpAddr)
+	af, err := db.GetFeedByPublicID(ctx, dbx.Read, anonymous.FeedID)
+	if err != nil || af == nil {
+		return fmt.Errorf("load feed: %v", err)
+	}
+	sendMessage(cfg.SMTPPort, anonymous.Email, cfg.Hostname, "Dedup Anonymous", "<p>No Message-ID</p>")
+	sendMessage(cfg.SMTPPort, anonymous.Email, cfg.Hostname, "Dedup Anonymous", "<p>No Message-ID</p>")
+	if entries, err := db.GetFeedEntriesDesc(ctx, dbx.Read, af.ID); err != nil || len(entries) != 1 {
+		return fmt.Errorf("after redelivery without a Message-ID: %d entries, want 1 (%v)", len(entries), err)
+	}
+	sendMessageWithHeaders(cfg.SMTPPort, created.Email, cfg.Hostname, "Dedup", "<p>Dedup corrected</p>", first)
+	sendMessageWithHeaders(cfg.SMTPPort, created.Email, cfg.Hostname, "Dedup", "<p>Dedup superseded</p>",
+		[]string{"Message-ID: <dedup-2@example.com>", "Supersedes: <dedup-1@example.com>"})
+	if n, err := count(); err != nil || n != before+1 {
+		return fmt.Errorf("after update: %d entries, want %d (%v)", n, before+1, err)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", httpAddr, path(created.Feed)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var doc struct {
+		Entries []struct {
+			Title     string `xml:"title"`
+			Published string `xml:"published"`
+			Updated   string `xml:"updated"`
+		} `xml:"entry"`
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(body), "Dedup superseded") || strings.Contains(string(body), "Dedup one") {
+		return fmt.Errorf("entry content not updated")
+	}
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		return err
+	}
+	for _, e := range doc.Entries {
+		if e.Title != "Dedup" {
+			continue
+		}
+		if !(e.Updated > e.Published) {
+			return fmt.Errorf("updated %q not after published %q", e.Updated, e.Published)
+		}
+		return nil
+	}
+	return fmt.Errorf("entry not in feed")
+}
+
+func hasHeader(headers []string, name string) bool {
+	for _, h := range headers {
+		if strings.HasPrefix(strings.ToLower(h), strings.ToLower(name)+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyHeaderMetadata checks that entries take their author from the From
+// header and their published date from a plausible Date header.
+func verifyHeaderMetadata(httpAddr string, cfg config.Config, created createdFeed) error {
+	type atomEntry struct {
+		Title     string `xml:"title"`
+		Published string `xml:"published"`
+		Updated   string `xml:"updated"`
+		Author    struct {
+			Name  string `xml:"name"`
+			Email string `xml:"email"`
+		} `xml:"author"`
+	}
+	latest := func(title string) (*atomEntry, error) {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", httpAddr, path(created.Feed)))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		var doc struct {
+			Entries []atomEntry `xml:"entry"`
+		}
+		if err := xml.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			return nil, err
+		}
+		for _, e := range doc.Entries {
+			if e.Title == title {
+				return &e, nil
+			}
+		}
+		return nil, fmt.Errorf("entry %q not in feed", title)
+	}
+
+	date := time.Now().Add(-48 * time.Hour).UTC().Truncate(time.Second)
+	sendMessageWithHeaders(cfg.SMTPPort, created.Email, cfg.Hostname, "Dated", "<p>Dated</p>", []string{
+		"From: \"Newsletter Team\" <team@news.example.com>",
+		"Date: " + date.Format(time.RFC1123Z),
+	})
+	e, err := latest("Dated")
+	if err != nil {
+		return err
+	}
+	if e.Author.Name != "Newsletter Team" || e.Author.Email != "team@news.example.com" {
+		return fmt.Errorf("author = %+v", e.Author)
+	}
+	if published, err := time.Parse(time.RFC3339Nano, e.Published); err != nil || !published.Equal(date) {
+		return fmt.Errorf("published = %q, want %s", e.Published, date.Format(time.RFC3339))
+	}
+	if updated, err := time.Parse(time.RFC3339Nano, e.Updated); err != nil || time.Since(updated) > time.Minute {
+		return fmt.Errorf("updated = %q, want receive time", e.Updated)
+	}
+
+	// A Date far in the future is clock skew; the receive time is used instead.
+	sendMessageWithHeaders(cfg.SMTPPort, created.Email, cfg.Hostname, "Skewed", "<p>Skewed</p>", []string{
+		"Date: " + time.Now().AddDate(5, 0, 0).Format(time.RFC1123Z),
+	})
+	e, err = latest("Skewed")
+	if err != nil {
+		return err
+	}
+	if e.Published != e.Updated || e.Author.Name != "Sender" || e.Author.Email != "sender@example.com" {
+		return fmt.Errorf("skewed entry = %+v", e)
+	}
+	return nil
+}
+
+// verifyInlineImages checks that cid: references are rewritten to the served
+// inline part and that referenced inlines aren't listed as enclosures.
+func verifyInlineImages(httpAddr string, cfg config.Config, created createdFeed) error {
+	body := strings.Join([]string{
+		"--outer",
+		"Content-Type: multipart/related; boundary=related",
+		"",
+		"--related",
+		"Content-Type: text/html; charset=utf-8",
+		"",
+		`<p>Inline <img src="cid:logo@example.com" alt="logo"></p>`,
+		"--related",
+		"Content-Type: image/png",
+		"Content-ID: <logo@example.com>",
+		"Content-Disposition: inline; filename=logo.png",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"iVBORw0KGgo=",
+		"--related--",
+		"--outer",
+		"Content-Type: text/plain",
+		"Content-Disposition: attachment; filename=notes.txt",
+		"",
+		"Some notes",
+		"--outer--",
+	}, "\r\n")
+	sendMessageWithHeaders(cfg.SMTPPort, created.Email, cfg.Hostname, "Inline Images", body,
+		[]string{"Content-Type: multipart/mixed; boundary=outer"})
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", httpAddr, path(created.Feed)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	doc := string(raw)
+	at := strings.Index(doc, "<title>Inline Images</title>")
+	if at == -1 {
+		return fmt.Errorf("entry not in feed")
+	}
+	entry := doc[strings.LastIndex(doc[:at], "<entry>"):]
+	entry = entry[:strings.Index(entry, "</entry>")]
+	if strings.Contains(entry, "cid:") || !regexp.MustCompile(`/files/[a-z0-9]+/logo\.png`).MatchString(entry) {
+		return fmt.Errorf("cid: reference not rewritten: %s", entry)
+	}
+	enclosures := regexp.MustCompile(`rel="enclosure"[^>]*href="([^"]+)"`).FindAllStringSubmatch(entry, -1)
+	if len(enclosures) != 1 || !strings.HasSuffix(enclosures[0][1], "/notes.txt") {
+		return fmt.Errorf("enclosures = %v, want only notes.txt", enclosures)
+	}
+	return nil
+}
+
+// verifySanitization checks that active content is removed from stored
+// entries while layout is kept, and that the original is stored separately.
+func verifySanitization(httpAddr string, dbx *db.DB, cfg config.Config, created createdFeed) error {
+	body := `<html><head><meta http-equiv="refresh" content="0;url=https://evil.example.com/"><base href="https://evil.example.com/"></head>` +
+		`<body onload="steal()"><table width="600" cellpadding="0" style="margin:0 auto"><tr><td bgcolor="#ffffff">` +
+		`<a href="javascript:steal()">Bad link</a> <a href="https://example.com/read">Good link</a>` +
+		`<script>steal()</script><form action="https://evil.example.com/"><input name="password"></form>` +
+		`<img src="https://example.com/hero.png" onerror="steal()" width="600"></td></tr></table></body></html>`
+	sendMessage(cfg.SMTPPort, created.Email, cfg.Hostname, "Sanitized", body)
+	ctx := context.Background()
+	f, err := db.GetFeedByPublicID(ctx, dbx.Read, created.FeedID)
+	if err != nil {
+		return err
+	}
+	entries, err := db.GetFeedEntriesDesc(ctx, dbx.Read, f.ID)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 || entries[0].Title != "Sanitized" {
+		return fmt.Errorf("entry not stored")
+	}
+	content := entries[0].Content
+	for _, bad := range []string{"<script", "steal()", "onload", "onerror", "javascript:", "<form", "<input", "<meta", "<base", "evil.example.com"} {
+		if strings.Contains(content, bad) {
+			return fmt.Errorf("sanitized content contains %q: %s", bad, content)
+		}
+	}
+	for _, good := range []string{`width="600"`, `bgcolor="#ffffff"`, `style="margin:0 auto"`, `href="https://example.com/read"`, `src="https://example.com/hero.png"`, "Bad link"} {
+		if !strings.Contains(content, good) {
+			return fmt.Errorf("sanitized content lost %q: %s", good, content)
+		}
+	}
+	var original string
+	if err := dbx.Read.QueryRowContext(ctx, `SELECT originalContent FROM feedEntries WHERE id=?`, entries[0].ID).Scan(&original); err != nil {
+		return err
+	}
+	if strings.TrimSpace(original) != body {
+		return fmt.Errorf("original content not kept: %s", original)
+	}
+	return nil
+}
+
+// verifyPrivacyCleaning checks that tracking is removed from new entries and
+// restored in existing ones when the feed turns privacy cleaning off.
+func verifyPrivacyCleaning(httpAddr string, dbx *db.DB, cfg config.Config, created createdFeed) error {
+	body := `<p><a href="https://example.com/article?id=7&amp;utm_source=newsletter&amp;utm_medium=email">Article</a>` +
+		` <a href="https://www.google.com/url?q=https%3A%2F%2Fexample.com%2Fwrapped%3Futm_campaign%3Dx&amp;sa=D">Wrapped</a></p>` +
+		`<img src="https://tracker.example.com/o.gif?id=abc" width="1" height="1" alt="">` +
+		`<img src="https://example.com/photo.jpg" width="600" alt="Photo">`
+	sendMessage(cfg.SMTPPort, created.Email, cfg.Hostname, "Tracked", body)
+	ctx := context.Background()
+	f, err := db.GetFeedByPublicID(ctx, dbx.Read, created.FeedID)
+	if err != nil {
+		return err
+	}
+	entry := func() (*db.FeedEntry, error) {
+		entries, err := db.GetFeedEntriesDesc(ctx, dbx.Read, f.ID)
+		if err != nil || len(entries) == 0 || entries[0].Title != "Tracked" {
+			return nil, fmt.Errorf("entry not stored (%v)", err)
+		}
+		return &entries[0], nil
+	}
+	e, err := entry()
+	if err != nil {
+		return err
+	}
+	for _, bad := range []string{"utm_", "tracker.example.com", "google.com"} {
+		if strings.Contains(e.Content, bad) {
+			return fmt.Errorf("cleaned content contains %q: %s", bad, e.Content)
+		}
+	}
+	for _, good := range []string{`href="https://example.com/article?id=7"`, `href="https://example.com/wrapped"`, "photo.jpg"} {
+		if !strings.Contains(e.Content, good) {
+			return fmt.Errorf("cleaned content lost %q: %s", good, e.Content)
+		}
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/feeds/%s/entries/%s.html", httpAddr, f.ReadToken, e.PublicID))
+	if err != nil {
+		return err
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), "Privacy cleaned: removed 1 tracking pixel, 3 tracking parameters and 1 redirect.") {
+		return fmt.Errorf("entry page has no privacy note: %s", page)
+	}
+
+	status, err := apiRequest(http.MethodPatch, fmt.Sprintf("http://%s/api/v1/feeds/%s", httpAddr, created.FeedID), "e2e-api-token", strings.NewReader(`{"privacyCleaning":false}`), nil)
+	if err != nil || status != http.StatusOK {
+		return fmt.Errorf("disable privacy cleaning status=%d (%v)", status, err)
+	}
+	if e, err = entry(); err != nil {
+		return err
+	}
+	if !strings.Contains(e.Content, "utm_source=newsletter") || !strings.Contains(e.Content, "tracker.example.com") || e.PrivacyReport.Valid {
+		return fmt.Errorf("existing entry not restored: %s", e.Content)
+	}
 	return nil
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+)
+
+// legacySchema is the schema of the first release, from before migrations
+// were numbered.
+const legacySchema = `
+CREATE TABLE feeds (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  publicId TEXT NOT NULL UNIQUE,
+  title TEXT NOT NULL,
+  icon TEXT NULL,
+  emailIcon TEXT NULL
+);
+CREATE TABLE feedEntries (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  publicId TEXT NOT NULL UNIQUE,
+  feed INTEGER NOT NULL REFERENCES feeds(id) ON DELETE CASCADE,
+  createdAt TEXT NOT NULL,
+  author TEXT NULL,
+  title TEXT NOT NULL,
+  content TEXT NOT NULL
+);
+CREATE TABLE feedEntryEnclosures (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  publicId TEXT NOT NULL UNIQUE,
+  type TEXT NOT NULL,
+  length INTEGER NOT NULL,
+  name TEXT NOT NULL
+);
+CREATE TABLE feedEntryEnclosureLinks (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  feedEntry INTEGER NOT NULL REFERENCES feedEntries(id) ON DELETE CASCADE,
+  feedEntryEnclosure INTEGER NOT NULL REFERENCES feedEntryEnclosures(id) ON DELETE CASCADE
+);
+CREATE TABLE feedVisualizations (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  feed INTEGER NOT NULL REFERENCES feeds(id) ON DELETE CASCADE,
+  createdAt TEXT NOT NULL
+);
+CREATE TABLE feedWebSubSubscriptions (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  feed INTEGER NOT NULL REFERENCES feeds(id) ON DELETE CASCADE,
+  createdAt TEXT NOT NULL,
+  callback TEXT NOT NULL,
+  secret TEXT NULL,
+  UNIQUE(feed, callback)
+);
+CREATE TABLE backgroundJobs (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  type TEXT NOT NULL,
+  startAt TEXT NOT NULL,
+  parameters TEXT NOT NULL,
+  retries INTEGER NOT NULL DEFAULT 0,
+  status TEXT NOT NULL DEFAULT 'pending'
+);
+INSERT INTO feeds (publicId, title) VALUES ('legacyfeed', 'Legacy Feed');
+INSERT INTO feedEntries (publicId, feed, createdAt, author, title, content)
+  VALUES ('legacyentry', 1, '2020-01-02T03:04:05.000Z', 'sender@example.com', 'Legacy Entry', '<p>Legacy body</p>');
+`
+
+// verifyMigrations upgrades a database from before migrations were numbered,
+// checks that its data is carried over, and that a database migrated by a
+// newer version isn't opened.
+func verifyMigrations(dir string) error {
+	ctx := context.Background()
+	dataDir := filepath.Join(dir, "legacy")
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return err
+	}
+	raw, err := sql.Open("sqlite", "file:"+filepath.Join(dataDir, "kill-the-newsletter.db"))
+	if err != nil {
+		return err
+	}
+	if _, err := raw.ExecContext(ctx, legacySchema); err != nil {
+		raw.Close()
+		return err
+	}
+	raw.Close()
+
+	dbx, err := db.Open(dataDir)
+	if err != nil {
+		return fmt.Errorf("upgrade legacy database: %w", err)
+	}
+	migrations, err := dbx.Migrations(ctx)
+	if err != nil {
+		dbx.Close()
+		return err
+	}
+	for _, m := range migrations {
+		if m.AppliedAt == "" {
+			dbx.Close()
+			return fmt.Errorf("migration %s wasn't applied", m)
+		}
+	}
+	f, err := db.GetFeedByReadToken(ctx, dbx.Read, "legacyfeed")
+	if err != nil || f == nil || f.LastEntrySequence != 1 {
+		dbx.Close()
+		return fmt.Errorf("legacy feed isn't readable by its public id: %+v, %v", f, err)
+	}
+	found, err := db.SearchEntries(ctx, dbx.Read, f.ID, "legacy body", 10)
+	if err != nil || len(found) != 1 {
+		dbx.Close()
+		return fmt.Errorf("legacy entry isn't searchable: %d, %v", len(found), err)
+	}
+	// A migration that this version doesn't know means a newer version
+	// changed the schema.
+	if _, err := dbx.Write.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, appliedAt) VALUES (?, 'from_the_future', '2100-01-01T00:00:00.000Z')`, len(migrations)+1); err != nil {
+		dbx.Close()
+		return err
+	}
+	dbx.Close()
+	if dbx, err := db.Open(dataDir); !errors.Is(err, db.ErrSchemaTooNew) {
+		if err == nil {
+			dbx.Close()
+		}
+		return fmt.Errorf("database with a newer schema was opened: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/config"
+	"github.com/jtsang4/kill-the-newsletter/internal/outbound"
+)
+
+// verifyOutbound checks that requests to WebSub callbacks can't reach
+// blocked networks, directly, through host names or through redirects, and
+// that redirects and response bodies are limited.
+func verifyOutbound(cfg config.Config, httpAddr string) error {
+	var userAgent string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/redirect/"):
+			n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+			if n > 0 {
+				http.Redirect(w, r, fmt.Sprintf("/redirect/%d", n-1), http.StatusFound)
+				return
+			}
+		case r.URL.Path == "/large":
+			w.Header().Set("Content-Length", strconv.Itoa(outbound.MaxBodyBytes+1))
+			_, _ = w.Write(bytes.Repeat([]byte("a"), outbound.MaxBodyBytes+1))
+			return
+		case r.URL.Path == "/large-chunked":
+			// Flushing first leaves the length out of the headers.
+			w.(http.Flusher).Flush()
+			_, _ = w.Write(bytes.Repeat([]byte("a"), outbound.MaxBodyBytes+1))
+			return
+		case r.URL.Path == "/internal":
+			http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+
+	// By default, loopback is blocked whether it's named by address or by
+	// host name, which is only resolved when connecting.
+	strict := outbound.New(config.Config{Hostname: cfg.Hostname})
+	for _, u := range []string{target.URL + "/", "http://localhost:" + port + "/"} {
+		if _, err := strict.Get(u); !errors.Is(err, outbound.ErrBlocked) {
+			return fmt.Errorf("GET %s with the default blocklist: %v", u, err)
+		}
+	}
+	for u, ok := range map[string]bool{
+		"http://127.0.0.1/":                 false,
+		"http://localhost/":                 false,
+		"http://[::1]:8080/":                false,
+		"http://[::ffff:10.0.0.1]/":         false,
+		"http://169.254.169.254/latest/":    false,
+		"ftp://example.com/":                false,
+		"https://example.com/websub?a=1":    true,
+		"http://subscriber.example.org:81/": true,
+	} {
+		if err := strict.CheckURL(u); (err == nil) != ok {
+			return fmt.Errorf("CheckURL(%s) = %v", u, err)
+		}
+	}
+
+	// The hub refuses callbacks on blocked networks.
+	created := createFeed(httpAddr)
+	resp, err := http.PostForm("http://"+httpAddr+strings.TrimSuffix(path(created.Feed), ".xml")+"/websub", url.Values{
+		"hub.mode":     {"subscribe"},
+		"hub.topic":    {created.Feed},
+		"hub.callback": {"http://169.254.169.254/latest/meta-data/"},
+	})
+	if err != nil {
+		return err
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || string(b) != "invalid callback host" {
+		return fmt.Errorf("hub accepted a callback on a blocked network: %s %s", resp.Status, b)
+	}
+
+	// Redirects go through the same checks. 127.0.0.2 is loopback too, so it
+	// stands in for an internal address here.
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		return err
+	}
+	internal := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "secret")
+	}))
+	internal.Listener.Close()
+	internal.Listener = l
+	internal.Start()
+	defer internal.Close()
+	client := outbound.New(config.Config{Hostname: cfg.Hostname, OutboundBlockedNetworks: []string{"127.0.0.2"}})
+	if _, err := client.Get(target.URL + "/internal?to=" + url.QueryEscape(internal.URL+"/")); !errors.Is(err, outbound.ErrBlocked) {
+		return fmt.Errorf("redirect to a blocked network: %v", err)
+	}
+
+	resp, err = client.Get(target.URL + "/redirect/3")
+	if err != nil {
+		return fmt.Errorf("3 redirects: %v", err)
+	}
+	outbound.Discard(resp)
+	if want := "Kill the Newsletter! (+https://" + cfg.Hostname + "/)"; userAgent != want {
+		return fmt.Errorf("User-Agent is %q, want %q", userAgent, want)
+	}
+	if _, err := client.Get(target.URL + "/redirect/5"); err == nil {
+		return errors.New("5 redirects were followed")
+	}
+
+	if _, err := client.Get(target.URL + "/large"); !errors.Is(err, outbound.ErrTooLarge) {
+		return fmt.Errorf("response with a large Content-Length: %v", err)
+	}
+	resp, err = client.Get(target.URL + "/large-chunked")
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !errors.Is(err, outbound.ErrTooLarge) {
+		return fmt.Errorf("large response without a length: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/config"
+)
+
+// pagedDocument is the part of an Atom document that paging is checked on.
+type pagedDocument struct {
+	Links []struct {
+		Rel  string `xml:"rel,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"link"`
+	Archive *struct{} `xml:"http://purl.org/syndication/history/1.0 archive"`
+	Entries []struct {
+		Title string `xml:"title"`
+	} `xml:"entry"`
+	raw  []byte
+	etag string
+}
+
+func (d pagedDocument) link(rel string) string {
+	for _, l := range d.Links {
+		if l.Rel == rel {
+			return l.Href
+		}
+	}
+	return ""
+}
+
+func (d pagedDocument) titles() string {
+	var titles []string
+	for _, e := range d.Entries {
+		titles = append(titles, e.Title)
+	}
+	return strings.Join(titles, ",")
+}
+
+// fetchPaged fetches and validates an Atom document, returning nil if it
+// doesn't exist.
+func fetchPaged(httpAddr, rawURL string) (*pagedDocument, error) {
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", httpAddr, path(rawURL)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: status %d", rawURL, resp.StatusCode)
+	}
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateAtom(raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", rawURL, err)
+	}
+	d := pagedDocument{raw: raw, etag: resp.Header.Get("ETag")}
+	if err := xml.Unmarshal(raw, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// verifyPaging fills a feed past a few pages and walks its RFC 5005 links
+// from the subscription document to the oldest archive, checking that
+// archives are complete, stable pages.
+func verifyPaging(httpAddr string, cfg config.Config) error {
+	size := cfg.FeedPageSize
+	created := createFeed(httpAddr)
+	title := func(n int) string { return fmt.Sprintf("Page %02d", n) }
+	// Two complete archives and part of a third page.
+	total := 2*size + size/2
+	for n := 1; n <= total; n++ {
+		sendMessage(cfg.SMTPPort, created.Email, cfg.Hostname, title(n), "<p>"+title(n)+"</p>")
+	}
+	titles := func(from, to int) string {
+		var out []string
+		for n := to; n >= from; n-- {
+			out = append(out, title(n))
+		}
+		return strings.Join(out, ",")
+	}
+
+	current, err := fetchPaged(httpAddr, created.Feed)
+	if err != nil {
+		return err
+	}
+	if got, want := current.titles(), titles(total-size+1, total); got != want {
+		return fmt.Errorf("subscription document has %s, want %s", got, want)
+	}
+	if current.Archive != nil || current.link("current") != created.Feed || current.link("first") != created.Feed {
+		return fmt.Errorf("subscription document links: %+v", current.Links)
+	}
+	if !strings.HasSuffix(current.link("prev-archive"), "/archives/2.xml") || current.link("next") != current.link("prev-archive") {
+		return fmt.Errorf("subscription document doesn't link to the newest archive: %+v", current.Links)
+	}
+
+	newest, err := fetchPaged(httpAddr, current.link("prev-archive"))
+	if err != nil || newest == nil {
+		return fmt.Errorf("newest archive: %v", err)
+	}
+	if got, want := newest.titles(), titles(size+1, 2*size); got != want {
+		return fmt.Errorf("archive 2 has %s, want %s", got, want)
+	}
+	if newest.Archive == nil || newest.link("current") != created.Feed || newest.link("next-archive") != "" || newest.link("hub") != "" {
+		return fmt.Errorf("archive 2 links: %+v", newest.Links)
+	}
+	oldest, err := fetchPaged(httpAddr, newest.link("prev-archive"))
+	if err != nil || oldest == nil {
+		return fmt.Errorf("oldest archive: %v", err)
+	}
+	if got, want := oldest.titles(), titles(1, size); got != want {
+		return fmt.Errorf("archive 1 has %s, want %s", got, want)
+	}
+	if oldest.link("prev-archive") != "" || oldest.link("next-archive") != current.link("prev-archive") {
+		return fmt.Errorf("archive 1 links: %+v", oldest.Links)
+	}
+	// The third page isn't complete yet, so it isn't an archive.
+	if doc, err := fetchPaged(httpAddr, strings.Replace(current.link("prev-archive"), "/2.xml", "/3.xml", 1)); err != nil || doc != nil {
+		return fmt.Errorf("incomplete archive 3 is served: %v", err)
+	}
+
+	// New entries don't change existing archives.
+	sendMessage(cfg.SMTPPort, created.Email, cfg.Hostname, title(total+1), "<p>"+title(total+1)+"</p>")
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s%s", httpAddr, path(newest.link("prev-archive"))), nil)
+	req.Header.Set("If-None-Match", oldest.etag)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		return fmt.Errorf("archive 1 changed after a new entry: status %d", resp.StatusCode)
+	}
+	again, err := fetchPaged(httpAddr, newest.link("prev-archive"))
+	if err != nil || again == nil || string(again.raw) != string(oldest.raw) {
+		return fmt.Errorf("archive 1 isn't stable: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/config"
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+	"github.com/jtsang4/kill-the-newsletter/internal/worker"
+)
+
+// webhookRequest is a delivery received by the fake webhook endpoint.
+type webhookRequest struct {
+	Header http.Header
+	Body   []byte
+}
+
+// verifyWebhooks checks that webhooks are managed from the API and the feed
+// page, that new entries are delivered to them signed, that failed
+// deliveries are retried, and that every attempt is in the delivery log.
+func verifyWebhooks(httpAddr string, dbx *db.DB, cfg config.Config) error {
+	ctx := context.Background()
+	const token = "e2e-api-token"
+	var mu sync.Mutex
+	var received []webhookRequest
+	failures := 1
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, webhookRequest{Header: r.Header, Body: b})
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer endpoint.Close()
+	waitForRequests := func(n int) ([]webhookRequest, error) {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			mu.Lock()
+			got := append([]webhookRequest(nil), received...)
+			mu.Unlock()
+			if len(got) >= n {
+				return got, nil
+			}
+			if time.Now().After(deadline) {
+				return got, fmt.Errorf("webhook got %d requests after 10s, want %d", len(got), n)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	created := createFeed(httpAddr)
+	base := fmt.Sprintf("http://%s/api/v1/feeds/%s/webhooks", httpAddr, created.FeedID)
+	var apiErr struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	status, err := apiRequest(http.MethodPost, base, token, strings.NewReader(`{"url":"http://169.254.169.254/latest/"}`), &apiErr)
+	if err != nil || status != http.StatusBadRequest || apiErr.Error.Code != "invalid_url" {
+		return fmt.Errorf("webhook on a blocked network: %d %q %v", status, apiErr.Error.Code, err)
+	}
+	apiErr.Error.Code = ""
+	status, err = apiRequest(http.MethodPost, base, token, strings.NewReader(`{"url":"https://`+cfg.Hostname+path(created.Settings)+`"}`), &apiErr)
+	if err != nil || status != http.StatusBadRequest || apiErr.Error.Code != "invalid_url" {
+		return fmt.Errorf("webhook on this instance: %d %q %v", status, apiErr.Error.Code, err)
+	}
+	// Neither can URLs on this instance's host name in another case, or with
+	// a port or userinfo, nor such WebSub callbacks.
+	for _, u := range []string{
+		"https://" + strings.ToUpper(cfg.Hostname) + "/feeds",
+		"https://" + cfg.Hostname + ":443/feeds",
+		"https://someone@" + cfg.Hostname + "/feeds",
+		"http://" + cfg.Hostname + "./feeds",
+	} {
+		apiErr.Error.Code = ""
+		status, err := apiRequest(http.MethodPost, base, token, strings.NewReader(`{"url":"`+u+`"}`), &apiErr)
+		if err != nil || status != http.StatusBadRequest || apiErr.Error.Code != "invalid_url" {
+			return fmt.Errorf("webhook %s: %d %q %v", u, status, apiErr.Error.Code, err)
+		}
+		if status, _, err := hubRequest(httpAddr, created, "subscribe", u, nil); err != nil || status != http.StatusBadRequest {
+			return fmt.Errorf("websub callback %s: %d %v", u, status, err)
+		}
+	}
+	var hook struct {
+		ID     string `json:"id"`
+		URL    string `json:"url"`
+		Secret string `json:"secret"`
+	}
+	status, err = apiRequest(http.MethodPost, base, token, strings.NewReader(`{"url":"`+endpoint.URL+`/api"}`), &hook)
+	if err != nil || status != http.StatusCreated || hook.ID == "" || hook.Secret == "" {
+		return fmt.Errorf("create webhook: %d %+v %v", status, hook, err)
+	}
+
+	// A webhook added from the feed page is listed there.
+	settings := "http://" + httpAddr + path(created.Settings)
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirects.PostForm(settings+"/webhooks", url.Values{"url": {endpoint.URL + "/page"}})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		return fmt.Errorf("add webhook from the feed page: %s", resp.Status)
+	}
+	var hooks struct {
+		Webhooks []struct {
+			ID  string `json:"id"`
+			URL string `json:"url"`
+		} `json:"webhooks"`
+	}
+	if status, err := apiRequest(http.MethodGet, base, token, nil, &hooks); err != nil || status != http.StatusOK || len(hooks.Webhooks) != 2 || hooks.Webhooks[1].URL != endpoint.URL+"/page" {
+		return fmt.Errorf("list webhooks: %d %+v %v", status, hooks, err)
+	}
+	pageHook := hooks.Webhooks[1].ID
+	resp, err = http.Get(settings)
+	if err != nil {
+		return err
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), endpoint.URL+"/page") {
+		return fmt.Errorf("feed page doesn't list the webhook")
+	}
+	req, _ := http.NewRequest(http.MethodDelete, settings+"/webhooks/"+pageHook, nil)
+	resp, err = noRedirects.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		return fmt.Errorf("delete webhook from the feed page: %s", resp.Status)
+	}
+
+	// The first delivery fails and is retried; the retry is made due now
+	// instead of after the backoff.
+	body := strings.Join([]string{
+		"--mixed",
+		"Content-Type: text/html; charset=utf-8",
+		"",
+		"<p>Hello <b>webhooks</b></p>",
+		"--mixed",
+		"Content-Type: text/plain",
+		"Content-Disposition: attachment; filename=report.txt",
+		"",
+		"Quarterly numbers",
+		"--mixed--",
+	}, "\r\n")
+	sendMessageWithHeaders(cfg.SMTPPort, created.Email, cfg.Hostname, "Webhook Delivery", body,
+		[]string{"Content-Type: multipart/mixed; boundary=mixed"})
+	if _, err := waitForRequests(1); err != nil {
+		return err
+	}
+	deliveries, err := waitForDeliveries(base+"/"+hook.ID+"/deliveries", token, 1)
+	if err != nil {
+		return err
+	}
+	if d := deliveries[0]; d.Attempt != 1 || d.Status == nil || *d.Status != http.StatusServiceUnavailable || d.Error == nil {
+		return fmt.Errorf("failed delivery: %+v", d)
+	}
+	if _, err := dbx.Write.ExecContext(ctx, `UPDATE backgroundJobs SET startAt = ? WHERE type = 'feedWebhooks.deliver' AND status = 'pending'`, time.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+	db.NotifyJobs("feedWebhooks.deliver")
+	got, err := waitForRequests(2)
+	if err != nil {
+		return err
+	}
+	if len(got) != 2 {
+		return fmt.Errorf("webhook got %d requests, want 2: the deleted webhook got one", len(got))
+	}
+	deliveries, err = waitForDeliveries(base+"/"+hook.ID+"/deliveries", token, 2)
+	if err != nil {
+		return err
+	}
+	if d := deliveries[0]; d.Attempt != 2 || d.Status == nil || *d.Status != http.StatusOK || d.Error != nil || d.Event != "entry.created" {
+		return fmt.Errorf("retried delivery: %+v", d)
+	}
+
+	resp, err = http.Get(settings)
+	if err != nil {
+		return err
+	}
+	page, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), "503 Service Unavailable") {
+		return fmt.Errorf("feed page doesn't show the failed delivery")
+	}
+
+	// Deliveries are signed, and retries are the same delivery.
+	first, second := got[0], got[1]
+	if first.Header.Get(worker.WebhookDeliveryHeader) != second.Header.Get(worker.WebhookDeliveryHeader) {
+		return fmt.Errorf("retry has another delivery id")
+	}
+	timestamp := second.Header.Get(worker.WebhookTimestampHeader)
+	if want := worker.WebhookSignature(hook.Secret, timestamp, second.Body); second.Header.Get(worker.WebhookSignatureHeader) != want {
+		return fmt.Errorf("signature is %q, want %q", second.Header.Get(worker.WebhookSignatureHeader), want)
+	}
+	if second.Header.Get(worker.WebhookEventHeader) != "entry.created" || second.Header.Get("Content-Type") != "application/json" {
+		return fmt.Errorf("delivery headers: %v", second.Header)
+	}
+	var payload worker.WebhookPayload
+	if err := json.NewDecoder(bytes.NewReader(second.Body)).Decode(&payload); err != nil {
+		return err
+	}
+	if payload.FeedID != created.FeedID || payload.EntryID == "" || payload.EntryID != deliveries[0].EntryID || payload.Subject != "Webhook Delivery" {
+		return fmt.Errorf("payload: %+v", payload)
+	}
+	if payload.Sender.Address == nil || *payload.Sender.Address != "sender@example.com" {
+		return fmt.Errorf("payload sender: %+v", payload.Sender)
+	}
+	if payload.Text != "Hello webhooks" || !strings.Contains(payload.HTML, "<b>webhooks</b>") {
+		return fmt.Errorf("payload body: %q %q", payload.Text, payload.HTML)
+	}
+	if len(payload.Enclosures) != 1 || !strings.HasSuffix(payload.Enclosures[0].URL, "/report.txt") || !strings.HasPrefix(payload.Enclosures[0].URL, "https://"+cfg.Hostname+"/files/") {
+		return fmt.Errorf("payload enclosures: %+v", payload.Enclosures)
+	}
+
+	if status, err := apiRequest(http.MethodDelete, base+"/"+hook.ID, token, nil, nil); err != nil || status != http.StatusNoContent {
+		return fmt.Errorf("delete webhook: %d %v", status, err)
+	}
+	if status, err := apiRequest(http.MethodGet, base+"/"+hook.ID, token, nil, nil); err != nil || status != http.StatusNotFound {
+		return fmt.Errorf("deleted webhook: %d %v", status, err)
+	}
+	return nil
+}
+
+type webhookDelivery struct {
+	Event   string  `json:"event"`
+	EntryID string  `json:"entryId"`
+	Attempt int     `json:"attempt"`
+	Status  *int    `json:"status"`
+	Error   *string `json:"error"`
+}
+
+// waitForDeliveries polls a webhook's delivery log until it has n
+// deliveries, and returns them newest first.
+func waitForDeliveries(deliveriesURL, token string, n int) ([]webhookDelivery, error) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var out struct {
+			Deliveries []webhookDelivery `json:"deliveries"`
+		}
+		status, err := apiRequest(http.MethodGet, deliveriesURL, token, nil, &out)
+		if err != nil || status != http.StatusOK {
+			return nil, fmt.Errorf("deliveries: %d %v", status, err)
+		}
+		if len(out.Deliveries) >= n {
+			return out.Deliveries, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%d deliveries after 10s, want %d", len(out.Deliveries), n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/config"
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+)
+
+// subscriberRequest is a request that the hub made to the fake subscriber.
+type subscriberRequest struct {
+	Method string
+	Query  url.Values
+	Header http.Header
+	Body   string
+}
+
+// fakeSubscriber is a WebSub subscriber whose callbacks are the paths of one
+// server. It confirms verification requests by echoing the challenge, except
+// on callbacks under /refuse/, and records every request it gets.
+type fakeSubscriber struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests map[string][]subscriberRequest
+}
+
+func newFakeSubscriber() *fakeSubscriber {
+	s := &fakeSubscriber{requests: map[string][]subscriberRequest{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests[r.URL.Path] = append(s.requests[r.URL.Path], subscriberRequest{Method: r.Method, Query: r.URL.Query(), Header: r.Header, Body: string(b)})
+		s.mu.Unlock()
+		if r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/refuse/") {
+			_, _ = io.WriteString(w, r.URL.Query().Get("hub.challenge"))
+		}
+	}))
+	return s
+}
+
+// wait returns the nth request (from 1) to a callback path once it arrives.
+func (s *fakeSubscriber) wait(path string, n int) (subscriberRequest, error) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		s.mu.Lock()
+		got := s.requests[path]
+		s.mu.Unlock()
+		if len(got) >= n {
+			return got[n-1], nil
+		}
+		if time.Now().After(deadline) {
+			return subscriberRequest{}, fmt.Errorf("%s got %d requests after 10s, want %d", path, len(got), n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func (s *fakeSubscriber) count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests[path])
+}
+
+// hubRequest makes a request to a feed's hub for callback, with extra
+// parameters.
+func hubRequest(httpAddr string, created createdFeed, mode, callback string, extra url.Values) (int, string, error) {
+	form := url.Values{"hub.mode": {mode}, "hub.topic": {created.Feed}, "hub.callback": {callback}}
+	for k, v := range extra {
+		form[k] = v
+	}
+	resp, err := http.PostForm("http://"+httpAddr+strings.TrimSuffix(path(created.Feed), ".xml")+"/websub", form)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(b), nil
+}
+
+// waitForExpiresAt polls until a feed's subscription to callback exists, or
+// doesn't if want is false, and returns when it expires.
+func waitForExpiresAt(ctx context.Context, dbx *db.DB, feedID int64, callback string, want bool) (time.Time, error) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		expiresAt, err := db.GetWebSubSubscriptionExpiresAt(ctx, dbx.Read, feedID, callback)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if (expiresAt != "") == want {
+			if !want {
+				return time.Time{}, nil
+			}
+			return time.Parse(time.RFC3339Nano, expiresAt)
+		}
+		if time.Now().After(deadline) {
+			return time.Time{}, fmt.Errorf("subscription of %s exists: %v after 10s", callback, !want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// verifyWebSub checks the hub against the WebSub recommendation with a fake
+// subscriber: verification of intent, negotiated leases that end, secrets,
+// signatures, unsubscribing and denials.
+func verifyWebSub(httpAddr string, dbx *db.DB, cfg config.Config) error {
+	ctx := context.Background()
+	sub := newFakeSubscriber()
+	defer sub.Close()
+	created := createFeed(httpAddr)
+	readToken := strings.TrimSuffix(strings.TrimPrefix(path(created.Feed), "/feeds/"), ".xml")
+	f, err := db.GetFeedByReadToken(ctx, dbx.Read, readToken)
+	if err != nil || f == nil {
+		return fmt.Errorf("load feed: %v", err)
+	}
+
+	// Leases are negotiated within the bounds, and start when the subscriber
+	// confirms them.
+	for _, c := range []struct {
+		path      string
+		requested string
+		granted   int
+	}{
+		{"/default", "", config.DefaultWebSubDefaultLeaseSeconds},
+		{"/short", "60", config.DefaultWebSubMinLeaseSeconds},
+		{"/long", "1000000000", config.DefaultWebSubMaxLeaseSeconds},
+		{"/hours", "7200", 7200},
+	} {
+		extra := url.Values{}
+		if c.requested != "" {
+			extra.Set("hub.lease_seconds", c.requested)
+		}
+		status, body, err := hubRequest(httpAddr, created, "subscribe", sub.URL+c.path, extra)
+		if err != nil || status != http.StatusAccepted {
+			return fmt.Errorf("subscribe %s: %d %s %v", c.path, status, body, err)
+		}
+		req, err := sub.wait(c.path, 1)
+		if err != nil {
+			return err
+		}
+		q := req.Query
+		if req.Method != http.MethodGet || q.Get("hub.mode") != "subscribe" || q.Get("hub.topic") != created.Feed || q.Get("hub.challenge") == "" {
+			return fmt.Errorf("verification of %s: %s %v", c.path, req.Method, q)
+		}
+		if q.Get("hub.lease_seconds") != strconv.Itoa(c.granted) {
+			return fmt.Errorf("lease of %s is %s, want %d", c.path, q.Get("hub.lease_seconds"), c.granted)
+		}
+		expiresAt, err := waitForExpiresAt(ctx, dbx, f.ID, sub.URL+c.path, true)
+		if err != nil {
+			return err
+		}
+		if d := time.Until(expiresAt) - time.Duration(c.granted)*time.Second; d > 0 || d < -time.Minute {
+			return fmt.Errorf("subscription of %s expires at %s, want in %ds", c.path, expiresAt, c.granted)
+		}
+	}
+
+	// Invalid requests are refused right away.
+	for name, extra := range map[string]url.Values{
+		"lease that isn't a number": {"hub.lease_seconds": {"forever"}},
+		"negative lease":            {"hub.lease_seconds": {"-1"}},
+		"200-byte secret":           {"hub.secret": {strings.Repeat("s", 200)}},
+	} {
+		if status, _, err := hubRequest(httpAddr, created, "subscribe", sub.URL+"/invalid", extra); err != nil || status != http.StatusBadRequest {
+			return fmt.Errorf("subscribe with a %s: %d %v", name, status, err)
+		}
+	}
+	if sub.count("/invalid") != 0 {
+		return fmt.Errorf("invalid requests were verified")
+	}
+
+	// Requests that the subscriber doesn't confirm don't subscribe it.
+	if status, _, err := hubRequest(httpAddr, created, "subscribe", sub.URL+"/refuse/me", nil); err != nil || status != http.StatusAccepted {
+		return fmt.Errorf("subscribe /refuse/me: %d %v", status, err)
+	}
+	if _, err := sub.wait("/refuse/me", 1); err != nil {
+		return err
+	}
+
+	// Notifications to subscribers with a secret are signed with the
+	// configured algorithm.
+	secret := strings.Repeat("s", 199)
+	if status, _, err := hubRequest(httpAddr, created, "subscribe", sub.URL+"/signed", url.Values{"hub.secret": {secret}}); err != nil || status != http.StatusAccepted {
+		return fmt.Errorf("subscribe with a 199-byte secret: %d %v", status, err)
+	}
+	if _, err := waitForExpiresAt(ctx, dbx, f.ID, sub.URL+"/signed", true); err != nil {
+		return err
+	}
+	sendMessage(cfg.SMTPPort, created.Email, cfg.Hostname, "WebSub Notification", "<p>First</p>")
+	for _, p := range []string{"/default", "/short", "/long", "/hours", "/signed"} {
+		req, err := sub.wait(p, 2)
+		if err != nil {
+			return err
+		}
+		if req.Method != http.MethodPost || !strings.Contains(req.Body, "WebSub Notification") {
+			return fmt.Errorf("notification to %s: %s %.200s", p, req.Method, req.Body)
+		}
+		signature := req.Header.Get("X-Hub-Signature")
+		if p != "/signed" {
+			if signature != "" {
+				return fmt.Errorf("notification to %s without a secret is signed", p)
+			}
+			continue
+		}
+		h := hmac.New(sha512.New, []byte(secret))
+		h.Write([]byte(req.Body))
+		if want := "sha512=" + hex.EncodeToString(h.Sum(nil)); signature != want {
+			return fmt.Errorf("signature is %q, want %q", signature, want)
+		}
+	}
+	if n := sub.count("/refuse/me"); n != 1 {
+		return fmt.Errorf("subscriber that didn't confirm got %d requests", n)
+	}
+
+	// Subscriptions whose lease ended get no notifications, and are deleted.
+	past := time.Now().Add(-time.Second).UTC().Format(time.RFC3339Nano)
+	if _, err := dbx.Write.ExecContext(ctx, `UPDATE feedWebSubSubscriptions SET expiresAt = ? WHERE feed = ? AND callback = ?`, past, f.ID, sub.URL+"/hours"); err != nil {
+		return err
+	}
+	sendMessage(cfg.SMTPPort, created.Email, cfg.Hostname, "WebSub Notification", "<p>Second</p>")
+	if _, err := sub.wait("/signed", 3); err != nil {
+		return err
+	}
+	if _, err := sub.wait("/default", 3); err != nil {
+		return err
+	}
+	if n := sub.count("/hours"); n != 2 {
+		return fmt.Errorf("subscriber whose lease ended got %d requests, want 2", n)
+	}
+	if err := db.DeleteExpiredWebSubs(ctx, dbx.Write, time.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+	if _, err := waitForExpiresAt(ctx, dbx, f.ID, sub.URL+"/hours", false); err != nil {
+		return err
+	}
+
+	// Unsubscribing is verified too, without a lease.
+	if status, _, err := hubRequest(httpAddr, created, "unsubscribe", sub.URL+"/default", nil); err != nil || status != http.StatusAccepted {
+		return fmt.Errorf("unsubscribe: %d %v", status, err)
+	}
+	req, err := sub.wait("/default", 4)
+	if err != nil {
+		return err
+	}
+	if q := req.Query; q.Get("hub.mode") != "unsubscribe" || q.Has("hub.lease_seconds") || q.Get("hub.challenge") == "" {
+		return fmt.Errorf("verification of unsubscribing: %v", q)
+	}
+	if _, err := waitForExpiresAt(ctx, dbx, f.ID, sub.URL+"/default", false); err != nil {
+		return err
+	}
+
+	// Valid requests that the hub won't honor are denied to the subscriber.
+	err = dbx.Tx(ctx, func(tx *db.Tx) error {
+		now := time.Now().UTC()
+		for i := range 11 {
+			if err := db.UpsertWebSubSubscription(ctx, tx, f.ID, now.Format(time.RFC3339Nano), fmt.Sprintf("%s/other/%d", sub.URL, i), "xml", nil, now.Add(time.Hour).Format(time.RFC3339Nano)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if status, _, err := hubRequest(httpAddr, created, "subscribe", sub.URL+"/denied", nil); err != nil || status != http.StatusAccepted {
+		return fmt.Errorf("subscribe past the limit: %d %v", status, err)
+	}
+	req, err = sub.wait("/denied", 1)
+	if err != nil {
+		return err
+	}
+	if q := req.Query; q.Get("hub.mode") != "denied" || q.Get("hub.topic") != created.Feed || q.Get("hub.reason") == "" || q.Has("hub.challenge") {
+		return fmt.Errorf("denial: %v", q)
+	}
+	if _, err := waitForExpiresAt(ctx, dbx, f.ID, sub.URL+"/denied", false); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/config"
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+	"github.com/jtsang4/kill-the-newsletter/internal/httpserver"
+	"github.com/jtsang4/kill-the-newsletter/internal/util"
+)
+
+const usage = `usage:
+  ktn                        run the servers selected by KTN_RUN_TYPE
+  ktn tokens create <name>   create an API token and print it once
+  ktn tokens list            list API tokens
+  ktn tokens revoke <id>     revoke an API token
+  ktn jobs dead              list background jobs that failed for good
+  ktn jobs retry <id>|all    retry a dead job, or all of them
+  ktn migrate status         list schema migrations and whether they are applied
+  ktn migrate up             apply pending schema migrations`
+
+// runCommand runs a one-off administrative command instead of the servers.
+func runCommand(cfg config.Config, args []string) error {
+	switch args[0] {
+	case "tokens":
+		return runTokens(cfg, args[1:])
+	case "jobs":
+		return runJobs(cfg, args[1:])
+	case "migrate":
+		return runMigrate(cfg, args[1:])
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+}
+
+func runTokens(cfg config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	dbx, err := db.Open(cfg.DataDirectory)
+	if err != nil {
+		return fmt.Errorf("open db: %w", err)
+	}
+	defer dbx.Close()
+	ctx := context.Background()
+	switch {
+	case args[0] == "create" && len(args) == 2:
+		token, err := util.RandID(40)
+		if err != nil {
+			return err
+		}
+		var id int64
+		err = dbx.Tx(ctx, func(tx *db.Tx) error {
+			id, err = db.CreateAPIToken(ctx, tx, args[1], httpserver.HashAPIToken(token), time.Now().UTC().Format(time.RFC3339Nano))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("token %d created; it won't be shown again:\n%s\n", id, token)
+		return nil
+	case args[0] == "list" && len(args) == 1:
+		tokens, err := db.ListAPITokens(ctx, dbx.Read)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tCREATED\tLAST USED")
+		for _, t := range tokens {
+			lastUsed := "never"
+			if t.LastUsedAt.Valid {
+				lastUsed = t.LastUsedAt.String
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", t.ID, t.Name, t.CreatedAt, lastUsed)
+		}
+		return tw.Flush()
+	case args[0] == "revoke" && len(args) == 2:
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid token id %q", args[1])
+		}
+		var found bool
+		err = dbx.Tx(ctx, func(tx *db.Tx) error {
+			found, err = db.DeleteAPIToken(ctx, tx, id)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if !found {
+			return db.ErrNotFound("token")
+		}
+		fmt.Printf("token %d revoked\n", id)
+		return nil
+	}
+	return errors.New(usage)
+}
+
+func runJobs(cfg config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	dbx, err := db.Open(cfg.DataDirectory)
+	if err != nil {
+		return fmt.Errorf("open db: %w", err)
+	}
+	defer dbx.Close()
+	ctx := context.Background()
+	switch {
+	case args[0] == "dead" && len(args) == 1:
+		jobs, err := db.ListDeadJobs(ctx, dbx.Read, 100)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tTYPE\tATTEMPTS\tLAST ATTEMPT DUE\tLAST ERROR")
+		for _, j := range jobs {
+			fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%s\n", j.ID, j.Type, j.Retries, j.StartAt, j.LastError.String)
+		}
+		return tw.Flush()
+	case args[0] == "retry" && len(args) == 2:
+		var id int64
+		if args[1] != "all" {
+			id, err = strconv.ParseInt(args[1], 10, 64)
+			if err != nil || id <= 0 {
+				return fmt.Errorf("invalid job id %q", args[1])
+			}
+		}
+		var n int64
+		err = dbx.Tx(ctx, func(tx *db.Tx) error {
+			n, err = db.RequeueDeadJobs(ctx, tx, id, time.Now().UTC().Format(time.RFC3339Nano))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if id != 0 && n == 0 {
+			return db.ErrNotFound("dead job")
+		}
+		fmt.Printf("%d jobs requeued\n", n)
+		return nil
+	}
+	return errors.New(usage)
+}
+
+func runMigrate(cfg config.Config, args []string) error {
+	if len(args) != 1 || (args[0] != "status" && args[0] != "up") {
+		return errors.New(usage)
+	}
+	dbx, err := db.Open(cfg.DataDirectory, db.WithoutMigrating())
+	if err != nil {
+		return fmt.Errorf("open db: %w", err)
+	}
+	defer dbx.Close()
+	ctx := context.Background()
+	if args[0] == "up" {
+		applied, err := dbx.Migrate(ctx)
+		for _, m := range applied {
+			fmt.Printf("applied %s\n", m)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+		return nil
+	}
+	migrations, err := dbx.Migrations(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "MIGRATION\tAPPLIED")
+	for _, m := range migrations {
+		applied := "pending"
+		if m.AppliedAt != "" {
+			applied = m.AppliedAt
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", m, applied)
+	}
+	return tw.Flush()
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/jtsang4/kill-the-newsletter/internal/config"
 	"github.com/jtsang4/kill-the-newsletter/internal/db"
+	"github.com/jtsang4/kill-the-newsletter/internal/feedcache"
 	"github.com/jtsang4/kill-the-newsletter/internal/httpserver"
 	"github.com/jtsang4/kill-the-newsletter/internal/smtpserver"
 	"github.com/jtsang4/kill-the-newsletter/internal/worker"
@@ -25,11 +27,22 @@ func main() {
 		log.Fatalf("mkdir data: %v", err)
 	}
 
+	if len(os.Args) > 1 {
+		if err := runCommand(cfg, os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	dbx, err := db.Open(cfg.DataDirectory)
 	if err != nil {
 		log.Fatalf("open db: %v", err)
 	}
 	defer dbx.Close()
+	// Cached documents may predate migrations and the running renderers.
+	if err := feedcache.New(cfg.DataDirectory).Clear(); err != nil {
+		log.Fatalf("clear feed cache: %v", err)
+	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
@@ -37,7 +50,9 @@ func main() {
 	var httpSrv *http.Server
 	if cfg.RunType == "server" || cfg.RunType == "all" {
 		hs := httpserver.New(cfg, dbx)
-		httpSrv = &http.Server{Addr: cfg.HTTPAddr, Handler: hs}
+		// Requests end on shutdown, which would otherwise wait for event
+		// streams to close.
+		httpSrv = &http.Server{Addr: cfg.HTTPAddr, Handler: hs, BaseContext: func(net.Listener) context.Context { return ctx }}
 		go func() {
 			log.Printf("HTTP listening on %s", cfg.HTTPAddr)
 			if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -5,6 +5,7 @@ go 1.24.2
 require (
 	github.com/emersion/go-smtp v0.18.0
 	github.com/jhillyerd/enmime v1.3.0
+	golang.org/x/net v0.23.0
 	modernc.org/sqlite v1.39.1
 )
 
@@ -24,7 +25,6 @@ require (
 	github.com/rivo/uniseg v0.4.4 // indirect
 	github.com/ssor/bom v0.0.0-20170718123548-6386211fdfcf // indirect
 	golang.org/x/exp v0.0.0-20250620022241-b7579e27df2b // indirect
-	golang.org/x/net v0.23.0 // indirect
 	golang.org/x/sys v0.36.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	modernc.org/libc v1.66.10 // indirect
@@ -4,40 +4,22 @@ import (
 	"bytes"
 	"encoding/xml"
 	"fmt"
-)
-
-type Feed struct {
-	PublicID  string
-	Title     string
-	Icon      *string
-	EmailIcon *string
-}
-
-type Entry struct {
-	ID         int64
-	PublicID   string
-	CreatedAt  string
-	Author     *string
-	Title      string
-	Content    string
-	Enclosures []Enclosure
-}
+	"net/mail"
 
-type Enclosure struct {
-	PublicID string
-	Type     string
-	Length   int64
-	Name     string
-}
+	"github.com/jtsang4/kill-the-newsletter/internal/feed"
+)
 
 type atomFeed struct {
-	XMLName xml.Name    `xml:"feed"`
-	Xmlns   string      `xml:"xmlns,attr"`
-	ID      string      `xml:"id"`
-	Links   []atomLink  `xml:"link"`
-	Icon    *string     `xml:"icon,omitempty"`
-	Updated string      `xml:"updated"`
-	Title   string      `xml:"title"`
+	XMLName xml.Name   `xml:"feed"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Base    string     `xml:"http://www.w3.org/XML/1998/namespace base,attr"`
+	ID      string     `xml:"id"`
+	Links   []atomLink `xml:"link"`
+	Icon    *string    `xml:"icon,omitempty"`
+	Updated string     `xml:"updated"`
+	Title   string     `xml:"title"`
+	// Archive marks archive documents (RFC 5005 section 4).
+	Archive *struct{}   `xml:"http://purl.org/syndication/history/1.0 archive,omitempty"`
 	Entries []atomEntry `xml:"entry"`
 }
 
@@ -49,63 +31,80 @@ type atomLink struct {
 }
 
 type atomEntry struct {
-	ID        string      `xml:"id"`
-	Links     []atomLink  `xml:"link"`
-	Published string      `xml:"published"`
-	Updated   string      `xml:"updated"`
-	Author    atomAuthor  `xml:"author"`
-	Title     string      `xml:"title"`
-	Content   atomContent `xml:"content"`
+	ID        string     `xml:"id"`
+	Links     []atomLink `xml:"link"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Author    atomAuthor `xml:"author"`
+	Title     string     `xml:"title"`
+	Summary   atomText   `xml:"summary"`
+	Content   atomText   `xml:"content"`
 }
 
 type atomAuthor struct {
 	Name  string `xml:"name"`
-	Email string `xml:"email"`
+	Email string `xml:"email,omitempty"`
 }
 
-type atomContent struct {
+// atomText is a text construct. With type "html" the body is HTML, which is
+// escaped as character data like any other text.
+type atomText struct {
 	Type string `xml:"type,attr"`
-	Body string `xml:",innerxml"`
+	Body string `xml:",chardata"`
 }
 
 // BuildFeedXML returns a full Atom feed document for the given items.
-func BuildFeedXML(hostname string, feed Feed, entries []Entry) (string, error) {
-	icon := feed.Icon
-	if icon == nil && feed.EmailIcon != nil {
-		icon = feed.EmailIcon
-	}
+func BuildFeedXML(f feed.Feed, entries []feed.Entry) (string, error) {
 	af := atomFeed{
 		Xmlns: "http://www.w3.org/2005/Atom",
-		ID:    fmt.Sprintf("urn:kill-the-newsletter:%s", feed.PublicID),
+		Base:  f.BaseURL,
+		ID:    f.ID,
 		Links: []atomLink{
-			{Rel: "self", Href: fmt.Sprintf("https://%s/feeds/%s.xml", hostname, feed.PublicID)},
-			{Rel: "hub", Href: fmt.Sprintf("https://%s/feeds/%s/websub", hostname, feed.PublicID)},
+			{Rel: "self", Href: f.SelfURL(feed.FormatAtom)},
 		},
-		Title: feed.Title,
+		Icon:  f.Icon,
+		Title: f.Title,
 	}
-	if icon != nil {
-		af.Icon = icon
+	if f.HubURL != "" {
+		af.Links = append(af.Links, atomLink{Rel: "hub", Href: f.HubURL})
 	}
-	if len(entries) > 0 {
-		af.Updated = entries[0].CreatedAt
-	} else {
+	// Paged feed links (first, next) and archived feed links (current,
+	// prev-archive, next-archive) lead to the same documents.
+	if p := f.Paging; p.Current != "" {
+		af.Links = append(af.Links, atomLink{Rel: "current", Href: p.Current}, atomLink{Rel: "first", Href: p.Current})
+		if p.PrevArchive != "" {
+			af.Links = append(af.Links, atomLink{Rel: "next", Href: p.PrevArchive}, atomLink{Rel: "prev-archive", Href: p.PrevArchive})
+		}
+		if p.NextArchive != "" {
+			af.Links = append(af.Links, atomLink{Rel: "next-archive", Href: p.NextArchive})
+		}
+		if p.Page > 0 {
+			af.Archive = &struct{}{}
+		}
+	}
+	// The feed changes when an entry does or when its own metadata does.
+	af.Updated = feed.Latest(feed.LastUpdated(entries), f.UpdatedAt)
+	if af.Updated == "" {
 		af.Updated = "2000-01-01T00:00:00.000Z"
 	}
 	for _, e := range entries {
 		links := []atomLink{
-			{Rel: "alternate", Type: "text/html", Href: fmt.Sprintf("https://%s/feeds/%s/entries/%s.html", hostname, feed.PublicID, e.PublicID)},
+			{Rel: "alternate", Type: "text/html", Href: e.URL},
 		}
 		for _, enc := range e.Enclosures {
-			links = append(links, atomLink{Rel: "enclosure", Type: enc.Type, Length: fmt.Sprintf("%d", enc.Length), Href: fmt.Sprintf("https://%s/files/%s/%s", hostname, enc.PublicID, enc.Name)})
+			links = append(links, atomLink{Rel: "enclosure", Type: enc.Type, Length: fmt.Sprintf("%d", enc.Length), Href: enc.URL})
 		}
 		ae := atomEntry{
-			ID:        fmt.Sprintf("urn:kill-the-newsletter:%s", e.PublicID),
+			ID:        e.ID,
 			Links:     links,
-			Published: e.CreatedAt,
-			Updated:   e.CreatedAt,
-			Author:    atomAuthor{Name: valOr(e.Author, "Kill the Newsletter!"), Email: valOr(e.Author, "kill-the-newsletter@leafac.com")},
+			Published: e.PublishedAt,
+			Updated:   e.UpdatedAt,
+			Author:    atomAuthor{Name: valOr(e.Author, f.Title), Email: addrSpec(e.AuthorEmail)},
 			Title:     e.Title,
-			Content:   atomContent{Type: "html", Body: fmt.Sprintf("%s<hr /><p><small><a href=\"https://%s/feeds/%s\">Kill the Newsletter! feed settings</a></small></p>", e.Content, hostname, feed.PublicID)},
+			Summary:   atomText{Type: "text", Body: e.Summary},
+			// The settings link is deliberately not included: anyone who can read the
+			// feed would otherwise be able to manage it.
+			Content: atomText{Type: "html", Body: e.Content},
 		}
 		af.Entries = append(af.Entries, ae)
 	}
@@ -128,3 +127,14 @@ func valOr(p *string, def string) string {
 	}
 	return def
 }
+
+// addrSpec returns email if it is a valid address for atom:email, or "".
+func addrSpec(email *string) string {
+	if email == nil {
+		return ""
+	}
+	if a, err := mail.ParseAddress(*email); err != nil || a.Address != *email {
+		return ""
+	}
+	return *email
+}
@@ -3,7 +3,9 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -16,15 +18,163 @@ type TLS struct {
 	Certificate string `json:"certificate"`
 }
 
+// Retention is the instance-wide default retention policy. Feeds may override
+// each limit; zero means unlimited.
+type Retention struct {
+	MaxBytes   int64 `json:"maxBytes"`
+	MaxEntries int64 `json:"maxEntries"`
+	MaxAgeDays int64 `json:"maxAgeDays"`
+}
+
+// WebSub is the hub's policy. Zero values mean the defaults.
+type WebSub struct {
+	// Subscribers may ask for leases between MinLeaseSeconds and
+	// MaxLeaseSeconds; those that don't ask get DefaultLeaseSeconds.
+	MinLeaseSeconds     int `json:"minLeaseSeconds"`
+	MaxLeaseSeconds     int `json:"maxLeaseSeconds"`
+	DefaultLeaseSeconds int `json:"defaultLeaseSeconds"`
+	// SignatureAlgorithm is the hash of the X-Hub-Signature of notifications
+	// to subscribers with a secret: sha1, sha256, sha384 or sha512.
+	SignatureAlgorithm string `json:"signatureAlgorithm"`
+}
+
+// WebSub defaults.
+const (
+	DefaultWebSubMinLeaseSeconds     = 60 * 60
+	DefaultWebSubMaxLeaseSeconds     = 30 * 24 * 60 * 60
+	DefaultWebSubDefaultLeaseSeconds = 10 * 24 * 60 * 60
+	DefaultWebSubSignatureAlgorithm  = "sha256"
+)
+
+// WebSubSignatureAlgorithms are the hashes that notifications may be signed
+// with, as named in X-Hub-Signature.
+var WebSubSignatureAlgorithms = []string{"sha1", "sha256", "sha384", "sha512"}
+
+// withDefaults fills in the defaults of the fields that are zero.
+func (w WebSub) withDefaults() WebSub {
+	if w.MinLeaseSeconds <= 0 {
+		w.MinLeaseSeconds = DefaultWebSubMinLeaseSeconds
+	}
+	if w.MaxLeaseSeconds <= 0 {
+		w.MaxLeaseSeconds = DefaultWebSubMaxLeaseSeconds
+	}
+	if w.DefaultLeaseSeconds <= 0 {
+		w.DefaultLeaseSeconds = DefaultWebSubDefaultLeaseSeconds
+	}
+	if w.SignatureAlgorithm == "" {
+		w.SignatureAlgorithm = DefaultWebSubSignatureAlgorithm
+	}
+	return w
+}
+
+// LeaseSeconds returns the lease granted to a subscriber that asked for
+// requested seconds, or didn't ask if requested is 0.
+func (w WebSub) LeaseSeconds(requested int) int {
+	w = w.withDefaults()
+	if requested <= 0 {
+		requested = w.DefaultLeaseSeconds
+	}
+	return min(max(requested, w.MinLeaseSeconds), w.MaxLeaseSeconds)
+}
+
+// Algorithm returns the name of the hash notifications are signed with.
+func (w WebSub) Algorithm() string { return w.withDefaults().SignatureAlgorithm }
+
+func (w WebSub) validate() error {
+	w = w.withDefaults()
+	if w.MinLeaseSeconds > w.MaxLeaseSeconds {
+		return fmt.Errorf("WebSub minimum lease (%ds) is longer than the maximum (%ds)", w.MinLeaseSeconds, w.MaxLeaseSeconds)
+	}
+	for _, a := range WebSubSignatureAlgorithms {
+		if w.SignatureAlgorithm == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("WebSub signature algorithm %q isn't one of %s", w.SignatureAlgorithm, strings.Join(WebSubSignatureAlgorithms, ", "))
+}
+
+// DefaultRetentionMaxBytes bounds a feed's entries plus their enclosures.
+const DefaultRetentionMaxBytes = 5 << 20
+
+// DefaultFeedPageSize is the number of entries in a feed document. Older
+// entries are in archive documents of the same size; changing it renumbers
+// the archives.
+const DefaultFeedPageSize = 50
+
 type Config struct {
-	Hostname                 string  `json:"hostname"`
-	SystemAdministratorEmail *string `json:"systemAdministratorEmail,omitempty"`
-	TLS                      TLS     `json:"tls"`
-	DataDirectory            string  `json:"dataDirectory"`
-	Environment              string  `json:"environment"`
-	SMTPPort                 int     `json:"smtpPort"`
-	HTTPAddr                 string  `json:"httpAddr"`
-	RunType                  string  `json:"runType"`
+	Hostname                 string    `json:"hostname"`
+	SystemAdministratorEmail *string   `json:"systemAdministratorEmail,omitempty"`
+	TLS                      TLS       `json:"tls"`
+	DataDirectory            string    `json:"dataDirectory"`
+	Environment              string    `json:"environment"`
+	SMTPPort                 int       `json:"smtpPort"`
+	HTTPAddr                 string    `json:"httpAddr"`
+	RunType                  string    `json:"runType"`
+	Retention                Retention `json:"retention"`
+	FeedPageSize             int       `json:"feedPageSize"`
+	// JobConcurrency overrides how many background jobs of a type run at
+	// the same time in a process, by job type.
+	JobConcurrency map[string]int `json:"jobConcurrency,omitempty"`
+	WebSub         WebSub         `json:"webSub"`
+	// OutboundBlockedNetworks are the networks that requests to URLs chosen
+	// by users, like WebSub callbacks, may not connect to, as CIDRs or single
+	// addresses. Nil means DefaultOutboundBlockedNetworks; empty blocks none.
+	OutboundBlockedNetworks []string `json:"outboundBlockedNetworks,omitempty"`
+}
+
+// DefaultOutboundBlockedNetworks are the loopback, private, link-local
+// (including cloud metadata endpoints), shared, multicast and reserved
+// networks, which no subscriber should be on, and the IPv6 networks that
+// embed or translate to IPv4 addresses (NAT64, Teredo and 6to4), which could
+// reach them.
+var DefaultOutboundBlockedNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"100::/64",
+	"2001::/32",
+	"2001:db8::/32",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// ParseNetwork parses a CIDR, or a single address as the network of just
+// that address.
+func ParseNetwork(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+func validateNetworks(networks []string) error {
+	for _, n := range networks {
+		if _, err := ParseNetwork(n); err != nil {
+			return fmt.Errorf("outbound blocked network %q: %w", n, err)
+		}
+	}
+	return nil
 }
 
 type AppEnv string
@@ -50,7 +200,8 @@ func Load(path string) (Config, error) {
 	if err != nil {
 		return Config{}, err
 	}
-	var cfg Config
+	// Fields missing from the file keep their defaults.
+	cfg := Config{Retention: Retention{MaxBytes: DefaultRetentionMaxBytes}}
 	if err := json.Unmarshal(b, &cfg); err != nil {
 		return Config{}, err
 	}
@@ -76,6 +227,15 @@ func Load(path string) (Config, error) {
 	if cfg.RunType == "" {
 		cfg.RunType = "all"
 	}
+	if cfg.FeedPageSize <= 0 {
+		cfg.FeedPageSize = DefaultFeedPageSize
+	}
+	if err := validateNetworks(cfg.OutboundBlockedNetworks); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.WebSub.validate(); err != nil {
+		return Config{}, err
+	}
 	return cfg, nil
 }
 
@@ -125,5 +285,68 @@ func LoadEnv() (Config, error) {
 	} else {
 		cfg.RunType = "all"
 	}
+	cfg.Retention = Retention{MaxBytes: DefaultRetentionMaxBytes}
+	if v := strings.TrimSpace(os.Getenv("KTN_RETENTION_MAX_BYTES")); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+			cfg.Retention.MaxBytes = n
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("KTN_RETENTION_MAX_ENTRIES")); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+			cfg.Retention.MaxEntries = n
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("KTN_RETENTION_MAX_AGE_DAYS")); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+			cfg.Retention.MaxAgeDays = n
+		}
+	}
+	cfg.FeedPageSize = DefaultFeedPageSize
+	if v := strings.TrimSpace(os.Getenv("KTN_FEED_PAGE_SIZE")); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.FeedPageSize = n
+		}
+	}
+	// Comma-separated type=n pairs.
+	if v := strings.TrimSpace(os.Getenv("KTN_JOB_CONCURRENCY")); v != "" {
+		cfg.JobConcurrency = map[string]int{}
+		for _, pair := range strings.Split(v, ",") {
+			typ, n, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if c, err := strconv.Atoi(n); ok && err == nil && c > 0 {
+				cfg.JobConcurrency[typ] = c
+			}
+		}
+	}
+	// Comma-separated networks, or "none" to block none. Unlike other
+	// settings, invalid ones are an error, as ignoring them would silently
+	// allow what they were meant to block.
+	if v := strings.TrimSpace(os.Getenv("KTN_OUTBOUND_BLOCKED_NETWORKS")); v != "" {
+		cfg.OutboundBlockedNetworks = []string{}
+		if v != "none" {
+			for _, n := range strings.Split(v, ",") {
+				if n = strings.TrimSpace(n); n != "" {
+					cfg.OutboundBlockedNetworks = append(cfg.OutboundBlockedNetworks, n)
+				}
+			}
+		}
+		if err := validateNetworks(cfg.OutboundBlockedNetworks); err != nil {
+			return Config{}, err
+		}
+	}
+	for env, field := range map[string]*int{
+		"KTN_WEBSUB_MIN_LEASE_SECONDS":     &cfg.WebSub.MinLeaseSeconds,
+		"KTN_WEBSUB_MAX_LEASE_SECONDS":     &cfg.WebSub.MaxLeaseSeconds,
+		"KTN_WEBSUB_DEFAULT_LEASE_SECONDS": &cfg.WebSub.DefaultLeaseSeconds,
+	} {
+		if v := strings.TrimSpace(os.Getenv(env)); v != "" {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				*field = n
+			}
+		}
+	}
+	cfg.WebSub.SignatureAlgorithm = strings.ToLower(strings.TrimSpace(os.Getenv("KTN_WEBSUB_SIGNATURE_ALGORITHM")))
+	if err := cfg.WebSub.validate(); err != nil {
+		return Config{}, err
+	}
 	return cfg, nil
 }
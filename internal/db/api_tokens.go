@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+type APIToken struct {
+	ID         int64
+	Name       string
+	CreatedAt  string
+	LastUsedAt sql.NullString
+}
+
+func CreateAPIToken(ctx context.Context, tx *sql.Tx, name, tokenHash, createdAt string) (int64, error) {
+	res, err := tx.ExecContext(ctx, `INSERT INTO apiTokens(name, tokenHash, createdAt) VALUES (?,?,?)`, name, tokenHash, createdAt)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func GetAPITokenByHash(ctx context.Context, dbx Reader, tokenHash string) (*APIToken, error) {
+	row := dbx.QueryRowContext(ctx, `SELECT id, name, createdAt, lastUsedAt FROM apiTokens WHERE tokenHash=?`, tokenHash)
+	var t APIToken
+	if err := row.Scan(&t.ID, &t.Name, &t.CreatedAt, &t.LastUsedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &t, nil
+}
+
+func ListAPITokens(ctx context.Context, dbx Reader) ([]APIToken, error) {
+	rows, err := dbx.QueryContext(ctx, `SELECT id, name, createdAt, lastUsedAt FROM apiTokens ORDER BY id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []APIToken
+	for rows.Next() {
+		var t APIToken
+		if err := rows.Scan(&t.ID, &t.Name, &t.CreatedAt, &t.LastUsedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func TouchAPIToken(ctx context.Context, dbx Writer, id int64, usedAt string) error {
+	_, err := dbx.ExecContext(ctx, `UPDATE apiTokens SET lastUsedAt=? WHERE id=?`, usedAt, id)
+	return err
+}
+
+// DeleteAPIToken revokes a token and reports whether it existed.
+func DeleteAPIToken(ctx context.Context, tx *sql.Tx, id int64) (bool, error) {
+	res, err := tx.ExecContext(ctx, `DELETE FROM apiTokens WHERE id=?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
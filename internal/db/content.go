@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/privacy"
+	"github.com/jtsang4/kill-the-newsletter/internal/sanitize"
+)
+
+// contentVersion identifies the rules that derive an entry's content from its
+// original HTML. It is stored in sanitizerVersion, and entries stored with
+// other rules are processed again on startup.
+const contentVersion = sanitize.Version*100 + privacy.Version
+
+// entryHTML derives an entry's content from the HTML it was received with,
+// and returns the JSON privacy report, or "" if nothing was removed.
+func entryHTML(original string, cleanPrivacy bool) (string, string) {
+	content := sanitize.HTML(original)
+	if !cleanPrivacy {
+		return content, ""
+	}
+	content, report := privacy.Clean(content)
+	if report.Empty() {
+		return content, ""
+	}
+	return content, report.JSON()
+}
+
+type reprocessable struct {
+	id                                   int64
+	title, author, authorEmail, original string
+	cleanPrivacy                         bool
+}
+
+const reprocessableColumns = `e.id, e.title, COALESCE(e.author, ''), COALESCE(e.authorEmail, ''), COALESCE(e.originalContent, e.content), f.privacyCleaning`
+
+func scanReprocessable(rows *sql.Rows) ([]reprocessable, error) {
+	defer rows.Close()
+	var out []reprocessable
+	for rows.Next() {
+		var p reprocessable
+		if err := rows.Scan(&p.id, &p.title, &p.author, &p.authorEmail, &p.original, &p.cleanPrivacy); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+func reprocessEntry(ctx context.Context, tx *sql.Tx, p reprocessable) error {
+	content, report := entryHTML(p.original, p.cleanPrivacy)
+	if _, err := tx.ExecContext(ctx, `UPDATE feedEntries SET content=?, originalContent=?, sanitizerVersion=?, privacyReport=? WHERE id=?`, content, p.original, contentVersion, nullIfEmpty(report), p.id); err != nil {
+		return err
+	}
+	return reindexEntry(ctx, tx, p.id, p.title, p.author, p.authorEmail, content)
+}
+
+// reprocessOutdatedEntries derives the content of entries stored before
+// content was processed, or with older rules, again from their original HTML.
+func reprocessOutdatedEntries(ctx context.Context, d *sql.DB) error {
+	for {
+		rows, err := d.QueryContext(ctx, `SELECT `+reprocessableColumns+` FROM feedEntries e JOIN feeds f ON f.id = e.feed WHERE e.sanitizerVersion IS NOT ? ORDER BY e.id LIMIT 100`, contentVersion)
+		if err != nil {
+			return err
+		}
+		todo, err := scanReprocessable(rows)
+		if err != nil || len(todo) == 0 {
+			return err
+		}
+		tx, err := d.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for _, p := range todo {
+			if err := reprocessEntry(ctx, tx, p); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+}
+
+// UpdateFeedPrivacyCleaning changes the setting and, if it changed, applies
+// it to the feed's existing entries.
+func UpdateFeedPrivacyCleaning(ctx context.Context, tx *sql.Tx, feedID int64, enabled bool) error {
+	res, err := tx.ExecContext(ctx, `UPDATE feeds SET privacyCleaning=?, updatedAt=`+nowSQL+` WHERE id=? AND privacyCleaning IS NOT ?`, enabled, feedID, enabled)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT `+reprocessableColumns+` FROM feedEntries e JOIN feeds f ON f.id = e.feed WHERE e.feed=?`, feedID)
+	if err != nil {
+		return err
+	}
+	todo, err := scanReprocessable(rows)
+	if err != nil {
+		return err
+	}
+	for _, p := range todo {
+		if err := reprocessEntry(ctx, tx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,56 +3,151 @@ package db
 import (
 	"context"
 	"database/sql"
-	_ "embed"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"runtime"
+	"sync"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
-//go:embed migrations.sql
-var migrationsSQL string
-
+// DB is the database of an instance. SQLite allows one writer at a time, so
+// all writes go through a single connection, while reads use a pool of
+// read-only connections that WAL lets run alongside the writer.
 type DB struct {
-	SQL *sql.DB
+	// Write is the only connection that writes; Tx runs transactions on it.
+	Write *sql.DB
+	// Read is the pool of read-only connections.
+	Read *ReadPool
+}
+
+// ReadPool is a pool of read-only connections. It only has the methods that
+// Reader needs, so it can't be passed to functions that write.
+type ReadPool struct {
+	db *sql.DB
+}
+
+func (p *ReadPool) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return p.db.QueryContext(ctx, query, args...)
+}
+
+func (p *ReadPool) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return p.db.QueryRowContext(ctx, query, args...)
+}
+
+// Reader is taken by functions that only read: the read pool, or the writer
+// or a transaction when the read must see writes that aren't committed yet.
+type Reader interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
 }
 
-func Open(dataDir string) (*DB, error) {
+// Writer is taken by functions that write outside of a transaction: the
+// writer connection.
+type Writer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// busyTimeout is how long a connection waits for locks held by other
+// connections, including those of other processes sharing the database.
+const busyTimeout = 5 * time.Second
+
+type options struct {
+	readConnections  int
+	withoutMigrating bool
+}
+
+// Option configures Open.
+type Option func(*options)
+
+// WithReadConnections sets the size of the read pool. With 0 there is no
+// pool and reads share the writer connection, which is only useful to
+// compare performance.
+func WithReadConnections(n int) Option {
+	return func(o *options) { o.readConnections = n }
+}
+
+// WithoutMigrating opens the database as it is, without applying pending
+// migrations, for commands that inspect or apply them.
+func WithoutMigrating() Option {
+	return func(o *options) { o.withoutMigrating = true }
+}
+
+// Open opens the database in the data directory, creating it if needed, and
+// applies pending migrations.
+func Open(dataDir string, opts ...Option) (*DB, error) {
+	o := options{readConnections: max(4, runtime.NumCPU())}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	path := filepath.Join(dataDir, "kill-the-newsletter.db")
-	d, err := sql.Open("sqlite", path)
+	// Pragmas in the DSN apply to every connection the pools open. Write
+	// transactions take the write lock when they begin, so that they wait
+	// for other writers instead of failing when upgrading a read lock.
+	pragmas := fmt.Sprintf("_pragma=foreign_keys(1)&_pragma=busy_timeout(%d)", busyTimeout.Milliseconds())
+	w, err := sql.Open("sqlite", "file:"+path+"?"+pragmas+"&_pragma=journal_mode(WAL)&_txlock=immediate")
 	if err != nil {
 		return nil, err
 	}
-	// Pragmas for reliability.
-	if _, err := d.Exec(`PRAGMA journal_mode=WAL; PRAGMA foreign_keys=ON;`); err != nil {
-		_ = d.Close()
-		return nil, err
+	w.SetMaxOpenConns(1)
+	w.SetMaxIdleConns(1)
+	w.SetConnMaxLifetime(0)
+	d := &DB{Write: w, Read: &ReadPool{db: w}}
+	if !o.withoutMigrating {
+		if _, err := d.Migrate(context.Background()); err != nil {
+			_ = w.Close()
+			return nil, err
+		}
+		// Processing content is slower than migrations and commits in
+		// batches, so it runs after them.
+		if err := reprocessOutdatedEntries(context.Background(), w); err != nil {
+			_ = w.Close()
+			return nil, err
+		}
 	}
-	d.SetMaxOpenConns(1)
-	if err := migrate(d); err != nil {
-		_ = d.Close()
-		return nil, err
+	if o.readConnections > 0 {
+		r, err := sql.Open("sqlite", "file:"+path+"?mode=ro&"+pragmas+"&_pragma=query_only(1)")
+		if err != nil {
+			_ = w.Close()
+			return nil, err
+		}
+		r.SetMaxOpenConns(o.readConnections)
+		r.SetMaxIdleConns(o.readConnections)
+		d.Read = &ReadPool{db: r}
 	}
-	return &DB{SQL: d}, nil
+	return d, nil
 }
 
-func (d *DB) Close() error { return d.SQL.Close() }
+func (d *DB) Close() error {
+	var err error
+	if d.Read.db != d.Write {
+		err = d.Read.db.Close()
+	}
+	return errors.Join(err, d.Write.Close())
+}
 
-func migrate(d *sql.DB) error {
-	// Single-shot migration using embedded SQL; idempotent via IF NOT EXISTS and CREATE UNIQUE indices.
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	_, err := d.ExecContext(ctx, migrationsSQL)
-	return err
+// IsBusy reports whether err is SQLite giving up on a lock after
+// busyTimeout, which is temporary: the operation can be retried later.
+func IsBusy(err error) bool {
+	var e *sqlite.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	code := e.Code() & 0xff // primary result code
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
 }
 
-// Tx wraps a function in a transaction.
+// Tx wraps a function in a transaction, and runs the functions registered
+// with afterCommit once it commits.
 func (d *DB) Tx(ctx context.Context, fn func(tx *sql.Tx) error) error {
-	tx, err := d.SQL.BeginTx(ctx, &sql.TxOptions{})
+	tx, err := d.Write.BeginTx(ctx, &sql.TxOptions{})
 	if err != nil {
 		return err
 	}
+	defer commitHooks.Delete(tx)
 	defer func() {
 		if p := recover(); p != nil {
 			_ = tx.Rollback()
@@ -63,7 +158,28 @@ func (d *DB) Tx(ctx context.Context, fn func(tx *sql.Tx) error) error {
 		_ = tx.Rollback()
 		return err
 	}
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if hooks, ok := commitHooks.Load(tx); ok {
+		for _, hook := range *hooks.(*[]func()) {
+			hook()
+		}
+	}
+	return nil
+}
+
+// commitHooks holds the functions to run after the transactions of Tx
+// commit, by *sql.Tx.
+var commitHooks sync.Map
+
+// afterCommit runs fn after tx commits, if it is a transaction of Tx, for
+// effects that other goroutines must only see once the transaction's writes
+// are visible.
+func afterCommit(tx *sql.Tx, fn func()) {
+	hooks, _ := commitHooks.LoadOrStore(tx, new([]func()))
+	p := hooks.(*[]func())
+	*p = append(*p, fn)
 }
 
 func ErrNotFound(entity string) error { return fmt.Errorf("%s not found", entity) }
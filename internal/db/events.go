@@ -0,0 +1,49 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// FeedEvent is a change to a feed's entries, logged by the triggers of
+// feedEntries.
+type FeedEvent struct {
+	ID            int64
+	CreatedAt     string
+	Type          string
+	EntryPublicID string
+	// EntryTitle is the title of the entry, unless it was deleted since.
+	EntryTitle sql.NullString
+}
+
+// GetLastFeedEventID returns the id of a feed's latest event, or 0 if it has
+// none.
+func GetLastFeedEventID(ctx context.Context, dbx Reader, feedID int64) (int64, error) {
+	var id int64
+	err := dbx.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM feedEvents WHERE feed=?`, feedID).Scan(&id)
+	return id, err
+}
+
+// GetFeedEventsAfter returns up to limit of a feed's events after afterID,
+// oldest first.
+func GetFeedEventsAfter(ctx context.Context, dbx Reader, feedID, afterID int64, limit int) ([]FeedEvent, error) {
+	rows, err := dbx.QueryContext(ctx, `SELECT ev.id, ev.createdAt, ev.type, ev.entryPublicId, e.title FROM feedEvents ev LEFT JOIN feedEntries e ON e.publicId = ev.entryPublicId WHERE ev.feed=? AND ev.id>? ORDER BY ev.id LIMIT ?`, feedID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []FeedEvent
+	for rows.Next() {
+		var ev FeedEvent
+		if err := rows.Scan(&ev.ID, &ev.CreatedAt, &ev.Type, &ev.EntryPublicID, &ev.EntryTitle); err != nil {
+			return nil, err
+		}
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
+
+func DeleteOldFeedEvents(ctx context.Context, dbx Writer, olderThan string) error {
+	_, err := dbx.ExecContext(ctx, `DELETE FROM feedEvents WHERE createdAt < ?`, olderThan)
+	return err
+}
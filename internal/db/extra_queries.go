@@ -5,41 +5,31 @@ import (
 	"database/sql"
 )
 
-func GetFeedByID(ctx context.Context, dbx *sql.DB, id int64) (*Feed, error) {
-	row := dbx.QueryRowContext(ctx, `SELECT id, publicId, title, icon, emailIcon FROM feeds WHERE id=?`, id)
-	var f Feed
-	if err := row.Scan(&f.ID, &f.PublicID, &f.Title, &f.Icon, &f.EmailIcon); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		return nil, err
-	}
-	return &f, nil
+func GetFeedByID(ctx context.Context, dbx Reader, id int64) (*Feed, error) {
+	return scanFeed(dbx.QueryRowContext(ctx, `SELECT `+feedColumns+` FROM feeds WHERE id=?`, id))
 }
 
-func GetEntryByID(ctx context.Context, dbx *sql.DB, id int64) (*FeedEntry, error) {
-	row := dbx.QueryRowContext(ctx, `SELECT id, publicId, feed, createdAt, author, title, content FROM feedEntries WHERE id=?`, id)
-	var e FeedEntry
-	if err := row.Scan(&e.ID, &e.PublicID, &e.FeedID, &e.CreatedAt, &e.Author, &e.Title, &e.Content); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		return nil, err
-	}
-	return &e, nil
+func GetFeedByIDTx(ctx context.Context, tx *sql.Tx, id int64) (*Feed, error) {
+	return scanFeed(tx.QueryRowContext(ctx, `SELECT `+feedColumns+` FROM feeds WHERE id=?`, id))
+}
+
+func GetEntryByID(ctx context.Context, dbx Reader, id int64) (*FeedEntry, error) {
+	return scanEntry(dbx.QueryRowContext(ctx, `SELECT `+entryColumns+` FROM feedEntries e WHERE e.id=?`, id))
 }
 
 func UpdateFeedEmailIcon(ctx context.Context, tx *sql.Tx, feedID int64, emailIcon string) error {
-	_, err := tx.ExecContext(ctx, `UPDATE feeds SET emailIcon=? WHERE id=?`, emailIcon, feedID)
+	_, err := tx.ExecContext(ctx, `UPDATE feeds SET emailIcon=?, updatedAt=`+nowSQL+` WHERE id=? AND emailIcon IS NOT ?`, emailIcon, feedID, emailIcon)
 	return err
 }
 
-func GetWebSubSubscriptionsRecentTx(ctx context.Context, tx *sql.Tx, feedID int64, since string) ([]struct {
+// GetActiveWebSubSubscriptionsTx returns a feed's subscriptions whose lease
+// hasn't ended by now.
+func GetActiveWebSubSubscriptionsTx(ctx context.Context, tx *sql.Tx, feedID int64, now string) ([]struct {
 	ID       int64
 	Callback string
 	Secret   *string
 }, error) {
-	rows, err := tx.QueryContext(ctx, `SELECT id, callback, secret FROM feedWebSubSubscriptions WHERE feed=? AND ? < createdAt`, feedID, since)
+	rows, err := tx.QueryContext(ctx, `SELECT id, callback, secret FROM feedWebSubSubscriptions WHERE feed=? AND ? < expiresAt`, feedID, now)
 	if err != nil {
 		return nil, err
 	}
@@ -65,29 +55,46 @@ func GetWebSubSubscriptionsRecentTx(ctx context.Context, tx *sql.Tx, feedID int6
 	return out, rows.Err()
 }
 
-func GetAllEntriesAscTx(ctx context.Context, tx *sql.Tx, feedID int64) ([]FeedEntry, error) {
-	rows, err := tx.QueryContext(ctx, `SELECT id, publicId, feed, createdAt, author, title, content FROM feedEntries WHERE feed=? ORDER BY id ASC`, feedID)
+func DeleteEntryByID(ctx context.Context, tx *sql.Tx, id int64) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM feedEntries WHERE id=?`, id)
+	return err
+}
+
+func DeleteEnclosureLinksByEntry(ctx context.Context, tx *sql.Tx, entryID int64) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM feedEntryEnclosureLinks WHERE feedEntry=?`, entryID)
+	return err
+}
+
+// EntrySize is an entry's storage footprint: title, content and enclosures.
+type EntrySize struct {
+	ID        int64
+	CreatedAt string
+	Bytes     int64
+}
+
+// GetEntrySizesDescTx returns the footprint of every entry of a feed, newest
+// first: its title, both copies of its content and its enclosures.
+func GetEntrySizesDescTx(ctx context.Context, tx *sql.Tx, feedID int64) ([]EntrySize, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT e.id, e.createdAt,
+			length(CAST(e.title AS BLOB)) + length(CAST(e.content AS BLOB)) + length(CAST(COALESCE(e.originalContent, '') AS BLOB)) + COALESCE(SUM(enc.length), 0)
+		FROM feedEntries e
+		LEFT JOIN feedEntryEnclosureLinks l ON l.feedEntry = e.id
+		LEFT JOIN feedEntryEnclosures enc ON enc.id = l.feedEntryEnclosure
+		WHERE e.feed=?
+		GROUP BY e.id
+		ORDER BY e.id DESC`, feedID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var out []FeedEntry
+	var out []EntrySize
 	for rows.Next() {
-		var e FeedEntry
-		if err := rows.Scan(&e.ID, &e.PublicID, &e.FeedID, &e.CreatedAt, &e.Author, &e.Title, &e.Content); err != nil {
+		var es EntrySize
+		if err := rows.Scan(&es.ID, &es.CreatedAt, &es.Bytes); err != nil {
 			return nil, err
 		}
-		out = append(out, e)
+		out = append(out, es)
 	}
 	return out, rows.Err()
 }
-
-func DeleteEntryByID(ctx context.Context, tx *sql.Tx, id int64) error {
-	_, err := tx.ExecContext(ctx, `DELETE FROM feedEntries WHERE id=?`, id)
-	return err
-}
-
-func DeleteEnclosureLinksByEntry(ctx context.Context, tx *sql.Tx, entryID int64) error {
-	_, err := tx.ExecContext(ctx, `DELETE FROM feedEntryEnclosureLinks WHERE feedEntry=?`, entryID)
-	return err
-}
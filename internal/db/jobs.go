@@ -0,0 +1,198 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// EnqueueJob adds a job and wakes the runner of its type in this process.
+func EnqueueJob(ctx context.Context, dbx Writer, typ, startAt string, params string) error {
+	_, err := dbx.ExecContext(ctx, `INSERT INTO backgroundJobs(type, startAt, parameters, status) VALUES (?,?,?, 'pending')`, typ, startAt, params)
+	if err == nil {
+		NotifyJobs(typ)
+	}
+	return err
+}
+
+// EnqueueJobTx adds a job in a transaction of DB.Tx, and wakes the runner
+// of its type in this process once the transaction commits.
+func EnqueueJobTx(ctx context.Context, tx *sql.Tx, typ, startAt string, params string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO backgroundJobs(type, startAt, parameters, status) VALUES (?,?,?, 'pending')`, typ, startAt, params)
+	if err == nil {
+		afterCommit(tx, func() { NotifyJobs(typ) })
+	}
+	return err
+}
+
+// Job is a background job taken by a worker.
+type Job struct {
+	ID         int64
+	Type       string
+	Parameters string
+	// Retries is the number of earlier attempts that failed.
+	Retries   int
+	StartAt   string
+	LastError sql.NullString
+	// LeasedBy is the worker running the job, until LeaseExpiresAt.
+	LeasedBy       sql.NullString
+	LeaseExpiresAt sql.NullString
+}
+
+const jobColumns = `id, type, parameters, retries, startAt, lastError, leasedBy, leaseExpiresAt`
+
+func scanJob(s scanner) (*Job, error) {
+	var j Job
+	if err := s.Scan(&j.ID, &j.Type, &j.Parameters, &j.Retries, &j.StartAt, &j.LastError, &j.LeasedBy, &j.LeaseExpiresAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &j, nil
+}
+
+func scanJobs(rows *sql.Rows) ([]Job, error) {
+	defer rows.Close()
+	var out []Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *j)
+	}
+	return out, rows.Err()
+}
+
+// DequeueJob leases the pending job of a type that is due first to worker
+// until leaseExpiresAt, marking it as running, and returns it, or nil if
+// none is due.
+func DequeueJob(ctx context.Context, tx *sql.Tx, typ, now, worker, leaseExpiresAt string) (*Job, error) {
+	return scanJob(tx.QueryRowContext(ctx, `UPDATE backgroundJobs SET status='running', leasedBy=?, leaseExpiresAt=? WHERE id = (
+		SELECT id FROM backgroundJobs WHERE type=? AND status='pending' AND startAt <= ? ORDER BY startAt, id LIMIT 1
+	) RETURNING `+jobColumns, worker, leaseExpiresAt, typ, now))
+}
+
+// RenewJobLease extends the lease of a job that worker is running, and
+// reports whether it still held it.
+func RenewJobLease(ctx context.Context, dbx Writer, id int64, worker, leaseExpiresAt string) (bool, error) {
+	res, err := dbx.ExecContext(ctx, `UPDATE backgroundJobs SET leaseExpiresAt=? WHERE id=? AND status='running' AND leasedBy=?`, leaseExpiresAt, id, worker)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetExpiredJobs returns running jobs whose lease expired before now,
+// including jobs that were running before jobs were leased.
+func GetExpiredJobs(ctx context.Context, tx *sql.Tx, now string) ([]Job, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT `+jobColumns+` FROM backgroundJobs WHERE status='running' AND (leaseExpiresAt IS NULL OR leaseExpiresAt < ?)`, now)
+	if err != nil {
+		return nil, err
+	}
+	return scanJobs(rows)
+}
+
+// The functions that end an attempt only change jobs that are still leased
+// by the worker that made it, which is empty for jobs without a lease, and
+// report whether they did. A worker that lost its lease mustn't overwrite
+// the outcome of the worker that took the job over.
+const jobLeasedBy = `id=? AND status='running' AND COALESCE(leasedBy, '')=?`
+
+func updateLeasedJob(ctx context.Context, tx *sql.Tx, set string, id int64, worker string, args ...any) (bool, error) {
+	res, err := tx.ExecContext(ctx, `UPDATE backgroundJobs SET `+set+`, leasedBy=NULL, leaseExpiresAt=NULL WHERE `+jobLeasedBy, append(args, id, worker)...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// CompleteJob marks a job as done.
+func CompleteJob(ctx context.Context, tx *sql.Tx, id int64, worker string) (bool, error) {
+	return updateLeasedJob(ctx, tx, `status='done'`, id, worker)
+}
+
+// RetryJob records a failed attempt and makes the job pending again from startAt.
+func RetryJob(ctx context.Context, tx *sql.Tx, id int64, worker, startAt, lastError string) (bool, error) {
+	return updateLeasedJob(ctx, tx, `status='pending', retries=retries+1, startAt=?, lastError=?`, id, worker, startAt, lastError)
+}
+
+// DeadLetterJob records a failed attempt of a job that won't be retried.
+func DeadLetterJob(ctx context.Context, tx *sql.Tx, id int64, worker, lastError string) (bool, error) {
+	return updateLeasedJob(ctx, tx, `status='dead', retries=retries+1, lastError=?`, id, worker, lastError)
+}
+
+// ListDeadJobs returns dead jobs, most recently due first.
+func ListDeadJobs(ctx context.Context, dbx Reader, limit int) ([]Job, error) {
+	rows, err := dbx.QueryContext(ctx, `SELECT `+jobColumns+` FROM backgroundJobs WHERE status='dead' ORDER BY startAt DESC, id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanJobs(rows)
+}
+
+// RequeueDeadJobs makes a dead job, or all of them if id is 0, pending again
+// with retries reset, and returns how many were requeued.
+func RequeueDeadJobs(ctx context.Context, tx *sql.Tx, id int64, startAt string) (int64, error) {
+	res, err := tx.ExecContext(ctx, `UPDATE backgroundJobs SET status='pending', retries=0, startAt=? WHERE status='dead' AND (?=0 OR id=?)`, startAt, id, id)
+	if err != nil {
+		return 0, err
+	}
+	afterCommit(tx, func() { NotifyJobs("") })
+	return res.RowsAffected()
+}
+
+// GetNextJobStartAt returns when the next pending job of a type is due, or
+// "" if there is none.
+func GetNextJobStartAt(ctx context.Context, dbx Reader, typ string) (string, error) {
+	var startAt sql.NullString
+	err := dbx.QueryRowContext(ctx, `SELECT MIN(startAt) FROM backgroundJobs WHERE type=? AND status='pending'`, typ).Scan(&startAt)
+	return startAt.String, err
+}
+
+// jobSignals has a channel per job type that runners in this process wait
+// on for new jobs. Runners also poll, for jobs added by other processes.
+var jobSignals = struct {
+	sync.Mutex
+	chans map[string]chan struct{}
+}{chans: map[string]chan struct{}{}}
+
+func jobSignal(typ string) chan struct{} {
+	jobSignals.Lock()
+	defer jobSignals.Unlock()
+	c, ok := jobSignals.chans[typ]
+	if !ok {
+		c = make(chan struct{}, 1)
+		jobSignals.chans[typ] = c
+	}
+	return c
+}
+
+// JobsEnqueued returns the channel that receives when jobs of a type are
+// enqueued or requeued in this process. Sends don't block, so a receiver
+// may be woken once for several jobs.
+func JobsEnqueued(typ string) <-chan struct{} { return jobSignal(typ) }
+
+// NotifyJobs wakes the runner of a job type, or of all types if typ is "",
+// after jobs were added or made due.
+func NotifyJobs(typ string) {
+	var chans []chan struct{}
+	if typ == "" {
+		jobSignals.Lock()
+		for _, c := range jobSignals.chans {
+			chans = append(chans, c)
+		}
+		jobSignals.Unlock()
+	} else {
+		chans = append(chans, jobSignal(typ))
+	}
+	for _, c := range chans {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// Migrations are the numbered files in migrations/, named like
+// 0002_add_something.sql. Each is applied once, in order, in a transaction
+// that also records it in schema_migrations, so a failed migration leaves
+// the schema as it was. Released migrations must not be edited; add a new
+// one instead.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is a schema migration.
+type Migration struct {
+	Version int
+	Name    string
+	// AppliedAt is when the migration was applied, or empty if it is pending.
+	AppliedAt string
+	sql       string
+}
+
+func (m Migration) String() string { return fmt.Sprintf("%04d_%s", m.Version, m.Name) }
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer
+// version, whose schema this version may not be able to use.
+var ErrSchemaTooNew = errors.New("database schema is newer than this version supports")
+
+var migrations = loadMigrations()
+
+var migrationFileRe = regexp.MustCompile(`^([0-9]{4})_([a-z0-9_]+)\.sql$`)
+
+func loadMigrations() []Migration {
+	files, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		panic(err)
+	}
+	var out []Migration
+	for i, f := range files {
+		m := migrationFileRe.FindStringSubmatch(f.Name())
+		if m == nil {
+			panic("db: invalid migration file name " + f.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		if version != i+1 {
+			panic(fmt.Sprintf("db: migration %s should be number %d", f.Name(), i+1))
+		}
+		b, err := migrationFiles.ReadFile("migrations/" + f.Name())
+		if err != nil {
+			panic(err)
+		}
+		out = append(out, Migration{Version: version, Name: m[2], sql: string(b)})
+	}
+	return out
+}
+
+// migrationSteps run Go code in a migration's transaction, before or after
+// its SQL, for changes that SQL can't make.
+var migrationSteps = map[int]struct {
+	before, after func(context.Context, *sql.Tx) error
+}{
+	1: {before: addLegacyColumns, after: indexUnsearchableEntries},
+}
+
+const createSchemaMigrations = `CREATE TABLE IF NOT EXISTS schema_migrations (
+  version INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  appliedAt TEXT NOT NULL
+)`
+
+// Migrations returns the migrations this version knows, applied or pending,
+// followed by those applied by newer versions.
+func (d *DB) Migrations(ctx context.Context) ([]Migration, error) {
+	applied, err := appliedMigrations(ctx, d.Write)
+	if err != nil {
+		return nil, err
+	}
+	out := slices.Clone(migrations)
+	for i := range out {
+		if a, ok := applied[out[i].Version]; ok {
+			out[i].AppliedAt = a.AppliedAt
+		}
+	}
+	for _, a := range applied {
+		if a.Version > len(migrations) {
+			out = append(out, a)
+		}
+	}
+	slices.SortFunc(out, func(a, b Migration) int { return a.Version - b.Version })
+	return out, nil
+}
+
+// Migrate applies the pending migrations and returns them. It refuses to
+// change a database with migrations it doesn't know.
+func (d *DB) Migrate(ctx context.Context) ([]Migration, error) {
+	conn, err := d.Write.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	version, err := schemaVersion(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	if version > len(migrations) {
+		return nil, fmt.Errorf("%w: it is at version %d, this version knows up to %d", ErrSchemaTooNew, version, len(migrations))
+	}
+	// Changing a constraint means rebuilding the table, which needs foreign
+	// keys off. They can't be turned off inside a transaction, so they are
+	// off for all migrations and each one checks them before committing.
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(context.Background(), `PRAGMA foreign_keys = ON`)
+	var applied []Migration
+	for _, m := range migrations[version:] {
+		ok, err := applyMigration(ctx, conn, &m)
+		if err != nil {
+			return applied, fmt.Errorf("migration %s: %w", m, err)
+		}
+		if ok {
+			applied = append(applied, m)
+		}
+	}
+	return applied, nil
+}
+
+// applyMigration applies m and sets its AppliedAt, unless another process
+// applied it first.
+func applyMigration(ctx context.Context, conn *sql.Conn, m *Migration) (bool, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if version, err := schemaVersion(ctx, tx); err != nil || version >= m.Version {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, createSchemaMigrations); err != nil {
+		return false, err
+	}
+	violations, err := foreignKeyViolations(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	steps := migrationSteps[m.Version]
+	if steps.before != nil {
+		if err := steps.before(ctx, tx); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+		return false, err
+	}
+	if steps.after != nil {
+		if err := steps.after(ctx, tx); err != nil {
+			return false, err
+		}
+	}
+	n, err := foreignKeyViolations(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	if n > violations {
+		return false, fmt.Errorf("%d more rows reference missing rows", n-violations)
+	}
+	if err := tx.QueryRowContext(ctx, `INSERT INTO schema_migrations (version, name, appliedAt) VALUES (?, ?, `+nowSQL+`) RETURNING appliedAt`, m.Version, m.Name).Scan(&m.AppliedAt); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// foreignKeyViolations counts rows that reference missing rows. Databases
+// from before foreign keys were enforced on every connection may have some,
+// so migrations only fail if they add more.
+func foreignKeyViolations(ctx context.Context, tx *sql.Tx) (int, error) {
+	rows, err := tx.QueryContext(ctx, `PRAGMA foreign_key_check`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	return n, rows.Err()
+}
+
+// schemaVersion returns the number of the last migration applied, or 0 for
+// new databases and those from before migrations were numbered.
+func schemaVersion(ctx context.Context, q Reader) (int, error) {
+	if ok, err := tableExists(ctx, q, "schema_migrations"); err != nil || !ok {
+		return 0, err
+	}
+	var version int
+	err := q.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+func appliedMigrations(ctx context.Context, q Reader) (map[int]Migration, error) {
+	if ok, err := tableExists(ctx, q, "schema_migrations"); err != nil || !ok {
+		return nil, err
+	}
+	rows, err := q.QueryContext(ctx, `SELECT version, name, appliedAt FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[int]Migration{}
+	for rows.Next() {
+		var m Migration
+		if err := rows.Scan(&m.Version, &m.Name, &m.AppliedAt); err != nil {
+			return nil, err
+		}
+		out[m.Version] = m
+	}
+	return out, rows.Err()
+}
+
+func tableExists(ctx context.Context, q Reader, name string) (bool, error) {
+	var n int
+	err := q.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&n)
+	return n > 0, err
+}
+
+// legacyColumns lists the columns that tables gained before migrations were
+// numbered. Databases from that time may lack any of them; new databases get
+// them from the CREATE TABLE statements of the first migration.
+var legacyColumns = []struct{ table, column, definition string }{
+	{"feeds", "emailId", "TEXT NULL"},
+	{"feeds", "readToken", "TEXT NULL"},
+	{"feeds", "manageToken", "TEXT NULL"},
+	{"feeds", "updatedAt", "TEXT NULL"},
+	{"feeds", "retentionMaxBytes", "INTEGER NULL"},
+	{"feeds", "retentionMaxEntries", "INTEGER NULL"},
+	{"feeds", "retentionMaxAgeDays", "INTEGER NULL"},
+	{"feeds", "privacyCleaning", "INTEGER NOT NULL DEFAULT 1"},
+	{"feeds", "lastEntrySequence", "INTEGER NOT NULL DEFAULT 0"},
+	{"feedWebSubSubscriptions", "format", "TEXT NOT NULL DEFAULT 'xml'"},
+	{"feedEntries", "updatedAt", "TEXT NULL"},
+	{"feedEntries", "messageId", "TEXT NULL"},
+	{"feedEntries", "contentHash", "TEXT NULL"},
+	{"feedEntries", "authorEmail", "TEXT NULL"},
+	{"feedEntries", "publishedAt", "TEXT NULL"},
+	{"feedEntries", "originalContent", "TEXT NULL"},
+	{"feedEntries", "sanitizerVersion", "INTEGER NULL"},
+	{"feedEntries", "privacyReport", "TEXT NULL"},
+	{"feedEntries", "sequence", "INTEGER NULL"},
+	{"feedEntryEnclosureLinks", "inline", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// addLegacyColumns adds the legacy columns that a database from before
+// migrations were numbered lacks, so that the first migration can complete
+// its schema.
+func addLegacyColumns(ctx context.Context, tx *sql.Tx) error {
+	for _, c := range legacyColumns {
+		cols, err := tableColumns(ctx, tx, c.table)
+		if err != nil {
+			return err
+		}
+		// Table not created yet; the first migration creates it with the column.
+		if len(cols) == 0 {
+			continue
+		}
+		if _, ok := cols[c.column]; ok {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, c.table, c.column, c.definition)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tableColumns(ctx context.Context, q Reader, table string) (map[string]struct{}, error) {
+	rows, err := q.QueryContext(ctx, fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols := map[string]struct{}{}
+	for rows.Next() {
+		var (
+			cid     int
+			name    string
+			typ     string
+			notNull int
+			dflt    sql.NullString
+			pk      int
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		cols[name] = struct{}{}
+	}
+	return cols, rows.Err()
+}
+
+// indexUnsearchableEntries adds entries stored before the full-text index
+// existed. Text extraction happens in Go, so it can't be done in SQL.
+func indexUnsearchableEntries(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT id, title, COALESCE(author, ''), COALESCE(authorEmail, ''), content FROM feedEntries WHERE id NOT IN (SELECT rowid FROM feedEntriesSearch)`)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id                                  int64
+		title, author, authorEmail, content string
+	}
+	var todo []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.title, &p.author, &p.authorEmail, &p.content); err != nil {
+			rows.Close()
+			return err
+		}
+		todo = append(todo, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, p := range todo {
+		if err := indexEntry(ctx, tx, p.id, p.title, p.author, p.authorEmail, p.content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
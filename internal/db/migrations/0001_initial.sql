@@ -0,0 +1,156 @@
+-- Schema for Kill the Newsletter! (Go)
+--
+-- Databases created before migrations were numbered have no
+-- schema_migrations table and may lack some of the columns below, which are
+-- added before this migration runs. The statements are idempotent so that it
+-- completes those databases as well as creating new ones. Later migrations
+-- don't need to be.
+
+CREATE TABLE IF NOT EXISTS feeds (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  publicId TEXT NOT NULL UNIQUE,
+  emailId TEXT NULL,
+  readToken TEXT NULL,
+  manageToken TEXT NULL,
+  title TEXT NOT NULL,
+  icon TEXT NULL,
+  emailIcon TEXT NULL,
+  updatedAt TEXT NULL,
+  -- Retention overrides; NULL uses the instance default and 0 means unlimited
+  retentionMaxBytes INTEGER NULL,
+  retentionMaxEntries INTEGER NULL,
+  retentionMaxAgeDays INTEGER NULL,
+  -- 1 to remove tracking pixels, tracking parameters and redirects from entries
+  privacyCleaning INTEGER NOT NULL DEFAULT 1,
+  -- Sequence number of the last entry received, see feedEntries.sequence
+  lastEntrySequence INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS index_feeds_publicId ON feeds(publicId);
+-- Feeds created before the inbound address, read and manage secrets were split
+-- keep using their publicId for all three so existing URLs keep working.
+UPDATE feeds SET emailId = publicId WHERE emailId IS NULL;
+UPDATE feeds SET readToken = publicId WHERE readToken IS NULL;
+UPDATE feeds SET manageToken = publicId WHERE manageToken IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS index_feeds_emailId ON feeds(emailId);
+CREATE UNIQUE INDEX IF NOT EXISTS index_feeds_readToken ON feeds(readToken);
+CREATE UNIQUE INDEX IF NOT EXISTS index_feeds_manageToken ON feeds(manageToken);
+
+CREATE TABLE IF NOT EXISTS feedEntries (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  publicId TEXT NOT NULL UNIQUE,
+  feed INTEGER NOT NULL REFERENCES feeds(id) ON DELETE CASCADE,
+  -- Position of the entry in its feed, from 1; numbers aren't reused after
+  -- deletions, so the archive pages built from them stay stable
+  sequence INTEGER NULL,
+  createdAt TEXT NOT NULL,
+  -- Set when a later message with the same Message-ID, or one that supersedes
+  -- it, replaced the entry's content
+  updatedAt TEXT NULL,
+  -- The Date header when it is plausible; NULL falls back to createdAt
+  publishedAt TEXT NULL,
+  -- Display name (or address) and address from the From header
+  author TEXT NULL,
+  authorEmail TEXT NULL,
+  title TEXT NOT NULL,
+  -- Sanitized and, if enabled for the feed, privacy-cleaned HTML;
+  -- originalContent is the HTML as received, kept so that content can be
+  -- derived again when the rules identified by sanitizerVersion change
+  content TEXT NOT NULL,
+  originalContent TEXT NULL,
+  sanitizerVersion INTEGER NULL,
+  -- JSON record of what privacy cleaning removed, NULL if nothing
+  privacyReport TEXT NULL,
+  -- Message-ID without angle brackets, and a hash of the message's content;
+  -- NULL for entries received before deduplication
+  messageId TEXT NULL,
+  contentHash TEXT NULL
+);
+CREATE INDEX IF NOT EXISTS index_feedEntries_publicId ON feedEntries(publicId);
+CREATE INDEX IF NOT EXISTS index_feedEntries_feed ON feedEntries(feed);
+CREATE INDEX IF NOT EXISTS index_feedEntries_feed_messageId ON feedEntries(feed, messageId);
+CREATE INDEX IF NOT EXISTS index_feedEntries_feed_sequence ON feedEntries(feed, sequence);
+-- Entries received before archive pages existed are numbered in the order
+-- they were received.
+UPDATE feedEntries SET sequence = (
+  SELECT COUNT(*) FROM feedEntries older WHERE older.feed = feedEntries.feed AND older.id <= feedEntries.id
+) WHERE sequence IS NULL;
+UPDATE feeds SET lastEntrySequence = (SELECT MAX(sequence) FROM feedEntries WHERE feed = feeds.id)
+  WHERE lastEntrySequence < (SELECT COALESCE(MAX(sequence), 0) FROM feedEntries WHERE feed = feeds.id);
+-- Entries received before From headers were parsed have the envelope sender
+-- as author.
+UPDATE feedEntries SET authorEmail = author WHERE authorEmail IS NULL AND author LIKE '%@%';
+
+-- Full-text index over entries; rowid is feedEntries.id. Rows are inserted by
+-- InsertEntry with the text extracted from the HTML content, and removed by
+-- the trigger so that cascading deletes are covered too.
+CREATE VIRTUAL TABLE IF NOT EXISTS feedEntriesSearch USING fts5(
+  title,
+  author,
+  content,
+  tokenize = 'unicode61 remove_diacritics 2'
+);
+CREATE TRIGGER IF NOT EXISTS feedEntries_search_delete AFTER DELETE ON feedEntries BEGIN
+  DELETE FROM feedEntriesSearch WHERE rowid = old.id;
+END;
+
+CREATE TABLE IF NOT EXISTS feedEntryEnclosures (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  publicId TEXT NOT NULL UNIQUE,
+  type TEXT NOT NULL,
+  length INTEGER NOT NULL,
+  name TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS feedEntryEnclosureLinks (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  feedEntry INTEGER NOT NULL REFERENCES feedEntries(id) ON DELETE CASCADE,
+  feedEntryEnclosure INTEGER NOT NULL REFERENCES feedEntryEnclosures(id) ON DELETE CASCADE,
+  -- 1 for inline parts that the entry's content references by cid:; these
+  -- are shown in place rather than listed as enclosures
+  inline INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS index_feedEntryEnclosureLinks_feedEntry ON feedEntryEnclosureLinks(feedEntry);
+CREATE INDEX IF NOT EXISTS index_feedEntryEnclosureLinks_feedEntryEnclosure ON feedEntryEnclosureLinks(feedEntryEnclosure);
+
+CREATE TABLE IF NOT EXISTS feedVisualizations (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  feed INTEGER NOT NULL REFERENCES feeds(id) ON DELETE CASCADE,
+  createdAt TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS index_feedVisualizations_feed ON feedVisualizations(feed);
+CREATE INDEX IF NOT EXISTS index_feedVisualizations_createdAt ON feedVisualizations(createdAt);
+
+CREATE TABLE IF NOT EXISTS feedWebSubSubscriptions (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  feed INTEGER NOT NULL REFERENCES feeds(id) ON DELETE CASCADE,
+  createdAt TEXT NOT NULL,
+  callback TEXT NOT NULL,
+  secret TEXT NULL,
+  format TEXT NOT NULL DEFAULT 'xml',
+  UNIQUE(feed, callback)
+);
+CREATE INDEX IF NOT EXISTS index_feedWebSubSubscriptions_feed ON feedWebSubSubscriptions(feed);
+CREATE INDEX IF NOT EXISTS index_feedWebSubSubscriptions_createdAt ON feedWebSubSubscriptions(createdAt);
+CREATE INDEX IF NOT EXISTS index_feedWebSubSubscriptions_callback ON feedWebSubSubscriptions(callback);
+
+-- Background jobs table
+CREATE TABLE IF NOT EXISTS backgroundJobs (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  type TEXT NOT NULL,
+  startAt TEXT NOT NULL,
+  parameters TEXT NOT NULL,
+  retries INTEGER NOT NULL DEFAULT 0,
+  status TEXT NOT NULL DEFAULT 'pending'
+);
+CREATE INDEX IF NOT EXISTS index_backgroundJobs_type ON backgroundJobs(type);
+CREATE INDEX IF NOT EXISTS index_backgroundJobs_startAt ON backgroundJobs(startAt);
+CREATE INDEX IF NOT EXISTS index_backgroundJobs_status ON backgroundJobs(status);
+
+-- API tokens for /api/v1; only the SHA-256 of each token is stored
+CREATE TABLE IF NOT EXISTS apiTokens (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT NOT NULL,
+  tokenHash TEXT NOT NULL UNIQUE,
+  createdAt TEXT NOT NULL,
+  lastUsedAt TEXT NULL
+);
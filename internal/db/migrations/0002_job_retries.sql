@@ -0,0 +1,7 @@
+-- Jobs are pending until a worker takes them, then running, then done. A job
+-- that fails goes back to pending with a later startAt and one more retry,
+-- until its type's retries are exhausted and it goes to dead, where it stays
+-- until retried by hand. lastError is the error of the last failed attempt.
+ALTER TABLE backgroundJobs ADD COLUMN lastError TEXT NULL;
+-- Jobs used to fail for good on their first error.
+UPDATE backgroundJobs SET status = 'dead', lastError = 'failed before jobs were retried' WHERE status = 'failed';
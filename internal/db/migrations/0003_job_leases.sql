@@ -0,0 +1,6 @@
+-- A running job is leased by the worker that took it, identified by
+-- leasedBy, until leaseExpiresAt. The worker renews the lease while the job
+-- runs; jobs whose lease expired, because their worker died, are taken back.
+ALTER TABLE backgroundJobs ADD COLUMN leasedBy TEXT NULL;
+ALTER TABLE backgroundJobs ADD COLUMN leaseExpiresAt TEXT NULL;
+CREATE INDEX IF NOT EXISTS index_backgroundJobs_status_leaseExpiresAt ON backgroundJobs(status, leaseExpiresAt);
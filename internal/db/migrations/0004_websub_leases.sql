@@ -0,0 +1,6 @@
+-- Subscriptions last for the lease negotiated when they were verified, until
+-- expiresAt. Existing ones were leased for a day, which is how long they were
+-- kept before leases were negotiated.
+ALTER TABLE feedWebSubSubscriptions ADD COLUMN expiresAt TEXT NULL;
+UPDATE feedWebSubSubscriptions SET expiresAt = strftime('%Y-%m-%dT%H:%M:%fZ', createdAt, '+1 day');
+CREATE INDEX IF NOT EXISTS index_feedWebSubSubscriptions_expiresAt ON feedWebSubSubscriptions(expiresAt);
@@ -0,0 +1,25 @@
+-- Webhooks POST each new entry of a feed as JSON to url, signed with secret.
+CREATE TABLE IF NOT EXISTS feedWebhooks (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  publicId TEXT NOT NULL UNIQUE,
+  feed INTEGER NOT NULL REFERENCES feeds(id) ON DELETE CASCADE,
+  createdAt TEXT NOT NULL,
+  url TEXT NOT NULL,
+  secret TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS index_feedWebhooks_feed ON feedWebhooks(feed);
+
+-- Each attempt to deliver an entry to a webhook, with the response status or
+-- the error of the request. Only the latest attempts of each webhook are kept.
+CREATE TABLE IF NOT EXISTS feedWebhookDeliveries (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  webhook INTEGER NOT NULL REFERENCES feedWebhooks(id) ON DELETE CASCADE,
+  createdAt TEXT NOT NULL,
+  event TEXT NOT NULL,
+  entryPublicId TEXT NOT NULL,
+  attempt INTEGER NOT NULL,
+  status INTEGER NULL,
+  error TEXT NULL,
+  durationMilliseconds INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS index_feedWebhookDeliveries_webhook ON feedWebhookDeliveries(webhook, id);
@@ -0,0 +1,20 @@
+-- feedEvents logs the entries created in and deleted from each feed, which
+-- live streams read in order. Triggers log every change, whichever process
+-- and code path makes it. Entries deleted with their feed are logged after
+-- the feed is gone, so feed isn't a foreign key; events are pruned by age.
+CREATE TABLE IF NOT EXISTS feedEvents (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  feed INTEGER NOT NULL,
+  createdAt TEXT NOT NULL,
+  type TEXT NOT NULL,
+  entryPublicId TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS index_feedEvents_feed_id ON feedEvents(feed, id);
+CREATE INDEX IF NOT EXISTS index_feedEvents_createdAt ON feedEvents(createdAt);
+
+CREATE TRIGGER IF NOT EXISTS feedEntries_event_insert AFTER INSERT ON feedEntries BEGIN
+  INSERT INTO feedEvents(feed, createdAt, type, entryPublicId) VALUES (new.feed, strftime('%Y-%m-%dT%H:%M:%fZ', 'now'), 'entry-created', new.publicId);
+END;
+CREATE TRIGGER IF NOT EXISTS feedEntries_event_delete AFTER DELETE ON feedEntries BEGIN
+  INSERT INTO feedEvents(feed, createdAt, type, entryPublicId) VALUES (old.feed, strftime('%Y-%m-%dT%H:%M:%fZ', 'now'), 'entry-deleted', old.publicId);
+END;
@@ -0,0 +1,3 @@
+-- Messages without a Message-ID are recognized as redelivered by their
+-- content hash.
+CREATE INDEX IF NOT EXISTS index_feedEntries_feed_contentHash ON feedEntries(feed, contentHash);
@@ -3,14 +3,57 @@ package db
 import (
 	"context"
 	"database/sql"
+	"strings"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/util"
 )
 
+// Feed is a newsletter feed. Each feed has three independent secrets:
+// EmailID is the local part of its inbound address, ReadToken grants access to
+// the feed documents and entries, and ManageToken grants access to the
+// settings page. PublicID is the stable identifier used in Atom ids.
 type Feed struct {
-	ID        int64
-	PublicID  string
-	Title     string
-	Icon      sql.NullString
-	EmailIcon sql.NullString
+	ID          int64
+	PublicID    string
+	EmailID     string
+	ReadToken   string
+	ManageToken string
+	Title       string
+	Icon        sql.NullString
+	EmailIcon   sql.NullString
+	// UpdatedAt is when the feed's metadata last changed; it is NULL for feeds
+	// that haven't changed since it was introduced.
+	UpdatedAt sql.NullString
+	// Retention overrides; NULL uses the instance default.
+	RetentionMaxBytes   sql.NullInt64
+	RetentionMaxEntries sql.NullInt64
+	RetentionMaxAgeDays sql.NullInt64
+	// PrivacyCleaning removes tracking from the feed's entries.
+	PrivacyCleaning bool
+	// LastEntrySequence is the sequence number of the last entry received;
+	// entries are numbered 1, 2, ... per feed and numbers aren't reused.
+	LastEntrySequence int64
+}
+
+const feedColumns = `id, publicId, emailId, readToken, manageToken, title, icon, emailIcon, updatedAt, retentionMaxBytes, retentionMaxEntries, retentionMaxAgeDays, privacyCleaning, lastEntrySequence`
+
+// nowSQL is the current time in the same format as the timestamps written from Go.
+const nowSQL = `strftime('%Y-%m-%dT%H:%M:%fZ', 'now')`
+
+// scanner is implemented by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanFeed(row scanner) (*Feed, error) {
+	var f Feed
+	if err := row.Scan(&f.ID, &f.PublicID, &f.EmailID, &f.ReadToken, &f.ManageToken, &f.Title, &f.Icon, &f.EmailIcon, &f.UpdatedAt, &f.RetentionMaxBytes, &f.RetentionMaxEntries, &f.RetentionMaxAgeDays, &f.PrivacyCleaning, &f.LastEntrySequence); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &f, nil
 }
 
 type FeedEntry struct {
@@ -18,9 +61,38 @@ type FeedEntry struct {
 	PublicID  string
 	FeedID    int64
 	CreatedAt string
-	Author    sql.NullString
-	Title     string
-	Content   string
+	// UpdatedAt is set when a later message replaced the entry's content.
+	UpdatedAt sql.NullString
+	// PublishedAt is the message's Date header, if it was plausible.
+	PublishedAt sql.NullString
+	// Author is the sender's display name, or address if it has none.
+	Author      sql.NullString
+	AuthorEmail sql.NullString
+	Title       string
+	Content     string
+	// PrivacyReport is the JSON record of what privacy cleaning removed.
+	PrivacyReport sql.NullString
+	// MessageID is the Message-ID header without angle brackets, and
+	// ContentHash identifies the message's content for deduplication.
+	MessageID   sql.NullString
+	ContentHash sql.NullString
+}
+
+const entryColumns = `e.id, e.publicId, e.feed, e.createdAt, e.updatedAt, e.publishedAt, e.author, e.authorEmail, e.title, e.content, e.privacyReport, e.messageId, e.contentHash`
+
+func (e *FeedEntry) scanDest() []any {
+	return []any{&e.ID, &e.PublicID, &e.FeedID, &e.CreatedAt, &e.UpdatedAt, &e.PublishedAt, &e.Author, &e.AuthorEmail, &e.Title, &e.Content, &e.PrivacyReport, &e.MessageID, &e.ContentHash}
+}
+
+func scanEntry(row scanner) (*FeedEntry, error) {
+	var e FeedEntry
+	if err := row.Scan(e.scanDest()...); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &e, nil
 }
 
 type Enclosure struct {
@@ -29,35 +101,74 @@ type Enclosure struct {
 	Type     string
 	Length   int64
 	Name     string
+	// Inline is set for parts the entry's content shows in place.
+	Inline bool
 }
 
 // Feeds
-func CreateFeed(ctx context.Context, tx *sql.Tx, publicId, title string) (int64, error) {
-	res, err := tx.ExecContext(ctx, `INSERT INTO feeds(publicId, title) VALUES (?, ?)`, publicId, title)
+func CreateFeed(ctx context.Context, tx *sql.Tx, publicId, emailId, readToken, manageToken, title string) (int64, error) {
+	res, err := tx.ExecContext(ctx, `INSERT INTO feeds(publicId, emailId, readToken, manageToken, title) VALUES (?,?,?,?,?)`, publicId, emailId, readToken, manageToken, title)
 	if err != nil {
 		return 0, err
 	}
 	return res.LastInsertId()
 }
 
-func GetFeedByPublicID(ctx context.Context, dbx *sql.DB, pub string) (*Feed, error) {
-	row := dbx.QueryRowContext(ctx, `SELECT id, publicId, title, icon, emailIcon FROM feeds WHERE publicId=?`, pub)
-	var f Feed
-	if err := row.Scan(&f.ID, &f.PublicID, &f.Title, &f.Icon, &f.EmailIcon); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
+func GetFeedByPublicID(ctx context.Context, dbx Reader, pub string) (*Feed, error) {
+	return scanFeed(dbx.QueryRowContext(ctx, `SELECT `+feedColumns+` FROM feeds WHERE publicId=?`, pub))
+}
+
+// GetFeedByEmailID looks up the feed that receives mail at emailId@hostname.
+func GetFeedByEmailID(ctx context.Context, dbx Reader, emailId string) (*Feed, error) {
+	return scanFeed(dbx.QueryRowContext(ctx, `SELECT `+feedColumns+` FROM feeds WHERE emailId=?`, emailId))
+}
+
+// GetFeedByReadToken looks up the feed served at /feeds/<readToken>.xml.
+func GetFeedByReadToken(ctx context.Context, dbx Reader, token string) (*Feed, error) {
+	return scanFeed(dbx.QueryRowContext(ctx, `SELECT `+feedColumns+` FROM feeds WHERE readToken=?`, token))
+}
+
+// GetFeedByManageToken looks up the feed whose settings page is /feeds/<manageToken>.
+func GetFeedByManageToken(ctx context.Context, dbx Reader, token string) (*Feed, error) {
+	return scanFeed(dbx.QueryRowContext(ctx, `SELECT `+feedColumns+` FROM feeds WHERE manageToken=?`, token))
+}
+
+func ListFeeds(ctx context.Context, dbx Reader) ([]Feed, error) {
+	rows, err := dbx.QueryContext(ctx, `SELECT `+feedColumns+` FROM feeds ORDER BY id ASC`)
+	if err != nil {
 		return nil, err
 	}
-	return &f, nil
+	defer rows.Close()
+	var out []Feed
+	for rows.Next() {
+		f, err := scanFeed(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *f)
+	}
+	return out, rows.Err()
 }
 
 func UpdateFeed(ctx context.Context, tx *sql.Tx, id int64, title string, icon *string) error {
 	if icon == nil {
-		_, err := tx.ExecContext(ctx, `UPDATE feeds SET title=?, icon=NULL WHERE id=?`, title, id)
+		_, err := tx.ExecContext(ctx, `UPDATE feeds SET title=?, icon=NULL, updatedAt=`+nowSQL+` WHERE id=?`, title, id)
 		return err
 	}
-	_, err := tx.ExecContext(ctx, `UPDATE feeds SET title=?, icon=? WHERE id=?`, title, *icon, id)
+	_, err := tx.ExecContext(ctx, `UPDATE feeds SET title=?, icon=?, updatedAt=`+nowSQL+` WHERE id=?`, title, *icon, id)
+	return err
+}
+
+// UpdateFeedRetention sets the feed's retention overrides; nil uses the instance default.
+func UpdateFeedRetention(ctx context.Context, tx *sql.Tx, id int64, maxBytes, maxEntries, maxAgeDays *int64) error {
+	_, err := tx.ExecContext(ctx, `UPDATE feeds SET retentionMaxBytes=?, retentionMaxEntries=?, retentionMaxAgeDays=? WHERE id=?`, maxBytes, maxEntries, maxAgeDays, id)
+	return err
+}
+
+// TouchFeed marks the feed document as changed for reasons other than a new
+// entry, such as an entry being deleted.
+func TouchFeed(ctx context.Context, tx *sql.Tx, id int64) error {
+	_, err := tx.ExecContext(ctx, `UPDATE feeds SET updatedAt=`+nowSQL+` WHERE id=?`, id)
 	return err
 }
 
@@ -67,45 +178,265 @@ func DeleteFeed(ctx context.Context, tx *sql.Tx, id int64) error {
 }
 
 // Entries
-func InsertEntry(ctx context.Context, tx *sql.Tx, publicId string, feedID int64, createdAt, author, title, content string) (int64, error) {
-	var a *string
-	if author != "" {
-		a = &author
+// EntryContent is what a message contributes to an entry. Empty strings are
+// stored as NULL. The entry's content is derived from OriginalContent when
+// stored, see entryHTML.
+type EntryContent struct {
+	PublishedAt     string
+	Author          string
+	AuthorEmail     string
+	Title           string
+	OriginalContent string
+	// CleanPrivacy is the feed's PrivacyCleaning setting.
+	CleanPrivacy bool
+	MessageID    string
+	ContentHash  string
+}
+
+func InsertEntry(ctx context.Context, tx *sql.Tx, publicId string, feedID int64, createdAt string, c EntryContent) (int64, error) {
+	content, report := entryHTML(c.OriginalContent, c.CleanPrivacy)
+	var sequence int64
+	if err := tx.QueryRowContext(ctx, `UPDATE feeds SET lastEntrySequence = lastEntrySequence + 1 WHERE id=? RETURNING lastEntrySequence`, feedID).Scan(&sequence); err != nil {
+		return 0, err
 	}
-	res, err := tx.ExecContext(ctx, `INSERT INTO feedEntries(publicId, feed, createdAt, author, title, content) VALUES (?,?,?,?,?,?)`, publicId, feedID, createdAt, a, title, content)
+	res, err := tx.ExecContext(ctx, `INSERT INTO feedEntries(publicId, feed, sequence, createdAt, publishedAt, author, authorEmail, title, content, originalContent, sanitizerVersion, privacyReport, messageId, contentHash) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		publicId, feedID, sequence, createdAt, nullIfEmpty(c.PublishedAt), nullIfEmpty(c.Author), nullIfEmpty(c.AuthorEmail), c.Title, content, c.OriginalContent, contentVersion, nullIfEmpty(report), nullIfEmpty(c.MessageID), nullIfEmpty(c.ContentHash))
 	if err != nil {
 		return 0, err
 	}
-	return res.LastInsertId()
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return id, indexEntry(ctx, tx, id, c.Title, c.Author, c.AuthorEmail, content)
 }
 
-func GetFeedEntriesDesc(ctx context.Context, dbx *sql.DB, feedID int64) ([]FeedEntry, error) {
-	rows, err := dbx.QueryContext(ctx, `SELECT id, publicId, feed, createdAt, author, title, content FROM feedEntries WHERE feed=? ORDER BY id DESC`, feedID)
+// UpdateEntry replaces the content of an entry with that of a newer message
+// and sets its updatedAt; the entry keeps its id, publicId and createdAt.
+func UpdateEntry(ctx context.Context, tx *sql.Tx, id int64, updatedAt string, c EntryContent) error {
+	content, report := entryHTML(c.OriginalContent, c.CleanPrivacy)
+	_, err := tx.ExecContext(ctx, `UPDATE feedEntries SET updatedAt=?, publishedAt=?, author=?, authorEmail=?, title=?, content=?, originalContent=?, sanitizerVersion=?, privacyReport=?, messageId=?, contentHash=? WHERE id=?`,
+		updatedAt, nullIfEmpty(c.PublishedAt), nullIfEmpty(c.Author), nullIfEmpty(c.AuthorEmail), c.Title, content, c.OriginalContent, contentVersion, nullIfEmpty(report), nullIfEmpty(c.MessageID), nullIfEmpty(c.ContentHash), id)
+	if err != nil {
+		return err
+	}
+	return reindexEntry(ctx, tx, id, c.Title, c.Author, c.AuthorEmail, content)
+}
+
+// GetEntryByMessageIDTx returns the newest entry of a feed that was received
+// with any of the given Message-IDs.
+func GetEntryByMessageIDTx(ctx context.Context, tx *sql.Tx, feedID int64, messageIds []string) (*FeedEntry, error) {
+	if len(messageIds) == 0 {
+		return nil, nil
+	}
+	args := []any{feedID}
+	for _, id := range messageIds {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(messageIds)), ",")
+	return scanEntry(tx.QueryRowContext(ctx, `SELECT `+entryColumns+` FROM feedEntries e WHERE e.feed=? AND e.messageId IN (`+placeholders+`) ORDER BY e.id DESC LIMIT 1`, args...))
+}
+
+// GetEntryByContentHashTx returns the latest entry of a feed with the given
+// content hash, which identifies redeliveries of messages without a
+// Message-ID.
+func GetEntryByContentHashTx(ctx context.Context, tx *sql.Tx, feedID int64, contentHash string) (*FeedEntry, error) {
+	return scanEntry(tx.QueryRowContext(ctx, `SELECT `+entryColumns+` FROM feedEntries e WHERE e.feed=? AND e.contentHash=? ORDER BY e.id DESC LIMIT 1`, feedID, contentHash))
+}
+
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// indexEntry adds an entry to the full-text index; the trigger on
+// feedEntries removes it when the entry is deleted.
+func indexEntry(ctx context.Context, tx *sql.Tx, id int64, title, author, authorEmail, content string) error {
+	if authorEmail != author {
+		author = strings.TrimSpace(author + " " + authorEmail)
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO feedEntriesSearch(rowid, title, author, content) VALUES (?,?,?,?)`, id, title, author, util.HTMLToText(content))
+	return err
+}
+
+func reindexEntry(ctx context.Context, tx *sql.Tx, id int64, title, author, authorEmail, content string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM feedEntriesSearch WHERE rowid=?`, id); err != nil {
+		return err
+	}
+	return indexEntry(ctx, tx, id, title, author, authorEmail, content)
+}
+
+// SearchQuery turns user input into an FTS5 query that matches entries
+// containing every term, treating each term as a prefix. FTS5 operators in
+// the input are matched literally.
+func SearchQuery(q string) string {
+	var terms []string
+	for _, t := range strings.Fields(q) {
+		terms = append(terms, `"`+strings.ReplaceAll(t, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// SearchEntries returns the newest entries of a feed matching the user query.
+func SearchEntries(ctx context.Context, dbx Reader, feedID int64, q string, limit int) ([]FeedEntry, error) {
+	match := SearchQuery(q)
+	if match == "" {
+		return nil, nil
+	}
+	rows, err := dbx.QueryContext(ctx, `SELECT `+entryColumns+` FROM feedEntriesSearch s JOIN feedEntries e ON e.id = s.rowid WHERE feedEntriesSearch MATCH ? AND e.feed=? ORDER BY e.id DESC LIMIT ?`, match, feedID, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var out []FeedEntry
 	for rows.Next() {
-		var e FeedEntry
-		if err := rows.Scan(&e.ID, &e.PublicID, &e.FeedID, &e.CreatedAt, &e.Author, &e.Title, &e.Content); err != nil {
+		e, err := scanEntry(rows)
+		if err != nil {
 			return nil, err
 		}
-		out = append(out, e)
+		out = append(out, *e)
 	}
 	return out, rows.Err()
 }
 
-func GetEntryByPublicID(ctx context.Context, dbx *sql.DB, feedID int64, pub string) (*FeedEntry, error) {
-	row := dbx.QueryRowContext(ctx, `SELECT id, publicId, feed, createdAt, author, title, content FROM feedEntries WHERE feed=? AND publicId=?`, feedID, pub)
-	var e FeedEntry
-	if err := row.Scan(&e.ID, &e.PublicID, &e.FeedID, &e.CreatedAt, &e.Author, &e.Title, &e.Content); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
+func GetFeedEntriesDesc(ctx context.Context, dbx Reader, feedID int64) ([]FeedEntry, error) {
+	return queryEntries(ctx, dbx, `SELECT `+entryColumns+` FROM feedEntries e WHERE e.feed=? ORDER BY e.id DESC`, feedID)
+}
+
+// GetFeedEntriesNewest returns the limit newest entries of a feed, newest
+// first.
+func GetFeedEntriesNewest(ctx context.Context, dbx Reader, feedID int64, limit int) ([]FeedEntry, error) {
+	return queryEntries(ctx, dbx, `SELECT `+entryColumns+` FROM feedEntries e WHERE e.feed=? ORDER BY e.id DESC LIMIT ?`, feedID, limit)
+}
+
+// GetFeedEntriesInSequence returns the entries of a feed numbered from first
+// to last, inclusive, newest first.
+func GetFeedEntriesInSequence(ctx context.Context, dbx Reader, feedID, first, last int64) ([]FeedEntry, error) {
+	return queryEntries(ctx, dbx, `SELECT `+entryColumns+` FROM feedEntries e WHERE e.feed=? AND e.sequence BETWEEN ? AND ? ORDER BY e.id DESC`, feedID, first, last)
+}
+
+// GetFeedFirstSequence returns the sequence number of the oldest remaining
+// entry of a feed, or 0 if it has none.
+func GetFeedFirstSequence(ctx context.Context, dbx Reader, feedID int64) (int64, error) {
+	var first int64
+	err := dbx.QueryRowContext(ctx, `SELECT COALESCE(MIN(sequence), 0) FROM feedEntries WHERE feed=?`, feedID).Scan(&first)
+	return first, err
+}
+
+func queryEntries(ctx context.Context, dbx Reader, query string, args ...any) ([]FeedEntry, error) {
+	rows, err := dbx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []FeedEntry
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
 		}
+		out = append(out, *e)
+	}
+	return out, rows.Err()
+}
+
+// EntrySummary is an entry with its storage footprint (title, content and
+// enclosures) and number of attachments, not counting inline images, as
+// listed on the feed page.
+type EntrySummary struct {
+	FeedEntry
+	Bytes       int64
+	Attachments int64
+}
+
+// GetFeedEntriesDescPage is the paginated variant of GetFeedEntriesDesc: it
+// returns up to limit entries older than beforeID (or the newest entries when
+// beforeID is 0), newest first.
+func GetFeedEntriesDescPage(ctx context.Context, dbx Reader, feedID, beforeID int64, limit int) ([]EntrySummary, error) {
+	rows, err := dbx.QueryContext(ctx, `
+		SELECT `+entryColumns+`,
+			length(CAST(e.title AS BLOB)) + length(CAST(e.content AS BLOB)) + length(CAST(COALESCE(e.originalContent, '') AS BLOB)) + COALESCE(SUM(enc.length), 0),
+			COUNT(CASE WHEN l.inline = 0 THEN enc.id END)
+		FROM feedEntries e
+		LEFT JOIN feedEntryEnclosureLinks l ON l.feedEntry = e.id
+		LEFT JOIN feedEntryEnclosures enc ON enc.id = l.feedEntryEnclosure
+		WHERE e.feed=? AND (?=0 OR e.id < ?)
+		GROUP BY e.id
+		ORDER BY e.id DESC
+		LIMIT ?`, feedID, beforeID, beforeID, limit)
+	if err != nil {
 		return nil, err
 	}
-	return &e, nil
+	defer rows.Close()
+	var out []EntrySummary
+	for rows.Next() {
+		var e EntrySummary
+		if err := rows.Scan(append(e.scanDest(), &e.Bytes, &e.Attachments)...); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// FeedValidators summarizes a feed's entries for HTTP cache validation.
+type FeedValidators struct {
+	Count int64
+	MaxID int64
+	// NewestAt is the last time an entry was received or updated.
+	NewestAt string
+}
+
+func GetFeedValidators(ctx context.Context, dbx Reader, feedID int64) (FeedValidators, error) {
+	row := dbx.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(MAX(id), 0), COALESCE(MAX(COALESCE(updatedAt, createdAt)), '') FROM feedEntries WHERE feed=?`, feedID)
+	var v FeedValidators
+	err := row.Scan(&v.Count, &v.MaxID, &v.NewestAt)
+	return v, err
+}
+
+// GetFeedValidatorsInSequence is GetFeedValidators restricted to the entries
+// numbered from first to last, as shown in an archive document.
+func GetFeedValidatorsInSequence(ctx context.Context, dbx Reader, feedID, first, last int64) (FeedValidators, error) {
+	row := dbx.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(MAX(id), 0), COALESCE(MAX(COALESCE(updatedAt, createdAt)), '') FROM feedEntries WHERE feed=? AND sequence BETWEEN ? AND ?`, feedID, first, last)
+	var v FeedValidators
+	err := row.Scan(&v.Count, &v.MaxID, &v.NewestAt)
+	return v, err
+}
+
+func GetEntryByPublicID(ctx context.Context, dbx Reader, feedID int64, pub string) (*FeedEntry, error) {
+	return scanEntry(dbx.QueryRowContext(ctx, `SELECT `+entryColumns+` FROM feedEntries e WHERE e.feed=? AND e.publicId=?`, feedID, pub))
+}
+
+// EntryLink identifies a neighbouring entry for navigation.
+type EntryLink struct {
+	PublicID string
+	Title    string
+}
+
+// GetAdjacentEntries returns the entries received right before and right
+// after entryID in the same feed, or nil at either end.
+func GetAdjacentEntries(ctx context.Context, dbx Reader, feedID, entryID int64) (*EntryLink, *EntryLink, error) {
+	adjacent := func(query string) (*EntryLink, error) {
+		var l EntryLink
+		if err := dbx.QueryRowContext(ctx, query, feedID, entryID).Scan(&l.PublicID, &l.Title); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return &l, nil
+	}
+	prev, err := adjacent(`SELECT publicId, title FROM feedEntries WHERE feed=? AND id < ? ORDER BY id DESC LIMIT 1`)
+	if err != nil {
+		return nil, nil, err
+	}
+	next, err := adjacent(`SELECT publicId, title FROM feedEntries WHERE feed=? AND id > ? ORDER BY id ASC LIMIT 1`)
+	if err != nil {
+		return nil, nil, err
+	}
+	return prev, next, nil
 }
 
 // Enclosures
@@ -117,13 +448,13 @@ func InsertEnclosure(ctx context.Context, tx *sql.Tx, publicId, typ string, leng
 	return res.LastInsertId()
 }
 
-func LinkEnclosure(ctx context.Context, tx *sql.Tx, entryID, enclID int64) error {
-	_, err := tx.ExecContext(ctx, `INSERT INTO feedEntryEnclosureLinks(feedEntry, feedEntryEnclosure) VALUES (?,?)`, entryID, enclID)
+func LinkEnclosure(ctx context.Context, tx *sql.Tx, entryID, enclID int64, inline bool) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO feedEntryEnclosureLinks(feedEntry, feedEntryEnclosure, inline) VALUES (?,?,?)`, entryID, enclID, inline)
 	return err
 }
 
-func GetEnclosuresForEntry(ctx context.Context, dbx *sql.DB, entryID int64) ([]Enclosure, error) {
-	rows, err := dbx.QueryContext(ctx, `SELECT e.publicId, e.type, e.length, e.name, e.id FROM feedEntryEnclosures e JOIN feedEntryEnclosureLinks l ON e.id = l.feedEntryEnclosure WHERE l.feedEntry=?`, entryID)
+func GetEnclosuresForEntry(ctx context.Context, dbx Reader, entryID int64) ([]Enclosure, error) {
+	rows, err := dbx.QueryContext(ctx, `SELECT e.publicId, e.type, e.length, e.name, e.id, l.inline FROM feedEntryEnclosures e JOIN feedEntryEnclosureLinks l ON e.id = l.feedEntryEnclosure WHERE l.feedEntry=?`, entryID)
 	if err != nil {
 		return nil, err
 	}
@@ -131,7 +462,7 @@ func GetEnclosuresForEntry(ctx context.Context, dbx *sql.DB, entryID int64) ([]E
 	var out []Enclosure
 	for rows.Next() {
 		var enc Enclosure
-		if err := rows.Scan(&enc.PublicID, &enc.Type, &enc.Length, &enc.Name, &enc.ID); err != nil {
+		if err := rows.Scan(&enc.PublicID, &enc.Type, &enc.Length, &enc.Name, &enc.ID, &enc.Inline); err != nil {
 			return nil, err
 		}
 		out = append(out, enc)
@@ -140,7 +471,7 @@ func GetEnclosuresForEntry(ctx context.Context, dbx *sql.DB, entryID int64) ([]E
 }
 
 // Visualizations & rate limiting
-func CountRecentVisualizations(ctx context.Context, dbx *sql.DB, feedID int64, since string) (int64, error) {
+func CountRecentVisualizations(ctx context.Context, dbx Reader, feedID int64, since string) (int64, error) {
 	row := dbx.QueryRowContext(ctx, `SELECT COUNT(*) FROM feedVisualizations WHERE feed=? AND ? < createdAt`, feedID, since)
 	var c int64
 	if err := row.Scan(&c); err != nil {
@@ -149,21 +480,24 @@ func CountRecentVisualizations(ctx context.Context, dbx *sql.DB, feedID int64, s
 	return c, nil
 }
 
-func InsertVisualization(ctx context.Context, dbx *sql.DB, feedID int64, createdAt string) error {
+func InsertVisualization(ctx context.Context, dbx Writer, feedID int64, createdAt string) error {
 	_, err := dbx.ExecContext(ctx, `INSERT INTO feedVisualizations(feed, createdAt) VALUES (?,?)`, feedID, createdAt)
 	return err
 }
 
 // WebSub
-func UpsertWebSubSubscription(ctx context.Context, tx *sql.Tx, feedID int64, createdAt, callback string, secret *string) error {
+// UpsertWebSubSubscription records a verified subscription, or renews it;
+// format is the extension of the topic URL the notifications are rendered
+// in, and expiresAt the end of the lease.
+func UpsertWebSubSubscription(ctx context.Context, tx *sql.Tx, feedID int64, createdAt, callback, format string, secret *string, expiresAt string) error {
 	// Try update; if no row, insert
-	res, err := tx.ExecContext(ctx, `UPDATE feedWebSubSubscriptions SET createdAt=?, secret=? WHERE feed=? AND callback=?`, createdAt, secret, feedID, callback)
+	res, err := tx.ExecContext(ctx, `UPDATE feedWebSubSubscriptions SET createdAt=?, secret=?, format=?, expiresAt=? WHERE feed=? AND callback=?`, createdAt, secret, format, expiresAt, feedID, callback)
 	if err != nil {
 		return err
 	}
 	n, _ := res.RowsAffected()
 	if n == 0 {
-		_, err = tx.ExecContext(ctx, `INSERT INTO feedWebSubSubscriptions(feed, createdAt, callback, secret) VALUES (?,?,?,?)`, feedID, createdAt, callback, secret)
+		_, err = tx.ExecContext(ctx, `INSERT INTO feedWebSubSubscriptions(feed, createdAt, callback, secret, format, expiresAt) VALUES (?,?,?,?,?,?)`, feedID, createdAt, callback, secret, format, expiresAt)
 	}
 	return err
 }
@@ -173,7 +507,25 @@ func DeleteWebSubSubscription(ctx context.Context, tx *sql.Tx, id int64) error {
 	return err
 }
 
-func GetWebSubSubscriptionsRecent(ctx context.Context, dbx *sql.DB, feedID int64, since string) ([]struct {
+// DeleteWebSubSubscriptionByCallback ends a feed's subscription to callback,
+// if there is one.
+func DeleteWebSubSubscriptionByCallback(ctx context.Context, tx *sql.Tx, feedID int64, callback string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM feedWebSubSubscriptions WHERE feed=? AND callback=?`, feedID, callback)
+	return err
+}
+
+// GetWebSubSubscriptionExpiresAt returns when a feed's subscription to
+// callback expires, or "" if there is none.
+func GetWebSubSubscriptionExpiresAt(ctx context.Context, dbx Reader, feedID int64, callback string) (string, error) {
+	var expiresAt sql.NullString
+	err := dbx.QueryRowContext(ctx, `SELECT expiresAt FROM feedWebSubSubscriptions WHERE feed=? AND callback=?`, feedID, callback).Scan(&expiresAt)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return expiresAt.String, err
+}
+
+func GetWebSubSubscriptionsRecent(ctx context.Context, dbx Reader, feedID int64, since string) ([]struct {
 	ID       int64
 	Callback string
 	Secret   *string
@@ -204,16 +556,18 @@ func GetWebSubSubscriptionsRecent(ctx context.Context, dbx *sql.DB, feedID int64
 	return out, rows.Err()
 }
 
-func GetWebSubSubscriptionByID(ctx context.Context, dbx *sql.DB, id int64) (*struct {
+func GetWebSubSubscriptionByID(ctx context.Context, dbx Reader, id int64) (*struct {
 	ID       int64
 	Callback string
 	Secret   *string
+	Format   string
 }, error) {
-	row := dbx.QueryRowContext(ctx, `SELECT id, callback, secret FROM feedWebSubSubscriptions WHERE id=?`, id)
+	row := dbx.QueryRowContext(ctx, `SELECT id, callback, secret, format FROM feedWebSubSubscriptions WHERE id=?`, id)
 	var rid int64
 	var cb string
 	var sec *string
-	if err := row.Scan(&rid, &cb, &sec); err != nil {
+	var format string
+	if err := row.Scan(&rid, &cb, &sec, &format); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
@@ -223,55 +577,24 @@ func GetWebSubSubscriptionByID(ctx context.Context, dbx *sql.DB, id int64) (*str
 		ID       int64
 		Callback string
 		Secret   *string
-	}{ID: rid, Callback: cb, Secret: sec}, nil
-}
-
-// Background jobs
-func EnqueueJob(ctx context.Context, dbx *sql.DB, typ, startAt string, params string) error {
-	_, err := dbx.ExecContext(ctx, `INSERT INTO backgroundJobs(type, startAt, parameters, status) VALUES (?,?,?, 'pending')`, typ, startAt, params)
-	return err
-}
-
-func EnqueueJobTx(ctx context.Context, tx *sql.Tx, typ, startAt string, params string) error {
-	_, err := tx.ExecContext(ctx, `INSERT INTO backgroundJobs(type, startAt, parameters, status) VALUES (?,?,?, 'pending')`, typ, startAt, params)
-	return err
-}
-
-func DequeueJob(ctx context.Context, tx *sql.Tx, typ string, now string) (int64, string, error) {
-	// Simple FIFO: pick the earliest pending job of given type whose startAt <= now and mark as running
-	row := tx.QueryRowContext(ctx, `SELECT id, parameters FROM backgroundJobs WHERE type=? AND status='pending' AND startAt <= ? ORDER BY id ASC LIMIT 1`, typ, now)
-	var id int64
-	var params string
-	if err := row.Scan(&id, &params); err != nil {
-		return 0, "", err
-	}
-	if _, err := tx.ExecContext(ctx, `UPDATE backgroundJobs SET status='running' WHERE id=?`, id); err != nil {
-		return 0, "", err
-	}
-	return id, params, nil
-}
-
-func FinishJob(ctx context.Context, tx *sql.Tx, id int64, ok bool) error {
-	status := "done"
-	if !ok {
-		status = "failed"
-	}
-	_, err := tx.ExecContext(ctx, `UPDATE backgroundJobs SET status=? WHERE id=?`, status, id)
-	return err
+		Format   string
+	}{ID: rid, Callback: cb, Secret: sec, Format: format}, nil
 }
 
 // Cleanup helpers
-func DeleteOldVisualizations(ctx context.Context, dbx *sql.DB, olderThan string) error {
+func DeleteOldVisualizations(ctx context.Context, dbx Writer, olderThan string) error {
 	_, err := dbx.ExecContext(ctx, `DELETE FROM feedVisualizations WHERE createdAt < ?`, olderThan)
 	return err
 }
 
-func DeleteOldWebSubs(ctx context.Context, dbx *sql.DB, olderThan string) error {
-	_, err := dbx.ExecContext(ctx, `DELETE FROM feedWebSubSubscriptions WHERE createdAt < ?`, olderThan)
+// DeleteExpiredWebSubs deletes the subscriptions whose lease ended before
+// now, which subscribers didn't renew.
+func DeleteExpiredWebSubs(ctx context.Context, dbx Writer, now string) error {
+	_, err := dbx.ExecContext(ctx, `DELETE FROM feedWebSubSubscriptions WHERE expiresAt IS NULL OR expiresAt < ?`, now)
 	return err
 }
 
-func GetOrphanEnclosures(ctx context.Context, dbx *sql.DB) ([]struct {
+func GetOrphanEnclosures(ctx context.Context, dbx Reader) ([]struct {
 	ID       int64
 	PublicID string
 }, error) {
@@ -298,7 +621,7 @@ func GetOrphanEnclosures(ctx context.Context, dbx *sql.DB) ([]struct {
 	return out, rows.Err()
 }
 
-func DeleteEnclosureByID(ctx context.Context, dbx *sql.DB, id int64) error {
+func DeleteEnclosureByID(ctx context.Context, dbx Writer, id int64) error {
 	_, err := dbx.ExecContext(ctx, `DELETE FROM feedEntryEnclosures WHERE id=?`, id)
 	return err
 }
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Webhook is an endpoint that a feed's new entries are POSTed to.
+type Webhook struct {
+	ID        int64
+	PublicID  string
+	FeedID    int64
+	CreatedAt string
+	URL       string
+	// Secret signs the deliveries, so the endpoint can tell they are ours.
+	Secret string
+}
+
+const webhookColumns = `id, publicId, feed, createdAt, url, secret`
+
+func scanWebhook(s scanner) (*Webhook, error) {
+	var h Webhook
+	if err := s.Scan(&h.ID, &h.PublicID, &h.FeedID, &h.CreatedAt, &h.URL, &h.Secret); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &h, nil
+}
+
+func scanWebhooks(rows *sql.Rows, err error) ([]Webhook, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Webhook
+	for rows.Next() {
+		h, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *h)
+	}
+	return out, rows.Err()
+}
+
+func InsertWebhook(ctx context.Context, tx *sql.Tx, publicID string, feedID int64, createdAt, url, secret string) (int64, error) {
+	res, err := tx.ExecContext(ctx, `INSERT INTO feedWebhooks(publicId, feed, createdAt, url, secret) VALUES (?,?,?,?,?)`, publicID, feedID, createdAt, url, secret)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// DeleteWebhook deletes a webhook and its delivery log. Deliveries still
+// queued find it gone and give up.
+func DeleteWebhook(ctx context.Context, tx *sql.Tx, id int64) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM feedWebhooks WHERE id=?`, id)
+	return err
+}
+
+func GetWebhookByID(ctx context.Context, dbx Reader, id int64) (*Webhook, error) {
+	return scanWebhook(dbx.QueryRowContext(ctx, `SELECT `+webhookColumns+` FROM feedWebhooks WHERE id=?`, id))
+}
+
+func GetWebhookByPublicID(ctx context.Context, dbx Reader, feedID int64, publicID string) (*Webhook, error) {
+	return scanWebhook(dbx.QueryRowContext(ctx, `SELECT `+webhookColumns+` FROM feedWebhooks WHERE feed=? AND publicId=?`, feedID, publicID))
+}
+
+// GetFeedWebhooks returns a feed's webhooks, oldest first.
+func GetFeedWebhooks(ctx context.Context, dbx Reader, feedID int64) ([]Webhook, error) {
+	return scanWebhooks(dbx.QueryContext(ctx, `SELECT `+webhookColumns+` FROM feedWebhooks WHERE feed=? ORDER BY id`, feedID))
+}
+
+func GetFeedWebhooksTx(ctx context.Context, tx *sql.Tx, feedID int64) ([]Webhook, error) {
+	return scanWebhooks(tx.QueryContext(ctx, `SELECT `+webhookColumns+` FROM feedWebhooks WHERE feed=? ORDER BY id`, feedID))
+}
+
+func CountFeedWebhooks(ctx context.Context, tx *sql.Tx, feedID int64) (int, error) {
+	var n int
+	err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM feedWebhooks WHERE feed=?`, feedID).Scan(&n)
+	return n, err
+}
+
+// WebhookDelivery is an attempt to deliver an entry to a webhook.
+type WebhookDelivery struct {
+	ID            int64
+	CreatedAt     string
+	Event         string
+	EntryPublicID string
+	// Attempt counts the attempts to deliver the entry, from 1.
+	Attempt int
+	// Status is the response status, unless the request failed with Error.
+	Status               sql.NullInt64
+	Error                sql.NullString
+	DurationMilliseconds int64
+}
+
+// webhookDeliveriesKept is how many of the latest deliveries of each
+// webhook are kept.
+const webhookDeliveriesKept = 50
+
+// InsertWebhookDelivery records a delivery attempt, and forgets the oldest
+// ones past webhookDeliveriesKept.
+func InsertWebhookDelivery(ctx context.Context, tx *sql.Tx, webhookID int64, d WebhookDelivery) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO feedWebhookDeliveries(webhook, createdAt, event, entryPublicId, attempt, status, error, durationMilliseconds) VALUES (?,?,?,?,?,?,?,?)`,
+		webhookID, d.CreatedAt, d.Event, d.EntryPublicID, d.Attempt, d.Status, d.Error, d.DurationMilliseconds)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM feedWebhookDeliveries WHERE webhook=? AND id NOT IN (SELECT id FROM feedWebhookDeliveries WHERE webhook=? ORDER BY id DESC LIMIT ?)`, webhookID, webhookID, webhookDeliveriesKept)
+	return err
+}
+
+// GetWebhookDeliveries returns a webhook's latest deliveries, newest first.
+func GetWebhookDeliveries(ctx context.Context, dbx Reader, webhookID int64, limit int) ([]WebhookDelivery, error) {
+	rows, err := dbx.QueryContext(ctx, `SELECT id, createdAt, event, entryPublicId, attempt, status, error, durationMilliseconds FROM feedWebhookDeliveries WHERE webhook=? ORDER BY id DESC LIMIT ?`, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.CreatedAt, &d.Event, &d.EntryPublicID, &d.Attempt, &d.Status, &d.Error, &d.DurationMilliseconds); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,56 @@
+// Package events announces changes to feeds' entries within a process, so
+// that their live streams send them right away.
+//
+// Announcements carry no data: the changes themselves are in the feedEvents
+// table, which streams read after each announcement. Changes made by other
+// processes aren't announced here; streams poll the table for those.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// MaxAge is how long the feedEvents table keeps events, for clients resuming
+// a stream with Last-Event-ID.
+const MaxAge = time.Hour
+
+var (
+	mu          sync.Mutex
+	subscribers = map[int64]map[chan struct{}]struct{}{}
+)
+
+// Subscribe returns a channel that receives a value after changes to a feed
+// are announced, and a function that stops it. Announcements made while a
+// value is pending are merged into it.
+func Subscribe(feedID int64) (<-chan struct{}, func()) {
+	c := make(chan struct{}, 1)
+	mu.Lock()
+	if subscribers[feedID] == nil {
+		subscribers[feedID] = map[chan struct{}]struct{}{}
+	}
+	subscribers[feedID][c] = struct{}{}
+	mu.Unlock()
+	return c, func() {
+		mu.Lock()
+		delete(subscribers[feedID], c)
+		if len(subscribers[feedID]) == 0 {
+			delete(subscribers, feedID)
+		}
+		mu.Unlock()
+	}
+}
+
+// Publish announces that a feed's entries changed. Call it after the
+// transaction that changed them commits, so that subscribers find the
+// changes.
+func Publish(feedID int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	for c := range subscribers[feedID] {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Package feed is the format-neutral model of a feed document. It is built
+// from the database once and rendered by the Atom, RSS and JSON Feed
+// serializers.
+package feed
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+	"github.com/jtsang4/kill-the-newsletter/internal/util"
+)
+
+// Format identifies a feed serialization by its URL extension.
+type Format string
+
+const (
+	FormatAtom Format = "xml"
+	FormatRSS  Format = "rss"
+	FormatJSON Format = "json"
+)
+
+// ParseFormat returns the format served at /feeds/<token>.<ext>.
+func ParseFormat(ext string) (Format, bool) {
+	switch f := Format(ext); f {
+	case FormatAtom, FormatRSS, FormatJSON:
+		return f, true
+	}
+	return "", false
+}
+
+func (f Format) ContentType() string {
+	switch f {
+	case FormatRSS:
+		return "application/rss+xml; charset=utf-8"
+	case FormatJSON:
+		return "application/feed+json; charset=utf-8"
+	}
+	return "application/atom+xml; charset=utf-8"
+}
+
+type Feed struct {
+	// ID is a stable identifier that doesn't change with the feed's secrets.
+	ID    string
+	Title string
+	Icon  *string
+	// BaseURL is the root of the instance, against which relative URLs in
+	// entries are resolved.
+	BaseURL string
+	// UpdatedAt is when the feed's metadata last changed, or "".
+	UpdatedAt string
+	// URL is the feed document URL without the format extension.
+	URL string
+	// HubURL is empty for documents that can't be subscribed to with WebSub.
+	HubURL string
+	// Query is the full-text search the document is restricted to, if any.
+	Query string
+	// Paging links the document to the others of the feed (RFC 5005).
+	Paging Paging
+}
+
+// Paging holds the RFC 5005 links of a feed document. The subscription
+// document has the newest entries and archive documents have the older ones
+// in fixed pages by sequence number. Empty URLs are omitted.
+type Paging struct {
+	// Page is the number of an archive document, or 0 for the subscription
+	// document. Archives don't change once complete, except for entries being
+	// updated or removed.
+	Page int64
+	// Current is the subscription document, which is also the first page.
+	Current string
+	// PrevArchive is the next older archive, which is also the next page;
+	// NextArchive is the next newer archive.
+	PrevArchive string
+	NextArchive string
+}
+
+// SelfURL returns the URL of the document in the given format, which is an
+// archive URL for archive documents.
+func (f Feed) SelfURL(format Format) string {
+	if f.Paging.Page > 0 {
+		return f.ArchiveURL(format, f.Paging.Page)
+	}
+	return f.DocumentURL(format)
+}
+
+// ArchiveURL returns the URL of an archive document of the feed.
+func (f Feed) ArchiveURL(format Format, page int64) string {
+	return fmt.Sprintf("%s/archives/%d.%s", f.URL, page, format)
+}
+
+// DocumentURL returns the URL of the feed rendered in the given format.
+func (f Feed) DocumentURL(format Format) string {
+	u := f.URL + "." + string(format)
+	if f.Query != "" {
+		u += "?q=" + url.QueryEscape(f.Query)
+	}
+	return u
+}
+
+// WithQuery returns the model of a saved search over the feed, which is a
+// feed of its own with a distinct id and title.
+func (f Feed) WithQuery(q string) Feed {
+	f.ID += "?q=" + url.QueryEscape(q)
+	f.Title = fmt.Sprintf("%s: %s", f.Title, q)
+	f.HubURL = ""
+	f.Query = q
+	return f
+}
+
+type Entry struct {
+	ID  string
+	URL string
+	// CreatedAt is when the message was received. PublishedAt is the date the
+	// sender gave it, or CreatedAt if that wasn't plausible.
+	CreatedAt   string
+	PublishedAt string
+	// UpdatedAt is when the entry last changed; it equals CreatedAt unless a
+	// later message replaced the entry.
+	UpdatedAt string
+	// Author is the sender's display name and AuthorEmail their address.
+	Author      *string
+	AuthorEmail *string
+	Title       string
+	Content     string
+	// Summary is the beginning of the content's text.
+	Summary    string
+	Enclosures []Enclosure
+}
+
+type Enclosure struct {
+	URL    string
+	Type   string
+	Length int64
+	Name   string
+}
+
+// FromDB builds the model for a feed; the user-chosen icon takes precedence
+// over the one derived from the sender's domain.
+func FromDB(hostname string, f *db.Feed) Feed {
+	var icon *string
+	if f.Icon.Valid {
+		icon = &f.Icon.String
+	} else if f.EmailIcon.Valid {
+		icon = &f.EmailIcon.String
+	}
+	return Feed{
+		ID:        fmt.Sprintf("urn:kill-the-newsletter:%s", f.PublicID),
+		Title:     f.Title,
+		Icon:      icon,
+		BaseURL:   fmt.Sprintf("https://%s/", hostname),
+		UpdatedAt: f.UpdatedAt.String,
+		URL:       fmt.Sprintf("https://%s/feeds/%s", hostname, f.ReadToken),
+		HubURL:    fmt.Sprintf("https://%s/feeds/%s/websub", hostname, f.ReadToken),
+	}
+}
+
+// EntriesFromDB builds the model for entries of f, loading their enclosures
+// except for the inline images their content references.
+func EntriesFromDB(ctx context.Context, dbx db.Reader, hostname string, f *db.Feed, entries []db.FeedEntry) ([]Entry, error) {
+	out := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		encls, err := db.GetEnclosuresForEntry(ctx, dbx, e.ID)
+		if err != nil {
+			return nil, err
+		}
+		var arr []Enclosure
+		for _, x := range encls {
+			if x.Inline {
+				// shown in place in the content
+				continue
+			}
+			arr = append(arr, Enclosure{URL: fmt.Sprintf("https://%s/files/%s/%s", hostname, x.PublicID, x.Name), Type: x.Type, Length: x.Length, Name: x.Name})
+		}
+		var author *string
+		if e.Author.Valid {
+			author = &e.Author.String
+		}
+		var authorEmail *string
+		if e.AuthorEmail.Valid {
+			authorEmail = &e.AuthorEmail.String
+		}
+		publishedAt := e.CreatedAt
+		if e.PublishedAt.Valid {
+			publishedAt = e.PublishedAt.String
+		}
+		updatedAt := e.CreatedAt
+		if e.UpdatedAt.Valid {
+			updatedAt = e.UpdatedAt.String
+		}
+		out = append(out, Entry{
+			ID:          fmt.Sprintf("urn:kill-the-newsletter:%s", e.PublicID),
+			URL:         fmt.Sprintf("https://%s/feeds/%s/entries/%s.html", hostname, f.ReadToken, e.PublicID),
+			CreatedAt:   e.CreatedAt,
+			PublishedAt: publishedAt,
+			UpdatedAt:   updatedAt,
+			Author:      author,
+			AuthorEmail: authorEmail,
+			Title:       e.Title,
+			Content:     e.Content,
+			Summary:     summarize(e.Content),
+			Enclosures:  arr,
+		})
+	}
+	return out, nil
+}
+
+// summaryLength is the maximum length of summaries, in characters.
+const summaryLength = 300
+
+func summarize(content string) string {
+	text := []rune(util.HTMLToText(content))
+	if len(text) <= summaryLength {
+		return string(text)
+	}
+	return strings.TrimSpace(string(text[:summaryLength-1])) + "…"
+}
+
+// LastUpdated returns the newest UpdatedAt of entries, or "" if there are none.
+func LastUpdated(entries []Entry) string {
+	var last string
+	for _, e := range entries {
+		last = Latest(last, e.UpdatedAt)
+	}
+	return last
+}
+
+// Latest returns the latest of RFC 3339 timestamps, ignoring invalid ones.
+func Latest(timestamps ...string) string {
+	var latest string
+	var latestT time.Time
+	for _, ts := range timestamps {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil && (latest == "" || t.After(latestT)) {
+			latest, latestT = ts, t
+		}
+	}
+	return latest
+}
@@ -0,0 +1,189 @@
+// Package feedcache keeps rendered feed documents on disk so that polls of
+// unchanged feeds are served without querying and rendering their entries.
+//
+// Documents are stored per feed in generations. Invalidating a feed starts a
+// new generation, and a document is only served from the generation that was
+// current before the data it was rendered from was read. A document rendered
+// from data that changed meanwhile is therefore never served, even when the
+// change was made by another process sharing the data directory.
+package feedcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/util"
+)
+
+// Cache stores documents under a directory, by feed read token and key.
+type Cache struct {
+	dir string
+}
+
+// New returns the cache under the data directory.
+func New(dataDir string) *Cache {
+	return &Cache{dir: filepath.Join(dataDir, "cache", "feeds")}
+}
+
+// Document is a rendered feed document with its validators.
+type Document struct {
+	Body         []byte
+	ETag         string
+	LastModified time.Time
+}
+
+var nameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.-]*$`)
+
+const generationFile = "generation"
+
+// Generation returns the current generation of a feed's documents, starting
+// one if there is none. Read it before the data that a document is rendered
+// from and pass it to Put.
+func (c *Cache) Generation(feed string) (string, error) {
+	if !nameRe.MatchString(feed) {
+		return "", errors.New("invalid feed")
+	}
+	b, err := os.ReadFile(filepath.Join(c.dir, feed, generationFile))
+	if err == nil {
+		return string(b), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	return c.newGeneration(feed)
+}
+
+// Get returns a document of the current generation of a feed.
+func (c *Cache) Get(feed, key string) (*Document, bool) {
+	if !nameRe.MatchString(feed) || !nameRe.MatchString(key) {
+		return nil, false
+	}
+	generation, err := os.ReadFile(filepath.Join(c.dir, feed, generationFile))
+	if err != nil {
+		return nil, false
+	}
+	b, err := os.ReadFile(filepath.Join(c.dir, feed, string(generation), key))
+	if err != nil {
+		return nil, false
+	}
+	// The ETag and Last-Modified lines precede the body.
+	r := bufio.NewReader(bytes.NewReader(b))
+	etag, err1 := r.ReadString('\n')
+	lastModified, err2 := r.ReadString('\n')
+	if err1 != nil || err2 != nil {
+		return nil, false
+	}
+	doc := &Document{ETag: strings.TrimSuffix(etag, "\n")}
+	doc.LastModified, _ = time.Parse(time.RFC3339Nano, strings.TrimSuffix(lastModified, "\n"))
+	doc.Body = b[len(etag)+len(lastModified):]
+	return doc, true
+}
+
+// Put stores a document rendered after generation was read. It is dropped if
+// the feed was invalidated in the meantime.
+func (c *Cache) Put(feed, generation, key string, doc Document) error {
+	if !nameRe.MatchString(feed) || !nameRe.MatchString(key) || !nameRe.MatchString(generation) {
+		return errors.New("invalid feed, generation or key")
+	}
+	dir := filepath.Join(c.dir, feed, generation)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	var lastModified string
+	if !doc.LastModified.IsZero() {
+		lastModified = doc.LastModified.UTC().Format(time.RFC3339Nano)
+	}
+	var b bytes.Buffer
+	b.WriteString(doc.ETag + "\n" + lastModified + "\n")
+	b.Write(doc.Body)
+	if err := writeFile(filepath.Join(dir, key), b.Bytes()); err != nil {
+		return err
+	}
+	if current, err := os.ReadFile(filepath.Join(c.dir, feed, generationFile)); err != nil || string(current) != generation {
+		return os.RemoveAll(dir)
+	}
+	return nil
+}
+
+// Invalidate discards a feed's documents. Call it after committing a change
+// to the feed or its entries.
+func (c *Cache) Invalidate(feed string) error {
+	if !nameRe.MatchString(feed) {
+		return errors.New("invalid feed")
+	}
+	if _, err := os.Stat(filepath.Join(c.dir, feed)); errors.Is(err, fs.ErrNotExist) {
+		// Nothing was rendered since the last time the cache was cleared.
+		return nil
+	}
+	generation, err := c.newGeneration(feed)
+	if err != nil {
+		return err
+	}
+	old, err := os.ReadDir(filepath.Join(c.dir, feed))
+	if err != nil {
+		return err
+	}
+	for _, e := range old {
+		if e.IsDir() && e.Name() != generation {
+			if err := os.RemoveAll(filepath.Join(c.dir, feed, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Remove discards a feed's documents for good, when the feed is deleted.
+func (c *Cache) Remove(feed string) error {
+	if !nameRe.MatchString(feed) {
+		return errors.New("invalid feed")
+	}
+	return os.RemoveAll(filepath.Join(c.dir, feed))
+}
+
+// Clear discards all documents. It is called on startup, because documents
+// depend on the renderers and on entry content that migrations may change.
+func (c *Cache) Clear() error {
+	return os.RemoveAll(c.dir)
+}
+
+func (c *Cache) newGeneration(feed string) (string, error) {
+	generation, err := util.RandID(16)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Join(c.dir, feed), 0o755); err != nil {
+		return "", err
+	}
+	return generation, writeFile(filepath.Join(c.dir, feed, generationFile), []byte(generation))
+}
+
+// writeFile replaces a file atomically, so that readers see either the old
+// or the new contents.
+func writeFile(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,425 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+)
+
+var apiFeedsRe = regexp.MustCompile(`^/api/v1/feeds$`)
+var apiFeedRe = regexp.MustCompile(`^/api/v1/feeds/([A-Za-z0-9]+)$`)
+var apiEntriesRe = regexp.MustCompile(`^/api/v1/feeds/([A-Za-z0-9]+)/entries$`)
+var apiEntryRe = regexp.MustCompile(`^/api/v1/feeds/([A-Za-z0-9]+)/entries/([A-Za-z0-9]+)$`)
+var apiEnclosuresRe = regexp.MustCompile(`^/api/v1/feeds/([A-Za-z0-9]+)/entries/([A-Za-z0-9]+)/enclosures$`)
+
+const (
+	apiDefaultPageSize = 50
+	apiMaxPageSize     = 200
+)
+
+type apiFeed struct {
+	ID          string  `json:"id"`
+	Title       string  `json:"title"`
+	Icon        *string `json:"icon"`
+	Email       string  `json:"email"`
+	FeedURL     string  `json:"feedUrl"`
+	SettingsURL string  `json:"settingsUrl"`
+	// PrivacyCleaning removes tracking from new and existing entries.
+	PrivacyCleaning bool `json:"privacyCleaning"`
+}
+
+type apiEntry struct {
+	ID          string  `json:"id"`
+	CreatedAt   string  `json:"createdAt"`
+	PublishedAt *string `json:"publishedAt"`
+	UpdatedAt   *string `json:"updatedAt"`
+	Author      *string `json:"author"`
+	AuthorEmail *string `json:"authorEmail"`
+	Title       string  `json:"title"`
+	Content     string  `json:"content"`
+	URL         string  `json:"url"`
+}
+
+type apiEnclosure struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Length int64  `json:"length"`
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Inline bool   `json:"inline"`
+}
+
+type apiError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// HashAPIToken returns the value stored in apiTokens.tokenHash for a bearer token.
+func HashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticateAPI(w, r) {
+		return
+	}
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if apiFeedsRe.MatchString(path) {
+		s.handleAPIFeeds(w, r)
+		return
+	}
+	if m := apiFeedRe.FindStringSubmatch(path); m != nil {
+		s.handleAPIFeed(w, r, m[1])
+		return
+	}
+	if m := apiEntriesRe.FindStringSubmatch(path); m != nil {
+		s.handleAPIEntries(w, r, m[1])
+		return
+	}
+	if m := apiEntryRe.FindStringSubmatch(path); m != nil {
+		s.handleAPIEntry(w, r, m[1], m[2])
+		return
+	}
+	if m := apiEnclosuresRe.FindStringSubmatch(path); m != nil {
+		s.handleAPIEnclosures(w, r, m[1], m[2])
+		return
+	}
+	if m := apiWebhooksRe.FindStringSubmatch(path); m != nil {
+		s.handleAPIWebhooks(w, r, m[1])
+		return
+	}
+	if m := apiWebhookRe.FindStringSubmatch(path); m != nil {
+		s.handleAPIWebhook(w, r, m[1], m[2])
+		return
+	}
+	if m := apiWebhookDeliveriesRe.FindStringSubmatch(path); m != nil {
+		s.handleAPIWebhookDeliveries(w, r, m[1], m[2])
+		return
+	}
+	s.apiError(w, http.StatusNotFound, "not_found", "endpoint not found")
+}
+
+func (s *Server) authenticateAPI(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	token = strings.TrimSpace(token)
+	if !ok || token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+		s.apiError(w, http.StatusUnauthorized, "unauthorized", "missing bearer token")
+		return false
+	}
+	t, err := db.GetAPITokenByHash(r.Context(), s.db.Read, HashAPIToken(token))
+	if err != nil {
+		s.apiServerError(w, err)
+		return false
+	}
+	if t == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+		s.apiError(w, http.StatusUnauthorized, "unauthorized", "invalid bearer token")
+		return false
+	}
+	_ = db.TouchAPIToken(r.Context(), s.db.Write, t.ID, time.Now().UTC().Format(time.RFC3339Nano))
+	return true
+}
+
+func (s *Server) handleAPIFeeds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.apiMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	feeds, err := db.ListFeeds(r.Context(), s.db.Read)
+	if err != nil {
+		s.apiServerError(w, err)
+		return
+	}
+	out := make([]apiFeed, 0, len(feeds))
+	for i := range feeds {
+		out = append(out, s.apiFeedOf(&feeds[i]))
+	}
+	s.apiJSON(w, http.StatusOK, map[string]any{"feeds": out})
+}
+
+func (s *Server) handleAPIFeed(w http.ResponseWriter, r *http.Request, pub string) {
+	ctx := r.Context()
+	f, ok := s.apiLoadFeed(w, r, pub)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.apiJSON(w, http.StatusOK, s.apiFeedOf(f))
+	case http.MethodPatch:
+		// Fields that are absent keep their current value; "icon": null clears the icon.
+		var body map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			s.apiError(w, http.StatusBadRequest, "invalid_body", "request body must be a JSON object")
+			return
+		}
+		title := f.Title
+		if raw, ok := body["title"]; ok {
+			if err := json.Unmarshal(raw, &title); err != nil {
+				s.apiError(w, http.StatusBadRequest, "invalid_title", "title must be a string")
+				return
+			}
+		}
+		var icon string
+		if f.Icon.Valid {
+			icon = f.Icon.String
+		}
+		if raw, ok := body["icon"]; ok {
+			var v *string
+			if err := json.Unmarshal(raw, &v); err != nil {
+				s.apiError(w, http.StatusBadRequest, "invalid_icon", "icon must be a string or null")
+				return
+			}
+			icon = ""
+			if v != nil {
+				icon = *v
+			}
+		}
+		privacyCleaning := f.PrivacyCleaning
+		if raw, ok := body["privacyCleaning"]; ok {
+			if err := json.Unmarshal(raw, &privacyCleaning); err != nil {
+				s.apiError(w, http.StatusBadRequest, "invalid_privacy_cleaning", "privacyCleaning must be a boolean")
+				return
+			}
+		}
+		title, iconPtr, problem := parseFeedSettings(title, icon)
+		if problem != "" {
+			s.apiError(w, http.StatusBadRequest, strings.ReplaceAll(problem, " ", "_"), problem)
+			return
+		}
+		err := s.db.Tx(ctx, func(tx *db.Tx) error {
+			if err := db.UpdateFeed(ctx, tx, f.ID, title, iconPtr); err != nil {
+				return err
+			}
+			return db.UpdateFeedPrivacyCleaning(ctx, tx, f.ID, privacyCleaning)
+		})
+		if err != nil {
+			s.apiServerError(w, err)
+			return
+		}
+		s.invalidateFeed(f)
+		f, err := db.GetFeedByID(ctx, s.db.Read, f.ID)
+		if err != nil {
+			s.apiServerError(w, err)
+			return
+		}
+		if f == nil {
+			// Deleted since it was updated.
+			s.apiError(w, http.StatusNotFound, "not_found", db.ErrNotFound("feed").Error())
+			return
+		}
+		s.apiJSON(w, http.StatusOK, s.apiFeedOf(f))
+	case http.MethodDelete:
+		if err := s.db.Tx(ctx, func(tx *db.Tx) error { return db.DeleteFeed(ctx, tx, f.ID) }); err != nil {
+			s.apiServerError(w, err)
+			return
+		}
+		s.removeFeedCache(f)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.apiMethodNotAllowed(w, http.MethodGet, http.MethodPatch, http.MethodDelete)
+	}
+}
+
+func (s *Server) handleAPIEntries(w http.ResponseWriter, r *http.Request, pub string) {
+	if r.Method != http.MethodGet {
+		s.apiMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	f, ok := s.apiLoadFeed(w, r, pub)
+	if !ok {
+		return
+	}
+	limit := apiDefaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > apiMaxPageSize {
+			s.apiError(w, http.StatusBadRequest, "invalid_limit", fmt.Sprintf("limit must be between 1 and %d", apiMaxPageSize))
+			return
+		}
+		limit = n
+	}
+	// Entries are newest first; "before" is the id of the last entry of the previous page.
+	var beforeID int64
+	if before := r.URL.Query().Get("before"); before != "" {
+		e, err := db.GetEntryByPublicID(r.Context(), s.db.Read, f.ID, before)
+		if err != nil {
+			s.apiServerError(w, err)
+			return
+		}
+		if e == nil {
+			s.apiError(w, http.StatusBadRequest, "invalid_cursor", "before must be the id of an entry in this feed")
+			return
+		}
+		beforeID = e.ID
+	}
+	// Fetch one extra entry to know whether there is a next page.
+	page, err := db.GetFeedEntriesDescPage(r.Context(), s.db.Read, f.ID, beforeID, limit+1)
+	if err != nil {
+		s.apiServerError(w, err)
+		return
+	}
+	var next *string
+	if len(page) > limit {
+		page = page[:limit]
+		next = &page[limit-1].PublicID
+	}
+	out := make([]apiEntry, 0, len(page))
+	for i := range page {
+		out = append(out, s.apiEntryOf(f, &page[i].FeedEntry))
+	}
+	s.apiJSON(w, http.StatusOK, map[string]any{"entries": out, "nextBefore": next})
+}
+
+func (s *Server) handleAPIEntry(w http.ResponseWriter, r *http.Request, pub, entryPub string) {
+	ctx := r.Context()
+	f, e, ok := s.apiLoadEntry(w, r, pub, entryPub)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.apiJSON(w, http.StatusOK, s.apiEntryOf(f, e))
+	case http.MethodDelete:
+		if err := s.deleteEntry(ctx, f, e.ID); err != nil {
+			s.apiServerError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.apiMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+func (s *Server) handleAPIEnclosures(w http.ResponseWriter, r *http.Request, pub, entryPub string) {
+	if r.Method != http.MethodGet {
+		s.apiMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	_, e, ok := s.apiLoadEntry(w, r, pub, entryPub)
+	if !ok {
+		return
+	}
+	encls, err := db.GetEnclosuresForEntry(r.Context(), s.db.Read, e.ID)
+	if err != nil {
+		s.apiServerError(w, err)
+		return
+	}
+	out := make([]apiEnclosure, 0, len(encls))
+	for _, x := range encls {
+		out = append(out, apiEnclosure{
+			ID:     x.PublicID,
+			Type:   x.Type,
+			Length: x.Length,
+			Name:   x.Name,
+			URL:    fmt.Sprintf("https://%s/files/%s/%s", s.cfg.Hostname, x.PublicID, x.Name),
+			Inline: x.Inline,
+		})
+	}
+	s.apiJSON(w, http.StatusOK, map[string]any{"enclosures": out})
+}
+
+func (s *Server) apiLoadFeed(w http.ResponseWriter, r *http.Request, pub string) (*db.Feed, bool) {
+	f, err := db.GetFeedByPublicID(r.Context(), s.db.Read, pub)
+	if err != nil {
+		s.apiServerError(w, err)
+		return nil, false
+	}
+	if f == nil {
+		s.apiError(w, http.StatusNotFound, "not_found", db.ErrNotFound("feed").Error())
+		return nil, false
+	}
+	return f, true
+}
+
+func (s *Server) apiLoadEntry(w http.ResponseWriter, r *http.Request, pub, entryPub string) (*db.Feed, *db.FeedEntry, bool) {
+	f, ok := s.apiLoadFeed(w, r, pub)
+	if !ok {
+		return nil, nil, false
+	}
+	e, err := db.GetEntryByPublicID(r.Context(), s.db.Read, f.ID, entryPub)
+	if err != nil {
+		s.apiServerError(w, err)
+		return nil, nil, false
+	}
+	if e == nil {
+		s.apiError(w, http.StatusNotFound, "not_found", db.ErrNotFound("entry").Error())
+		return nil, nil, false
+	}
+	return f, e, true
+}
+
+func (s *Server) apiFeedOf(f *db.Feed) apiFeed {
+	return apiFeed{
+		ID:              f.PublicID,
+		Title:           f.Title,
+		Icon:            nullString(f.Icon),
+		Email:           fmt.Sprintf("%s@%s", f.EmailID, s.cfg.Hostname),
+		FeedURL:         fmt.Sprintf("https://%s/feeds/%s.xml", s.cfg.Hostname, f.ReadToken),
+		SettingsURL:     fmt.Sprintf("https://%s/feeds/%s", s.cfg.Hostname, f.ManageToken),
+		PrivacyCleaning: f.PrivacyCleaning,
+	}
+}
+
+func (s *Server) apiEntryOf(f *db.Feed, e *db.FeedEntry) apiEntry {
+	return apiEntry{
+		ID:          e.PublicID,
+		CreatedAt:   e.CreatedAt,
+		PublishedAt: nullString(e.PublishedAt),
+		UpdatedAt:   nullString(e.UpdatedAt),
+		Author:      nullString(e.Author),
+		AuthorEmail: nullString(e.AuthorEmail),
+		Title:       e.Title,
+		Content:     e.Content,
+		URL:         fmt.Sprintf("https://%s/feeds/%s/entries/%s.html", s.cfg.Hostname, f.ReadToken, e.PublicID),
+	}
+}
+
+func (s *Server) apiJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) apiError(w http.ResponseWriter, status int, code, msg string) {
+	var e apiError
+	e.Error.Code = code
+	e.Error.Message = msg
+	s.apiJSON(w, status, e)
+}
+
+func (s *Server) apiServerError(w http.ResponseWriter, err error) {
+	log.Println("api error:", err)
+	if db.IsBusy(err) {
+		w.Header().Set("Retry-After", busyRetryAfter)
+		s.apiError(w, http.StatusServiceUnavailable, "busy", "database busy, try again later")
+		return
+	}
+	s.apiError(w, http.StatusInternalServerError, "internal", "internal server error")
+}
+
+func (s *Server) apiMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	s.apiError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+}
+
+func nullString(v sql.NullString) *string {
+	if !v.Valid {
+		return nil
+	}
+	return &v.String
+}
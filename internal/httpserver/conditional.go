@@ -0,0 +1,61 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+	"github.com/jtsang4/kill-the-newsletter/internal/feed"
+)
+
+// feedCacheControl lets readers and proxies reuse a feed document for a few
+// minutes and revalidate it with ETag / Last-Modified afterwards.
+const feedCacheControl = "private, max-age=300"
+
+// feedValidators derives the ETag and Last-Modified of a feed document from
+// its newest entry and metadata, without rendering it. variant identifies the
+// document among those of the feed in the same format.
+func feedValidators(f *db.Feed, format feed.Format, variant string, v db.FeedValidators) (string, time.Time) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%d\x00%d\x00%s",
+		format, variant, f.Title, f.Icon.String, f.EmailIcon.String, f.UpdatedAt.String, v.Count, v.MaxID, v.NewestAt)
+	etag := `"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+	var lastModified time.Time
+	for _, ts := range []string{v.NewestAt, f.UpdatedAt.String} {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil && t.After(lastModified) {
+			lastModified = t
+		}
+	}
+	return etag, lastModified
+}
+
+// notModified reports whether the request's preconditions match the current
+// validators. If-None-Match takes precedence over If-Modified-Since (RFC 9110).
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !lastModified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+func setValidatorHeaders(w http.ResponseWriter, etag string, lastModified time.Time) {
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Cache-Control", feedCacheControl)
+}
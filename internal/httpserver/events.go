@@ -0,0 +1,149 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+	"github.com/jtsang4/kill-the-newsletter/internal/events"
+)
+
+var feedEventsRe = regexp.MustCompile(`^/feeds/([A-Za-z0-9]+)/events$`)
+
+const (
+	// eventsPollInterval is how often streams read new events that weren't
+	// announced, such as those of mail received or retention applied by
+	// another process.
+	eventsPollInterval = 2 * time.Second
+	// eventsHeartbeatInterval is how often streams send a comment, so that
+	// proxies don't close them while they're idle.
+	eventsHeartbeatInterval = 30 * time.Second
+	// eventsBatchSize bounds the events read at a time.
+	eventsBatchSize = 100
+	// eventsRetryMilliseconds is how long clients wait to reconnect.
+	eventsRetryMilliseconds = 3000
+)
+
+// feedEventData is the data of a stream event. The title and URL are only
+// sent for created entries that still exist.
+type feedEventData struct {
+	EntryID   string `json:"entryId"`
+	CreatedAt string `json:"createdAt"`
+	Title     string `json:"title,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// handleFeedEvents streams the entries created in and deleted from a feed as
+// Server-Sent Events. Clients that reconnect with Last-Event-ID get the events
+// they missed; others start with the next event.
+func (s *Server) handleFeedEvents(w http.ResponseWriter, r *http.Request, readToken string) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := db.GetFeedByReadToken(ctx, s.db.Read, readToken)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if f == nil {
+		s.notFound(w, r)
+		return
+	}
+	// Subscribe before reading the last event, so that no event falls in
+	// between.
+	announced, cancel := events.Subscribe(f.ID)
+	defer cancel()
+	last, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	if err != nil || last < 0 {
+		last, err = db.GetLastFeedEventID(ctx, s.db.Read, f.ID)
+		if err != nil {
+			s.serverError(w, r, err)
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	// Streams outlive the server's write timeout, if it has one.
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", eventsRetryMilliseconds); err != nil {
+		return
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	// Announcements wake the stream right away, but only for changes made
+	// in this process; polling picks up the others.
+	poll := time.NewTicker(eventsPollInterval)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(eventsHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		if last, err = s.writeFeedEvents(ctx, w, f, last); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-announced:
+		case <-poll.C:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		// The stream ends with its feed, after the events of its deletion.
+		exists, err := db.GetFeedByID(ctx, s.db.Read, f.ID)
+		if err != nil {
+			return
+		}
+		if exists == nil {
+			_, _ = s.writeFeedEvents(ctx, w, f, last)
+			return
+		}
+	}
+}
+
+// writeFeedEvents writes a feed's events after last, and returns the id of
+// the last one written.
+func (s *Server) writeFeedEvents(ctx context.Context, w http.ResponseWriter, f *db.Feed, last int64) (int64, error) {
+	for {
+		evs, err := db.GetFeedEventsAfter(ctx, s.db.Read, f.ID, last, eventsBatchSize)
+		if err != nil {
+			return last, err
+		}
+		for _, ev := range evs {
+			data := feedEventData{EntryID: ev.EntryPublicID, CreatedAt: ev.CreatedAt}
+			if ev.Type == "entry-created" && ev.EntryTitle.Valid {
+				data.Title = ev.EntryTitle.String
+				data.URL = fmt.Sprintf("https://%s/feeds/%s/entries/%s.html", s.cfg.Hostname, f.ReadToken, ev.EntryPublicID)
+			}
+			b, err := json.Marshal(data)
+			if err != nil {
+				return last, err
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, b); err != nil {
+				return last, err
+			}
+			last = ev.ID
+		}
+		if len(evs) < eventsBatchSize {
+			return last, nil
+		}
+	}
+}
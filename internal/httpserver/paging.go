@@ -0,0 +1,91 @@
+package httpserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/config"
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+	"github.com/jtsang4/kill-the-newsletter/internal/feed"
+)
+
+// Atom feeds are paged and archived as in RFC 5005. The subscription document
+// has the newest entries. Archive page n has the entries numbered
+// (n-1)*pageSize+1 to n*pageSize, so it only exists once all of them have
+// been received, and it stays the same as new entries arrive. Retention may
+// empty the oldest archives, which then no longer exist.
+
+func (s *Server) feedPageSize() int64 {
+	if s.cfg.FeedPageSize > 0 {
+		return int64(s.cfg.FeedPageSize)
+	}
+	return config.DefaultFeedPageSize
+}
+
+// archiveRange returns the oldest and newest archive pages of f, which has no
+// archives if oldest > newest.
+func (s *Server) archiveRange(ctx context.Context, f *db.Feed) (oldest, newest int64, err error) {
+	first, err := db.GetFeedFirstSequence(ctx, s.db.Read, f.ID)
+	if err != nil || first == 0 {
+		return 1, 0, err
+	}
+	size := s.feedPageSize()
+	return (first-1)/size + 1, f.LastEntrySequence / size, nil
+}
+
+// subscriptionDocument loads the newest entries of f, linking to the newest
+// archive if there are older entries.
+func (s *Server) subscriptionDocument(ctx context.Context, f *db.Feed, model feed.Feed) (feed.Feed, []db.FeedEntry, error) {
+	size := s.feedPageSize()
+	entries, err := db.GetFeedEntriesNewest(ctx, s.db.Read, f.ID, int(size))
+	if err != nil {
+		return model, nil, err
+	}
+	oldest, newest, err := s.archiveRange(ctx, f)
+	if err != nil {
+		return model, nil, err
+	}
+	model.Paging.Current = model.DocumentURL(feed.FormatAtom)
+	if int64(len(entries)) == size && oldest <= newest {
+		model.Paging.PrevArchive = model.ArchiveURL(feed.FormatAtom, newest)
+	}
+	return model, entries, nil
+}
+
+func (s *Server) handleFeedArchive(w http.ResponseWriter, r *http.Request, readToken string, page int64) {
+	ctx := r.Context()
+	s.serveFeedDocument(w, r, readToken, feed.FormatAtom, fmt.Sprintf("archive-%d.xml", page), func(f *db.Feed) (*feedDocument, error) {
+		oldest, newest, err := s.archiveRange(ctx, f)
+		if err != nil || page < oldest || page > newest {
+			return nil, err
+		}
+		size := s.feedPageSize()
+		first, last := (page-1)*size+1, page*size
+		return &feedDocument{
+			// The archive only changes with its entries, except that it gains a
+			// link to the next archive once that is complete.
+			variant: fmt.Sprintf("archive=%d,%d,%t", size, page, page < newest),
+			validators: func() (db.FeedValidators, error) {
+				return db.GetFeedValidatorsInSequence(ctx, s.db.Read, f.ID, first, last)
+			},
+			load: func() (feed.Feed, []db.FeedEntry, error) {
+				entries, err := db.GetFeedEntriesInSequence(ctx, s.db.Read, f.ID, first, last)
+				if err != nil {
+					return feed.Feed{}, nil, err
+				}
+				model := feed.FromDB(s.cfg.Hostname, f)
+				// Archives don't change, so there is nothing to subscribe to.
+				model.HubURL = ""
+				model.Paging = feed.Paging{Page: page, Current: model.DocumentURL(feed.FormatAtom)}
+				if page > oldest {
+					model.Paging.PrevArchive = model.ArchiveURL(feed.FormatAtom, page-1)
+				}
+				if page < newest {
+					model.Paging.NextArchive = model.ArchiveURL(feed.FormatAtom, page+1)
+				}
+				return model, entries, nil
+			},
+		}, nil
+	})
+}
@@ -0,0 +1,74 @@
+package httpserver
+
+import (
+	"database/sql"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/config"
+)
+
+// retentionForm holds the retention fields of the feed settings form as
+// displayed; empty fields use the instance default.
+type retentionForm struct {
+	MaxKilobytes string
+	MaxEntries   string
+	MaxAgeDays   string
+}
+
+func retentionFormOf(maxBytes, maxEntries, maxAgeDays sql.NullInt64) retentionForm {
+	var out retentionForm
+	if maxBytes.Valid {
+		out.MaxKilobytes = strconv.FormatInt(maxBytes.Int64/1024, 10)
+	}
+	if maxEntries.Valid {
+		out.MaxEntries = strconv.FormatInt(maxEntries.Int64, 10)
+	}
+	if maxAgeDays.Valid {
+		out.MaxAgeDays = strconv.FormatInt(maxAgeDays.Int64, 10)
+	}
+	return out
+}
+
+// retentionDefaultsOf describes the instance defaults for the form placeholders.
+func retentionDefaultsOf(r config.Retention) retentionForm {
+	show := func(n int64) string {
+		if n == 0 {
+			return "Default: no limit"
+		}
+		return "Default: " + strconv.FormatInt(n, 10)
+	}
+	return retentionForm{MaxKilobytes: show(r.MaxBytes / 1024), MaxEntries: show(r.MaxEntries), MaxAgeDays: show(r.MaxAgeDays)}
+}
+
+// parseRetentionForm reads the retention fields of the feed settings form and
+// returns a validation message if they are invalid.
+func parseRetentionForm(form url.Values) (maxBytes, maxEntries, maxAgeDays *int64, problem string) {
+	parse := func(name string) (*int64, bool) {
+		v := strings.TrimSpace(form.Get(name))
+		if v == "" {
+			return nil, true
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 || n > 1<<40 {
+			return nil, false
+		}
+		return &n, true
+	}
+	kb, ok := parse("retentionMaxKilobytes")
+	if !ok {
+		return nil, nil, nil, "invalid retention size"
+	}
+	if kb != nil {
+		b := *kb * 1024
+		maxBytes = &b
+	}
+	if maxEntries, ok = parse("retentionMaxEntries"); !ok {
+		return nil, nil, nil, "invalid retention entries"
+	}
+	if maxAgeDays, ok = parse("retentionMaxAgeDays"); !ok {
+		return nil, nil, nil, "invalid retention age"
+	}
+	return maxBytes, maxEntries, maxAgeDays, ""
+}
@@ -1,6 +1,7 @@
 package httpserver
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -9,14 +10,22 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/jtsang4/kill-the-newsletter/internal/atom"
 	"github.com/jtsang4/kill-the-newsletter/internal/config"
 	"github.com/jtsang4/kill-the-newsletter/internal/db"
+	"github.com/jtsang4/kill-the-newsletter/internal/events"
+	"github.com/jtsang4/kill-the-newsletter/internal/feed"
+	"github.com/jtsang4/kill-the-newsletter/internal/feedcache"
+	"github.com/jtsang4/kill-the-newsletter/internal/outbound"
+	"github.com/jtsang4/kill-the-newsletter/internal/privacy"
+	"github.com/jtsang4/kill-the-newsletter/internal/render"
+	"github.com/jtsang4/kill-the-newsletter/internal/retention"
 	"github.com/jtsang4/kill-the-newsletter/internal/util"
 )
 
@@ -25,13 +34,15 @@ type Server struct {
 	db        *db.DB
 	mux       *http.ServeMux
 	templates *template.Template
+	cache     *feedcache.Cache
+	outbound  *outbound.Client
 }
 
 type Option func(*Server)
 
 func New(cfg config.Config, dbx *db.DB, opts ...Option) *Server {
-	s := &Server{cfg: cfg, db: dbx, mux: http.NewServeMux()}
-	t := template.New("")
+	s := &Server{cfg: cfg, db: dbx, mux: http.NewServeMux(), cache: feedcache.New(cfg.DataDirectory), outbound: outbound.New(cfg)}
+	t := template.New("").Funcs(templateFuncs)
 	t = template.Must(t.ParseFS(templatesFS, "*.html"))
 	s.templates = t
 	s.routes()
@@ -42,6 +53,7 @@ func (s *Server) routes() {
 	s.mux.HandleFunc("/", s.handleHome)
 	s.mux.HandleFunc("/feeds", s.handleFeeds)
 	s.mux.HandleFunc("/feeds/", s.handleFeedsSub)
+	s.mux.HandleFunc("/api/v1/", s.handleAPI)
 	// static passthrough for icons
 	s.mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, filepath.Join("static", "favicon.ico"))
@@ -84,21 +96,25 @@ func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		err := s.db.Tx(ctx, func(tx *db.Tx) error {
 			pid, _ := util.RandID(20)
-			_, err := db.CreateFeed(ctx, tx, pid, title)
+			emailID, _ := util.RandID(20)
+			readToken, _ := util.RandID(20)
+			manageToken, _ := util.RandID(20)
+			_, err := db.CreateFeed(ctx, tx, pid, emailID, readToken, manageToken, title)
 			if err != nil {
 				return err
 			}
 			if strings.Contains(r.Header.Get("Accept"), "application/json") {
 				resp := map[string]string{
-					"feedId": pid,
-					"email":  fmt.Sprintf("%s@%s", pid, s.cfg.Hostname),
-					"feed":   fmt.Sprintf("https://%s/feeds/%s.xml", s.cfg.Hostname, pid),
+					"feedId":   pid,
+					"email":    fmt.Sprintf("%s@%s", emailID, s.cfg.Hostname),
+					"feed":     fmt.Sprintf("https://%s/feeds/%s.xml", s.cfg.Hostname, readToken),
+					"settings": fmt.Sprintf("https://%s/feeds/%s", s.cfg.Hostname, manageToken),
 				}
 				w.Header().Set("Content-Type", "application/json")
 				_ = json.NewEncoder(w).Encode(resp)
 				return nil
 			}
-			http.Redirect(w, r, "/feeds/"+pid, http.StatusFound)
+			http.Redirect(w, r, "/feeds/"+manageToken, http.StatusFound)
 			return nil
 		})
 		if err != nil {
@@ -110,10 +126,18 @@ func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// searchResultsLimit bounds the entries of a search results page or feed.
+const searchResultsLimit = 100
+
 var feedIDRe = regexp.MustCompile(`^/feeds/([A-Za-z0-9]+)$`)
-var feedXMLRe = regexp.MustCompile(`^/feeds/([A-Za-z0-9]+)\.xml$`)
+var feedXMLRe = regexp.MustCompile(`^/feeds/([A-Za-z0-9]+)\.(xml|rss|json)$`)
+var feedArchiveRe = regexp.MustCompile(`^/feeds/([A-Za-z0-9]+)/archives/([1-9][0-9]{0,17})\.xml$`)
 var feedEntryHTMLRe = regexp.MustCompile(`^/feeds/([A-Za-z0-9]+)/entries/([A-Za-z0-9]+)\.html$`)
 var feedWebSubRe = regexp.MustCompile(`^/feeds/([A-Za-z0-9]+)/websub$`)
+var feedEntryManageRe = regexp.MustCompile(`^/feeds/([A-Za-z0-9]+)/entries/([A-Za-z0-9]+)$`)
+
+// feedPageEntries is the number of entries per page on the feed settings page.
+const feedPageEntries = 20
 
 func (s *Server) handleFeeds(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/feeds" {
@@ -134,7 +158,13 @@ func (s *Server) handleFeedsSub(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if m := feedXMLRe.FindStringSubmatch(r.URL.Path); m != nil {
-		s.handleFeedXML(w, r, m[1])
+		format, _ := feed.ParseFormat(m[2])
+		s.handleFeedXML(w, r, m[1], format)
+		return
+	}
+	if m := feedArchiveRe.FindStringSubmatch(r.URL.Path); m != nil {
+		page, _ := strconv.ParseInt(m[2], 10, 64)
+		s.handleFeedArchive(w, r, m[1], page)
 		return
 	}
 	if m := feedEntryHTMLRe.FindStringSubmatch(r.URL.Path); m != nil {
@@ -145,46 +175,122 @@ func (s *Server) handleFeedsSub(w http.ResponseWriter, r *http.Request) {
 		s.handleWebSub(w, r, m[1])
 		return
 	}
+	if m := feedEntryManageRe.FindStringSubmatch(r.URL.Path); m != nil {
+		s.handleFeedEntryManage(w, r, m[1], m[2])
+		return
+	}
+	if m := feedEventsRe.FindStringSubmatch(r.URL.Path); m != nil {
+		s.handleFeedEvents(w, r, m[1])
+		return
+	}
+	if m := feedWebhooksRe.FindStringSubmatch(r.URL.Path); m != nil {
+		s.handleFeedWebhooks(w, r, m[1])
+		return
+	}
+	if m := feedWebhookRe.FindStringSubmatch(r.URL.Path); m != nil {
+		s.handleFeedWebhook(w, r, m[1], m[2])
+		return
+	}
 	s.notFound(w, r)
 }
 
-func (s *Server) handleFeedPage(w http.ResponseWriter, r *http.Request, pub string) {
+func (s *Server) handleFeedPage(w http.ResponseWriter, r *http.Request, manageToken string) {
 	ctx := r.Context()
-	f, err := db.GetFeedByPublicID(ctx, s.db.SQL, pub)
+	f, err := db.GetFeedByManageToken(ctx, s.db.Read, manageToken)
 	if err != nil {
 		s.serverError(w, r, err)
 		return
 	}
 	if f == nil {
+		s.notFound(w, r)
 		return
 	}
 	switch r.Method {
 	case http.MethodGet:
-		s.render(w, "feed.html", map[string]any{"Feed": f, "Hostname": s.cfg.Hostname})
-	case http.MethodPatch:
-		if err := r.ParseForm(); err != nil {
+		data := map[string]any{
+			"Feed":              f,
+			"Hostname":          s.cfg.Hostname,
+			"Retention":         retentionFormOf(f.RetentionMaxBytes, f.RetentionMaxEntries, f.RetentionMaxAgeDays),
+			"RetentionDefaults": retentionDefaultsOf(s.cfg.Retention),
+		}
+		// Entries are listed newest first, paginated by the id of the last entry shown.
+		var beforeID int64
+		if before := r.URL.Query().Get("before"); before != "" {
+			e, err := db.GetEntryByPublicID(ctx, s.db.Read, f.ID, before)
+			if err != nil {
+				s.serverError(w, r, err)
+				return
+			}
+			if e != nil {
+				beforeID = e.ID
+				data["Paginated"] = true
+			}
+		}
+		entries, err := db.GetFeedEntriesDescPage(ctx, s.db.Read, f.ID, beforeID, feedPageEntries+1)
+		if err != nil {
 			s.serverError(w, r, err)
 			return
 		}
-		title := strings.TrimSpace(r.Form.Get("title"))
-		icon := strings.TrimSpace(r.Form.Get("icon"))
-		if title == "" || len(title) > 200 {
-			s.validationError(w, r, "invalid title")
+		if len(entries) > feedPageEntries {
+			entries = entries[:feedPageEntries]
+			data["NextBefore"] = entries[feedPageEntries-1].PublicID
+		}
+		data["Entries"] = entries
+		webhooks, err := s.feedWebhookViews(ctx, f)
+		if err != nil {
+			s.serverError(w, r, err)
 			return
 		}
-		var iconPtr *string
-		if icon != "" {
-			if len(icon) > 200 {
-				s.validationError(w, r, "invalid icon")
+		data["Webhooks"] = webhooks
+		if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+			results, err := db.SearchEntries(ctx, s.db.Read, f.ID, q, searchResultsLimit)
+			if err != nil {
+				s.serverError(w, r, err)
 				return
 			}
-			iconPtr = &icon
+			data["Query"] = q
+			data["Results"] = results
+			data["SearchFeedURL"] = feed.FromDB(s.cfg.Hostname, f).WithQuery(q).DocumentURL(feed.FormatAtom)
+		}
+		s.render(w, "feed.html", data)
+	case http.MethodPatch:
+		if err := r.ParseForm(); err != nil {
+			s.serverError(w, r, err)
+			return
+		}
+		title, iconPtr, problem := parseFeedSettings(r.Form.Get("title"), r.Form.Get("icon"))
+		if problem != "" {
+			s.validationError(w, r, problem)
+			return
 		}
-		err := s.db.Tx(ctx, func(tx *db.Tx) error { return db.UpdateFeed(ctx, tx, f.ID, title, iconPtr) })
+		maxBytes, maxEntries, maxAgeDays, problem := parseRetentionForm(r.Form)
+		if problem != "" {
+			s.validationError(w, r, problem)
+			return
+		}
+		err := s.db.Tx(ctx, func(tx *db.Tx) error {
+			if err := db.UpdateFeed(ctx, tx, f.ID, title, iconPtr); err != nil {
+				return err
+			}
+			if err := db.UpdateFeedRetention(ctx, tx, f.ID, maxBytes, maxEntries, maxAgeDays); err != nil {
+				return err
+			}
+			if err := db.UpdateFeedPrivacyCleaning(ctx, tx, f.ID, r.Form.Get("privacyCleaning") != ""); err != nil {
+				return err
+			}
+			// Apply tightened limits right away instead of on the next email.
+			updated, err := db.GetFeedByIDTx(ctx, tx, f.ID)
+			if err != nil {
+				return err
+			}
+			_, err = retention.Apply(ctx, tx, f.ID, retention.For(s.cfg.Retention, updated), time.Now())
+			return err
+		})
 		if err != nil {
 			s.serverError(w, r, err)
 			return
 		}
+		s.invalidateFeed(f)
 		http.Redirect(w, r, r.URL.Path, http.StatusFound)
 	case http.MethodDelete:
 		err := s.db.Tx(ctx, func(tx *db.Tx) error { return db.DeleteFeed(ctx, tx, f.ID) })
@@ -192,26 +298,183 @@ func (s *Server) handleFeedPage(w http.ResponseWriter, r *http.Request, pub stri
 			s.serverError(w, r, err)
 			return
 		}
+		s.removeFeedCache(f)
 		http.Redirect(w, r, "/", http.StatusFound)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
-func (s *Server) handleFeedXML(w http.ResponseWriter, r *http.Request, pub string) {
+// handleFeedEntryManage deletes an entry from the feed settings page; it is
+// keyed by the manage token, unlike the entry page.
+func (s *Server) handleFeedEntryManage(w http.ResponseWriter, r *http.Request, manageToken, entryPub string) {
 	ctx := r.Context()
-	f, err := db.GetFeedByPublicID(ctx, s.db.SQL, pub)
+	f, err := db.GetFeedByManageToken(ctx, s.db.Read, manageToken)
 	if err != nil {
 		s.serverError(w, r, err)
 		return
 	}
 	if f == nil {
+		s.notFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	e, err := db.GetEntryByPublicID(ctx, s.db.Read, f.ID, entryPub)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if e == nil {
+		s.notFound(w, r)
 		return
 	}
+	if err := s.deleteEntry(ctx, f, e.ID); err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/feeds/"+f.ManageToken, http.StatusFound)
+}
+
+// deleteEntry removes an entry and marks its feed as changed. Enclosure
+// files are removed by the cleanup loop once they are no longer linked.
+func (s *Server) deleteEntry(ctx context.Context, f *db.Feed, entryID int64) error {
+	err := s.db.Tx(ctx, func(tx *db.Tx) error {
+		if err := db.DeleteEnclosureLinksByEntry(ctx, tx, entryID); err != nil {
+			return err
+		}
+		if err := db.DeleteEntryByID(ctx, tx, entryID); err != nil {
+			return err
+		}
+		return db.TouchFeed(ctx, tx, f.ID)
+	})
+	if err == nil {
+		s.invalidateFeed(f)
+	}
+	return err
+}
+
+// parseFeedSettings validates the user-editable feed settings and returns a
+// validation message if they are invalid. An empty icon clears it.
+func parseFeedSettings(title, icon string) (string, *string, string) {
+	title = strings.TrimSpace(title)
+	icon = strings.TrimSpace(icon)
+	if title == "" || len(title) > 200 {
+		return "", nil, "invalid title"
+	}
+	if icon == "" {
+		return title, nil, ""
+	}
+	if len(icon) > 200 {
+		return "", nil, "invalid icon"
+	}
+	return title, &icon, ""
+}
+
+func (s *Server) handleFeedXML(w http.ResponseWriter, r *http.Request, readToken string, format feed.Format) {
+	ctx := r.Context()
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	// Saved searches aren't cached, as any query can be asked for.
+	cacheKey := string(format)
+	if query != "" {
+		cacheKey = ""
+	}
+	s.serveFeedDocument(w, r, readToken, format, cacheKey, func(f *db.Feed) (*feedDocument, error) {
+		return &feedDocument{
+			variant: "q=" + query,
+			validators: func() (db.FeedValidators, error) {
+				return db.GetFeedValidators(ctx, s.db.Read, f.ID)
+			},
+			load: func() (feed.Feed, []db.FeedEntry, error) {
+				model := feed.FromDB(s.cfg.Hostname, f)
+				if query != "" {
+					// A saved search is a feed of its own, restricted to matching entries.
+					entries, err := db.SearchEntries(ctx, s.db.Read, f.ID, query, searchResultsLimit)
+					return model.WithQuery(query), entries, err
+				}
+				if format != feed.FormatAtom {
+					entries, err := db.GetFeedEntriesDesc(ctx, s.db.Read, f.ID)
+					return model, entries, err
+				}
+				return s.subscriptionDocument(ctx, f, model)
+			},
+		}, nil
+	})
+}
+
+// feedDocument describes how to validate and render a feed document.
+type feedDocument struct {
+	// variant distinguishes the documents of a feed in a format, like saved
+	// searches and archives.
+	variant    string
+	validators func() (db.FeedValidators, error)
+	load       func() (feed.Feed, []db.FeedEntry, error)
+}
+
+// serveFeedDocument serves a feed document from the cache under cacheKey, or
+// renders the one that document describes, which is nil if there is none.
+// Documents with an empty cacheKey aren't cached.
+func (s *Server) serveFeedDocument(w http.ResponseWriter, r *http.Request, readToken string, format feed.Format, cacheKey string, document func(f *db.Feed) (*feedDocument, error)) {
+	ctx := r.Context()
+	// The generation is read before the feed so that a document rendered
+	// from data that changes meanwhile isn't cached.
+	var generation string
+	if cacheKey != "" {
+		var err error
+		if generation, err = s.cache.Generation(readToken); err != nil {
+			log.Printf("feed cache: %v", err)
+		}
+	}
+	f, err := db.GetFeedByReadToken(ctx, s.db.Read, readToken)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if f == nil {
+		s.notFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var d *feedDocument
+	var cached *feedcache.Document
+	var ok bool
+	if generation != "" {
+		cached, ok = s.cache.Get(readToken, cacheKey)
+	}
+	if !ok {
+		cached = &feedcache.Document{}
+		if d, err = document(f); err != nil {
+			s.serverError(w, r, err)
+			return
+		}
+		if d == nil {
+			s.notFound(w, r)
+			return
+		}
+		validators, err := d.validators()
+		if err != nil {
+			s.serverError(w, r, err)
+			return
+		}
+		cached.ETag, cached.LastModified = feedValidators(f, format, d.variant, validators)
+	}
 	w.Header().Set("X-Robots-Tag", "none")
+	// Answer unchanged polls before rate limiting so that 304s don't count as visualizations.
+	setValidatorHeaders(w, cached.ETag, cached.LastModified)
+	if notModified(r, cached.ETag, cached.LastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 	// rate limit: 1000 visualizations/hour
 	since := time.Now().Add(-1 * time.Hour).UTC().Format(time.RFC3339Nano)
-	count, err := db.CountRecentVisualizations(ctx, s.db.SQL, f.ID, since)
+	count, err := db.CountRecentVisualizations(ctx, s.db.Read, f.ID, since)
 	if err != nil {
 		s.serverError(w, r, err)
 		return
@@ -221,69 +484,124 @@ func (s *Server) handleFeedXML(w http.ResponseWriter, r *http.Request, pub strin
 		s.render(w, "rate_limit.html", nil)
 		return
 	}
-	_ = db.InsertVisualization(ctx, s.db.SQL, f.ID, time.Now().UTC().Format(time.RFC3339Nano))
-	entries, err := db.GetFeedEntriesDesc(ctx, s.db.SQL, f.ID)
-	if err != nil {
-		s.serverError(w, r, err)
-		return
-	}
-	var items []atom.Entry
-	for _, e := range entries {
-		encls, err := db.GetEnclosuresForEntry(ctx, s.db.SQL, e.ID)
+	_ = db.InsertVisualization(ctx, s.db.Write, f.ID, time.Now().UTC().Format(time.RFC3339Nano))
+	if !ok {
+		model, entries, err := d.load()
 		if err != nil {
 			s.serverError(w, r, err)
 			return
 		}
-		var arr []atom.Enclosure
-		for _, x := range encls {
-			arr = append(arr, atom.Enclosure{PublicID: x.PublicID, Type: x.Type, Length: x.Length, Name: x.Name})
+		items, err := feed.EntriesFromDB(ctx, s.db.Read, s.cfg.Hostname, f, entries)
+		if err != nil {
+			s.serverError(w, r, err)
+			return
+		}
+		body, err := render.Feed(format, model, items)
+		if err != nil {
+			s.serverError(w, r, err)
+			return
 		}
-		var author *string
-		if e.Author.Valid {
-			author = &e.Author.String
+		cached.Body = []byte(body)
+		if generation != "" {
+			if err := s.cache.Put(readToken, generation, cacheKey, *cached); err != nil {
+				log.Printf("feed cache: %v", err)
+			}
 		}
-		items = append(items, atom.Entry{ID: e.ID, PublicID: e.PublicID, CreatedAt: e.CreatedAt, Author: author, Title: e.Title, Content: e.Content, Enclosures: arr})
 	}
-	var icon *string
-	if f.Icon.Valid {
-		icon = &f.Icon.String
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(cached.Body)))
+	if r.Method == http.MethodHead {
+		return
 	}
-	var emailIcon *string
-	if f.EmailIcon.Valid {
-		emailIcon = &f.EmailIcon.String
+	_, _ = w.Write(cached.Body)
+}
+
+// invalidateFeed discards the cached documents of a feed after a change to
+// it or its entries was committed, and wakes its live streams.
+func (s *Server) invalidateFeed(f *db.Feed) {
+	if err := s.cache.Invalidate(f.ReadToken); err != nil {
+		log.Printf("feed cache: %v", err)
 	}
-	xmlStr, err := atom.BuildFeedXML(s.cfg.Hostname, atom.Feed{PublicID: f.PublicID, Title: f.Title, Icon: icon, EmailIcon: emailIcon}, items)
-	if err != nil {
-		s.serverError(w, r, err)
-		return
+	events.Publish(f.ID)
+}
+
+func (s *Server) removeFeedCache(f *db.Feed) {
+	if err := s.cache.Remove(f.ReadToken); err != nil {
+		log.Printf("feed cache: %v", err)
 	}
-	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
-	_, _ = w.Write([]byte(xmlStr))
+	events.Publish(f.ID)
 }
 
-func (s *Server) handleFeedEntryHTML(w http.ResponseWriter, r *http.Request, pub, entryPub string) {
+// entryCSP applies to the entry page and, through inheritance, to the email
+// in its sandboxed iframe: remote images and inline styles are allowed, but
+// the email can't run scripts, submit forms or load other frames.
+const entryCSP = "default-src 'self'; script-src 'self' 'unsafe-inline' https://cdn.tailwindcss.com; style-src 'self' 'unsafe-inline'; img-src * data:; frame-src 'self'; object-src 'none'; form-action 'none'; frame-ancestors 'none'"
+
+func (s *Server) handleFeedEntryHTML(w http.ResponseWriter, r *http.Request, readToken, entryPub string) {
 	ctx := r.Context()
-	f, err := db.GetFeedByPublicID(ctx, s.db.SQL, pub)
-	if err != nil || f == nil {
+	f, err := db.GetFeedByReadToken(ctx, s.db.Read, readToken)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if f == nil {
+		s.notFound(w, r)
+		return
+	}
+	e, err := db.GetEntryByPublicID(ctx, s.db.Read, f.ID, entryPub)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if e == nil {
+		s.notFound(w, r)
 		return
 	}
-	e, err := db.GetEntryByPublicID(ctx, s.db.SQL, f.ID, entryPub)
-	if err != nil || e == nil {
+	enclosures, err := db.GetEnclosuresForEntry(ctx, s.db.Read, e.ID)
+	if err != nil {
+		s.serverError(w, r, err)
 		return
 	}
-	w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src *; style-src 'self' 'unsafe-inline'; frame-src 'none'; object-src 'none'; form-action 'self'; frame-ancestors 'none'")
+	// Inline images are shown in place in the email.
+	var attachments []db.Enclosure
+	for _, x := range enclosures {
+		if !x.Inline {
+			attachments = append(attachments, x)
+		}
+	}
+	prev, next, err := db.GetAdjacentEntries(ctx, s.db.Read, f.ID, e.ID)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Security-Policy", entryCSP)
 	w.Header().Set("Cross-Origin-Embedder-Policy", "unsafe-none")
-	_, _ = w.Write([]byte(e.Content))
+	w.Header().Set("X-Robots-Tag", "none")
+	s.render(w, "entry.html", map[string]any{
+		"Feed":        f,
+		"Entry":       e,
+		"Attachments": attachments,
+		"Privacy":     privacy.ParseReport(e.PrivacyReport.String),
+		"Prev":        prev,
+		"Next":        next,
+		// Links in the email open outside of the sandbox.
+		"Body": `<base target="_blank">` + e.Content,
+	})
 }
 
-func (s *Server) handleWebSub(w http.ResponseWriter, r *http.Request, pub string) {
+func (s *Server) handleWebSub(w http.ResponseWriter, r *http.Request, readToken string) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 	ctx := r.Context()
-	f, err := db.GetFeedByPublicID(ctx, s.db.SQL, pub)
-	if err != nil || f == nil {
+	f, err := db.GetFeedByReadToken(ctx, s.db.Read, readToken)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if f == nil {
+		s.notFound(w, r)
 		return
 	}
 	if err := r.ParseForm(); err != nil {
@@ -304,7 +622,9 @@ func (s *Server) handleWebSub(w http.ResponseWriter, r *http.Request, pub string
 		s.validationError(w, r, "invalid mode")
 		return
 	}
-	if topic != fmt.Sprintf("https://%s/feeds/%s.xml", s.cfg.Hostname, f.PublicID) {
+	// Subscribers may follow the feed in any format; notifications are sent in the topic's format.
+	model := feed.FromDB(s.cfg.Hostname, f)
+	if topic != model.DocumentURL(feed.FormatAtom) && topic != model.DocumentURL(feed.FormatRSS) && topic != model.DocumentURL(feed.FormatJSON) {
 		s.validationError(w, r, "invalid topic")
 		return
 	}
@@ -316,27 +636,39 @@ func (s *Server) handleWebSub(w http.ResponseWriter, r *http.Request, pub string
 		s.validationError(w, r, "invalid callback")
 		return
 	}
-	if host := hostOf(callback); host == s.cfg.Hostname || host == "localhost" || host == "127.0.0.1" {
+	// Callbacks on internal networks are refused again when connecting, as
+	// host names may resolve to them.
+	if s.pointsHere(callback) || s.outbound.CheckURL(callback) != nil {
 		s.validationError(w, r, "invalid callback host")
 		return
 	}
-	if secret != "" && len(secret) == 0 {
+	// WebSub requires secrets shorter than 200 bytes.
+	if len(secret) >= 200 {
 		s.validationError(w, r, "invalid secret")
 		return
 	}
-	// naive daily limit: ensure <= 10 different callbacks in last 24h (done at verify time in original, here we enforce on enqueue)
-	since := time.Now().Add(-24 * time.Hour).UTC().Format(time.RFC3339Nano)
-	subs, err := db.GetWebSubSubscriptionsRecent(ctx, s.db.SQL, f.ID, since)
-	if err == nil && mode == "subscribe" && uniqueCallbacks(subs) > 10 && !containsCallback(subs, callback) {
-		s.validationError(w, r, "rate limited")
-		return
+	var lease int
+	if v := r.Form.Get("hub.lease_seconds"); v != "" {
+		if lease, err = strconv.Atoi(v); err != nil || lease <= 0 {
+			s.validationError(w, r, "invalid lease_seconds")
+			return
+		}
 	}
 	var secretPtr *string
-	if strings.TrimSpace(secret) != "" {
+	if secret != "" {
 		secretPtr = &secret
 	}
-	params, _ := json.Marshal(map[string]any{"feedId": f.ID, "hub.mode": mode, "hub.topic": topic, "hub.callback": callback, "hub.secret": secretPtr})
-	_ = db.EnqueueJob(ctx, s.db.SQL, "feedWebSubSubscriptions.verify", time.Now().UTC().Format(time.RFC3339Nano), string(params))
+	job := map[string]any{"feedId": f.ID, "hub.mode": mode, "hub.topic": topic, "hub.callback": callback, "hub.secret": secretPtr, "hub.lease_seconds": lease}
+	// naive daily limit: ensure <= 10 different callbacks in last 24h (done at verify time in original, here we enforce on enqueue)
+	since := time.Now().Add(-24 * time.Hour).UTC().Format(time.RFC3339Nano)
+	subs, err := db.GetWebSubSubscriptionsRecent(ctx, s.db.Read, f.ID, since)
+	if err == nil && mode == "subscribe" && uniqueCallbacks(subs) > 10 && !containsCallback(subs, callback) {
+		// The request is valid but the hub won't honor it, which it tells
+		// the subscriber instead of verifying the request.
+		job["hub.mode"], job["hub.reason"] = "denied", "Too many subscriptions to this feed."
+	}
+	params, _ := json.Marshal(job)
+	_ = db.EnqueueJob(ctx, s.db.Write, "feedWebSubSubscriptions.verify", time.Now().UTC().Format(time.RFC3339Nano), string(params))
 	w.WriteHeader(http.StatusAccepted)
 }
 
@@ -353,25 +685,31 @@ func (s *Server) validationError(w http.ResponseWriter, _ *http.Request, msg str
 
 func (s *Server) serverError(w http.ResponseWriter, _ *http.Request, err error) {
 	log.Println("server error:", err)
+	if db.IsBusy(err) {
+		w.Header().Set("Retry-After", busyRetryAfter)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
 	s.render(w, "error.html", nil)
 }
 
+// busyRetryAfter is the Retry-After of responses to requests that failed
+// because the database stayed locked.
+const busyRetryAfter = "5"
+
 func (s *Server) notFound(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 	s.render(w, "not_found.html", nil)
 }
 
-func hostOf(u string) string {
-	i := strings.Index(u, "://")
-	if i == -1 {
-		return ""
-	}
-	rest := u[i+3:]
-	j := strings.IndexAny(rest, "/?")
-	if j == -1 {
-		return rest
+// pointsHere reports whether a URL is on this instance's host name, whatever
+// its case, port or userinfo, so that callbacks and webhooks don't point
+// back at it.
+func (s *Server) pointsHere(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
 	}
-	return rest[:j]
+	return strings.EqualFold(strings.TrimSuffix(u.Hostname(), "."), s.cfg.Hostname)
 }
 
 func uniqueCallbacks(v []struct {
@@ -1,6 +1,37 @@
 package httpserver
 
-import "embed"
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"time"
+)
 
 //go:embed *.html
 var templatesFS embed.FS
+
+var templateFuncs = template.FuncMap{
+	"humanBytes": humanBytes,
+	"humanTime":  humanTime,
+}
+
+// humanBytes formats a size for display, e.g. 12.3 KB.
+func humanBytes(n int64) string {
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%d B", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	}
+}
+
+// humanTime formats a stored RFC 3339 timestamp for display.
+func humanTime(ts string) string {
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return ts
+	}
+	return t.UTC().Format("2006-01-02 15:04 UTC")
+}
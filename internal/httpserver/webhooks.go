@@ -0,0 +1,290 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+	"github.com/jtsang4/kill-the-newsletter/internal/util"
+)
+
+var feedWebhooksRe = regexp.MustCompile(`^/feeds/([A-Za-z0-9]+)/webhooks$`)
+var feedWebhookRe = regexp.MustCompile(`^/feeds/([A-Za-z0-9]+)/webhooks/([A-Za-z0-9]+)$`)
+var apiWebhooksRe = regexp.MustCompile(`^/api/v1/feeds/([A-Za-z0-9]+)/webhooks$`)
+var apiWebhookRe = regexp.MustCompile(`^/api/v1/feeds/([A-Za-z0-9]+)/webhooks/([A-Za-z0-9]+)$`)
+var apiWebhookDeliveriesRe = regexp.MustCompile(`^/api/v1/feeds/([A-Za-z0-9]+)/webhooks/([A-Za-z0-9]+)/deliveries$`)
+
+const (
+	maxWebhooksPerFeed = 10
+	maxWebhookURLBytes = 2000
+	// feedPageDeliveries is the number of deliveries of each webhook shown
+	// on the feed settings page.
+	feedPageDeliveries = 5
+)
+
+type apiWebhook struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	Secret    string `json:"secret"`
+	CreatedAt string `json:"createdAt"`
+}
+
+type apiWebhookDelivery struct {
+	ID        int64  `json:"id"`
+	CreatedAt string `json:"createdAt"`
+	Event     string `json:"event"`
+	EntryID   string `json:"entryId"`
+	Attempt   int    `json:"attempt"`
+	// Status is the response status, null if the request failed.
+	Status               *int64  `json:"status"`
+	Error                *string `json:"error"`
+	DurationMilliseconds int64   `json:"durationMilliseconds"`
+}
+
+// webhookView is a webhook with its latest deliveries, for the feed page.
+type webhookView struct {
+	db.Webhook
+	Deliveries []db.WebhookDelivery
+}
+
+// createWebhook adds a webhook to a feed, with a new secret. It returns a
+// validation message if the URL isn't acceptable or the feed has too many.
+func (s *Server) createWebhook(ctx context.Context, f *db.Feed, rawURL string) (*db.Webhook, string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	// Like WebSub callbacks, webhooks can't point back at this instance.
+	if rawURL == "" || len(rawURL) > maxWebhookURLBytes || s.pointsHere(rawURL) || s.outbound.CheckURL(rawURL) != nil {
+		return nil, "invalid url", nil
+	}
+	publicID, err := util.RandID(20)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := util.RandID(32)
+	if err != nil {
+		return nil, "", err
+	}
+	createdAt := time.Now().UTC().Format(time.RFC3339Nano)
+	var problem string
+	var id int64
+	err = s.db.Tx(ctx, func(tx *db.Tx) error {
+		n, err := db.CountFeedWebhooks(ctx, tx, f.ID)
+		if err != nil {
+			return err
+		}
+		if n >= maxWebhooksPerFeed {
+			problem = "too many webhooks"
+			return nil
+		}
+		id, err = db.InsertWebhook(ctx, tx, publicID, f.ID, createdAt, rawURL, secret)
+		return err
+	})
+	if err != nil || problem != "" {
+		return nil, problem, err
+	}
+	return &db.Webhook{ID: id, PublicID: publicID, FeedID: f.ID, CreatedAt: createdAt, URL: rawURL, Secret: secret}, "", nil
+}
+
+func (s *Server) deleteWebhook(ctx context.Context, h *db.Webhook) error {
+	return s.db.Tx(ctx, func(tx *db.Tx) error { return db.DeleteWebhook(ctx, tx, h.ID) })
+}
+
+// feedWebhookViews returns a feed's webhooks for its settings page.
+func (s *Server) feedWebhookViews(ctx context.Context, f *db.Feed) ([]webhookView, error) {
+	hooks, err := db.GetFeedWebhooks(ctx, s.db.Read, f.ID)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]webhookView, 0, len(hooks))
+	for _, h := range hooks {
+		deliveries, err := db.GetWebhookDeliveries(ctx, s.db.Read, h.ID, feedPageDeliveries)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, webhookView{Webhook: h, Deliveries: deliveries})
+	}
+	return views, nil
+}
+
+// handleFeedWebhooks adds a webhook from the feed settings page.
+func (s *Server) handleFeedWebhooks(w http.ResponseWriter, r *http.Request, manageToken string) {
+	ctx := r.Context()
+	f, err := db.GetFeedByManageToken(ctx, s.db.Read, manageToken)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if f == nil {
+		s.notFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	_, problem, err := s.createWebhook(ctx, f, r.Form.Get("url"))
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if problem != "" {
+		s.validationError(w, r, problem)
+		return
+	}
+	http.Redirect(w, r, "/feeds/"+f.ManageToken, http.StatusFound)
+}
+
+// handleFeedWebhook deletes a webhook from the feed settings page.
+func (s *Server) handleFeedWebhook(w http.ResponseWriter, r *http.Request, manageToken, webhookPub string) {
+	ctx := r.Context()
+	f, err := db.GetFeedByManageToken(ctx, s.db.Read, manageToken)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if f == nil {
+		s.notFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	h, err := db.GetWebhookByPublicID(ctx, s.db.Read, f.ID, webhookPub)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	if h == nil {
+		s.notFound(w, r)
+		return
+	}
+	if err := s.deleteWebhook(ctx, h); err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/feeds/"+f.ManageToken, http.StatusFound)
+}
+
+func (s *Server) handleAPIWebhooks(w http.ResponseWriter, r *http.Request, pub string) {
+	ctx := r.Context()
+	f, ok := s.apiLoadFeed(w, r, pub)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		hooks, err := db.GetFeedWebhooks(ctx, s.db.Read, f.ID)
+		if err != nil {
+			s.apiServerError(w, err)
+			return
+		}
+		out := make([]apiWebhook, 0, len(hooks))
+		for i := range hooks {
+			out = append(out, apiWebhookOf(&hooks[i]))
+		}
+		s.apiJSON(w, http.StatusOK, map[string]any{"webhooks": out})
+	case http.MethodPost:
+		var body struct {
+			URL string `json:"url"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			s.apiError(w, http.StatusBadRequest, "invalid_body", "request body must be a JSON object")
+			return
+		}
+		h, problem, err := s.createWebhook(ctx, f, body.URL)
+		if err != nil {
+			s.apiServerError(w, err)
+			return
+		}
+		if problem != "" {
+			s.apiError(w, http.StatusBadRequest, strings.ReplaceAll(problem, " ", "_"), problem)
+			return
+		}
+		s.apiJSON(w, http.StatusCreated, apiWebhookOf(h))
+	default:
+		s.apiMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (s *Server) handleAPIWebhook(w http.ResponseWriter, r *http.Request, pub, webhookPub string) {
+	h, ok := s.apiLoadWebhook(w, r, pub, webhookPub)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.apiJSON(w, http.StatusOK, apiWebhookOf(h))
+	case http.MethodDelete:
+		if err := s.deleteWebhook(r.Context(), h); err != nil {
+			s.apiServerError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.apiMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+func (s *Server) handleAPIWebhookDeliveries(w http.ResponseWriter, r *http.Request, pub, webhookPub string) {
+	if r.Method != http.MethodGet {
+		s.apiMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	h, ok := s.apiLoadWebhook(w, r, pub, webhookPub)
+	if !ok {
+		return
+	}
+	deliveries, err := db.GetWebhookDeliveries(r.Context(), s.db.Read, h.ID, apiMaxPageSize)
+	if err != nil {
+		s.apiServerError(w, err)
+		return
+	}
+	out := make([]apiWebhookDelivery, 0, len(deliveries))
+	for _, d := range deliveries {
+		v := apiWebhookDelivery{
+			ID:                   d.ID,
+			CreatedAt:            d.CreatedAt,
+			Event:                d.Event,
+			EntryID:              d.EntryPublicID,
+			Attempt:              d.Attempt,
+			Error:                nullString(d.Error),
+			DurationMilliseconds: d.DurationMilliseconds,
+		}
+		if d.Status.Valid {
+			v.Status = &d.Status.Int64
+		}
+		out = append(out, v)
+	}
+	s.apiJSON(w, http.StatusOK, map[string]any{"deliveries": out})
+}
+
+func (s *Server) apiLoadWebhook(w http.ResponseWriter, r *http.Request, pub, webhookPub string) (*db.Webhook, bool) {
+	f, ok := s.apiLoadFeed(w, r, pub)
+	if !ok {
+		return nil, false
+	}
+	h, err := db.GetWebhookByPublicID(r.Context(), s.db.Read, f.ID, webhookPub)
+	if err != nil {
+		s.apiServerError(w, err)
+		return nil, false
+	}
+	if h == nil {
+		s.apiError(w, http.StatusNotFound, "not_found", db.ErrNotFound("webhook").Error())
+		return nil, false
+	}
+	return h, true
+}
+
+func apiWebhookOf(h *db.Webhook) apiWebhook {
+	return apiWebhook{ID: h.PublicID, URL: h.URL, Secret: h.Secret, CreatedAt: h.CreatedAt}
+}
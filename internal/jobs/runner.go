@@ -0,0 +1,326 @@
+// Package jobs runs background jobs from the backgroundJobs table.
+//
+// Handlers are registered by job type, each with its concurrency and retry
+// policy. A runner takes due jobs of each type as soon as they are enqueued
+// in the same process, and polls for jobs enqueued by other processes.
+// Running jobs are leased to the runner, which renews the lease while they
+// run; the jobs of runners that stop renewing are taken back by any runner
+// sharing the database.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+	"github.com/jtsang4/kill-the-newsletter/internal/util"
+)
+
+// Handler runs jobs of one type. Jobs whose handler returns an error are
+// retried according to the type's RetryPolicy, unless the error is
+// Permanent.
+type Handler interface {
+	Run(ctx context.Context, job *db.Job) error
+}
+
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc func(ctx context.Context, job *db.Job) error
+
+func (f HandlerFunc) Run(ctx context.Context, job *db.Job) error { return f(ctx, job) }
+
+// JSON returns a Handler for jobs whose parameters are the JSON encoding of
+// P. Parameters that don't decode are a permanent error.
+func JSON[P any](fn func(ctx context.Context, params P) error) Handler {
+	return HandlerFunc(func(ctx context.Context, job *db.Job) error {
+		var params P
+		if err := json.Unmarshal([]byte(job.Parameters), &params); err != nil {
+			return Permanent(err)
+		}
+		return fn(ctx, params)
+	})
+}
+
+// RetryPolicy is how failed jobs of a type are retried: after Base, then
+// twice as long after each failure up to Max, until Retries are exhausted.
+type RetryPolicy struct {
+	Retries   int
+	Base, Max time.Duration
+}
+
+// delay returns how long to wait before the next attempt of a job that
+// failed after retries earlier failures. It is randomized between half and
+// all of the exponential delay, so that jobs that failed together, like the
+// dispatches of an entry to a subscriber that was down, don't retry together.
+func (p RetryPolicy) delay(retries int) time.Duration {
+	// Compare before shifting, which would overflow past Max.
+	d := p.Max
+	if retries >= 0 && retries < 63 && p.Base <= p.Max>>retries {
+		d = p.Base << retries
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// defaultRetry is the retry policy of jobs of types that aren't registered.
+var defaultRetry = RetryPolicy{Retries: 5, Base: time.Minute, Max: time.Hour}
+
+type permanentError struct{ error }
+
+func (e permanentError) Unwrap() error { return e.error }
+
+// Permanent marks an error that retrying the job won't fix.
+func Permanent(err error) error { return permanentError{err} }
+
+// leaseDuration is how long a job stays leased to a runner that stops
+// renewing it, after which another runner takes it over. Runners renew
+// their leases every third of it, so a busy database doesn't make them lose
+// leases.
+const leaseDuration = time.Minute
+
+// pollInterval is how often runners look for jobs that they weren't woken
+// for: those enqueued by other processes, and retries that became due.
+const pollInterval = 10 * time.Second
+
+type jobType struct {
+	name        string
+	handler     Handler
+	concurrency int
+	retry       RetryPolicy
+}
+
+// Runner runs the jobs of the types registered with it.
+type Runner struct {
+	dbx   *db.DB
+	id    string
+	types map[string]*jobType
+}
+
+// NewRunner returns a runner with a new identity, which it leases jobs as.
+func NewRunner(dbx *db.DB) *Runner {
+	return &Runner{dbx: dbx, id: newRunnerID(), types: map[string]*jobType{}}
+}
+
+// ID identifies the runner in the leases of the jobs it runs.
+func (r *Runner) ID() string { return r.id }
+
+// Register sets the handler of a job type, how many of its jobs run at the
+// same time and how failed ones are retried. It must be called before Start.
+func (r *Runner) Register(typ string, h Handler, concurrency int, retry RetryPolicy) {
+	r.types[typ] = &jobType{name: typ, handler: h, concurrency: max(1, concurrency), retry: retry}
+}
+
+// Start takes back the jobs of runners that died, including an earlier run
+// of this process, then runs jobs until ctx is done.
+func (r *Runner) Start(ctx context.Context) {
+	r.reclaimExpiredJobs(ctx)
+	for _, t := range r.types {
+		go r.dispatch(ctx, t)
+	}
+	go r.reclaimLoop(ctx)
+}
+
+// newRunnerID identifies a process in the leases of the jobs it runs. The
+// random part tells apart processes on the same host that reuse a pid, as
+// in containers.
+func newRunnerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	suffix, _ := util.RandID(6)
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), suffix)
+}
+
+func leaseUntil(now time.Time) string {
+	return now.Add(leaseDuration).UTC().Format(time.RFC3339Nano)
+}
+
+// dispatch takes due jobs of a type while fewer than its concurrency run,
+// then waits until a job is enqueued, a running one finishes, the next
+// pending one is due or it is time to poll.
+func (r *Runner) dispatch(ctx context.Context, t *jobType) {
+	enqueued := db.JobsEnqueued(t.name)
+	slots := make(chan struct{}, t.concurrency)
+	finished := make(chan struct{}, 1)
+	for {
+		for len(slots) < cap(slots) {
+			job := r.dequeue(ctx, t.name)
+			if job == nil {
+				break
+			}
+			slots <- struct{}{}
+			go func() {
+				r.run(ctx, t, job)
+				<-slots
+				select {
+				case finished <- struct{}{}:
+				default:
+				}
+			}()
+		}
+		wait := pollInterval
+		if len(slots) < cap(slots) {
+			wait = r.untilNextJob(ctx, t.name)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-enqueued:
+		case <-finished:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// untilNextJob returns how long until the next pending job of a type is
+// due, up to pollInterval.
+func (r *Runner) untilNextJob(ctx context.Context, typ string) time.Duration {
+	next, err := db.GetNextJobStartAt(ctx, r.dbx.Read, typ)
+	if err != nil || next == "" {
+		return pollInterval
+	}
+	startAt, err := time.Parse(time.RFC3339Nano, next)
+	if err != nil {
+		return pollInterval
+	}
+	return min(max(time.Until(startAt), 0), pollInterval)
+}
+
+func (r *Runner) dequeue(ctx context.Context, typ string) *db.Job {
+	var job *db.Job
+	err := r.dbx.Tx(ctx, func(tx *db.Tx) error {
+		now := time.Now()
+		var err error
+		job, err = db.DequeueJob(ctx, tx, typ, now.UTC().Format(time.RFC3339Nano), r.id, leaseUntil(now))
+		return err
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("dequeue %s: %v", typ, err)
+	}
+	return job
+}
+
+// run runs a job with its lease renewed, and records the outcome.
+func (r *Runner) run(ctx context.Context, t *jobType, job *db.Job) {
+	jobCtx, stop := r.heartbeat(ctx, job)
+	err := t.handler.Run(jobCtx, job)
+	stop()
+	r.finish(ctx, job, err)
+}
+
+// heartbeat renews the lease of a job until stop is called. The returned
+// context is canceled if the lease is lost, as the job then belongs to
+// another runner.
+func (r *Runner) heartbeat(ctx context.Context, job *db.Job) (jobCtx context.Context, stop func()) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(leaseDuration / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-jobCtx.Done():
+				return
+			case <-t.C:
+			}
+			held, err := db.RenewJobLease(jobCtx, r.dbx.Write, job.ID, r.id, leaseUntil(time.Now()))
+			if err != nil {
+				log.Printf("renew lease of job %d: %v", job.ID, err)
+				continue
+			}
+			if !held {
+				log.Printf("job %d (%s): lease lost, stopping", job.ID, job.Type)
+				cancel()
+				return
+			}
+		}
+	}()
+	return jobCtx, func() {
+		cancel()
+		<-done
+	}
+}
+
+// finish records the outcome of a job.
+func (r *Runner) finish(ctx context.Context, job *db.Job, jobErr error) {
+	var held bool
+	err := r.dbx.Tx(ctx, func(tx *db.Tx) error {
+		var err error
+		if jobErr == nil {
+			held, err = db.CompleteJob(ctx, tx, job.ID, r.id)
+		} else {
+			held, err = r.fail(ctx, tx, r.id, job, jobErr)
+		}
+		return err
+	})
+	if err != nil {
+		log.Printf("finish job %d: %v", job.ID, err)
+	} else if !held {
+		log.Printf("job %d (%s): lease lost before it finished", job.ID, job.Type)
+	}
+}
+
+// fail records a failed attempt of a job leased by runner. The job is
+// retried later, unless the error is permanent or the job's retries are
+// exhausted, in which case it is dead.
+func (r *Runner) fail(ctx context.Context, tx *db.Tx, runner string, job *db.Job, jobErr error) (bool, error) {
+	// Reclaimed jobs may be of types that another version registers.
+	p := defaultRetry
+	if t, ok := r.types[job.Type]; ok {
+		p = t.retry
+	}
+	if errors.As(jobErr, new(permanentError)) || job.Retries >= p.Retries {
+		log.Printf("job %d (%s) is dead after %d attempts: %v", job.ID, job.Type, job.Retries+1, jobErr)
+		return db.DeadLetterJob(ctx, tx, job.ID, runner, jobErr.Error())
+	}
+	startAt := time.Now().Add(p.delay(job.Retries)).UTC().Format(time.RFC3339Nano)
+	return db.RetryJob(ctx, tx, job.ID, runner, startAt, jobErr.Error())
+}
+
+func (r *Runner) reclaimLoop(ctx context.Context) {
+	t := time.NewTicker(leaseDuration / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		r.reclaimExpiredJobs(ctx)
+	}
+}
+
+// reclaimExpiredJobs takes back the jobs of runners that stopped renewing
+// their leases, most likely because their process died. Each counts as a
+// failed attempt, so a job that kills its runner every time ends up dead.
+func (r *Runner) reclaimExpiredJobs(ctx context.Context) {
+	err := r.dbx.Tx(ctx, func(tx *db.Tx) error {
+		jobs, err := db.GetExpiredJobs(ctx, tx, time.Now().UTC().Format(time.RFC3339Nano))
+		if err != nil {
+			return err
+		}
+		for i := range jobs {
+			j := &jobs[i]
+			log.Printf("job %d (%s): lease of runner %q expired, reclaiming", j.ID, j.Type, j.LeasedBy.String)
+			if _, err := r.fail(ctx, tx, j.LeasedBy.String, j, fmt.Errorf("lease of runner %q expired", j.LeasedBy.String)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("reclaim expired jobs: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package jsonfeed
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/feed"
+)
+
+type jsonFeed struct {
+	Version     string     `json:"version"`
+	Title       string     `json:"title"`
+	HomePageURL string     `json:"home_page_url,omitempty"`
+	FeedURL     string     `json:"feed_url"`
+	Icon        string     `json:"icon,omitempty"`
+	Favicon     string     `json:"favicon,omitempty"`
+	Hubs        []jsonHub  `json:"hubs,omitempty"`
+	Items       []jsonItem `json:"items"`
+}
+
+type jsonHub struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type jsonItem struct {
+	ID            string           `json:"id"`
+	URL           string           `json:"url"`
+	Title         string           `json:"title"`
+	ContentHTML   string           `json:"content_html"`
+	DatePublished string           `json:"date_published"`
+	DateModified  string           `json:"date_modified"`
+	Authors       []jsonAuthor     `json:"authors,omitempty"`
+	Attachments   []jsonAttachment `json:"attachments,omitempty"`
+}
+
+type jsonAuthor struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+}
+
+type jsonAttachment struct {
+	URL         string `json:"url"`
+	MimeType    string `json:"mime_type"`
+	Title       string `json:"title,omitempty"`
+	SizeInBytes int64  `json:"size_in_bytes"`
+}
+
+// BuildFeedJSON returns a full JSON Feed 1.1 document for the given items.
+// Enclosures map to item attachments.
+func BuildFeedJSON(f feed.Feed, entries []feed.Entry) (string, error) {
+	jf := jsonFeed{
+		Version: "https://jsonfeed.org/version/1.1",
+		Title:   f.Title,
+		FeedURL: f.DocumentURL(feed.FormatJSON),
+		Items:   []jsonItem{},
+	}
+	if f.HubURL != "" {
+		jf.Hubs = []jsonHub{{Type: "WebSub", URL: f.HubURL}}
+	}
+	if f.Icon != nil {
+		jf.Favicon = *f.Icon
+	}
+	for _, e := range entries {
+		item := jsonItem{
+			ID:            e.ID,
+			URL:           e.URL,
+			Title:         e.Title,
+			ContentHTML:   e.Content,
+			DatePublished: e.PublishedAt,
+			DateModified:  e.UpdatedAt,
+		}
+		if e.Author != nil {
+			author := jsonAuthor{Name: *e.Author}
+			if e.AuthorEmail != nil {
+				author.URL = "mailto:" + *e.AuthorEmail
+			}
+			item.Authors = []jsonAuthor{author}
+		}
+		for _, enc := range e.Enclosures {
+			item.Attachments = append(item.Attachments, jsonAttachment{URL: enc.URL, MimeType: enc.Type, Title: enc.Name, SizeInBytes: enc.Length})
+		}
+		jf.Items = append(jf.Items, item)
+	}
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(jf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
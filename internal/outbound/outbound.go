@@ -0,0 +1,194 @@
+// Package outbound is the HTTP client for requests to URLs that users
+// choose, like WebSub callbacks.
+//
+// The addresses that such URLs resolve to are checked when connecting, not
+// when the URL is accepted, so that a host name resolving to a public
+// address at first and to an internal one later (DNS rebinding) can't reach
+// the instance's network. Redirects are followed through the same checks.
+package outbound
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/config"
+)
+
+const (
+	dialTimeout     = 10 * time.Second
+	responseTimeout = 15 * time.Second
+	// requestTimeout bounds a whole request, including redirects and reading
+	// the response body.
+	requestTimeout = 30 * time.Second
+	maxRedirects   = 3
+	// MaxBodyBytes is the most of a response body that is read.
+	MaxBodyBytes = 1 << 20
+)
+
+// ErrBlocked is returned for requests to addresses in the blocked networks.
+var ErrBlocked = errors.New("address is in a blocked network")
+
+// ErrTooLarge is returned when reading a response body past MaxBodyBytes.
+var ErrTooLarge = errors.New("response body is too large")
+
+// Client is an HTTP client that only connects to addresses outside of the
+// blocked networks.
+type Client struct {
+	*http.Client
+	blocked []netip.Prefix
+}
+
+// New returns a client that blocks the networks in cfg, by default
+// config.DefaultOutboundBlockedNetworks.
+func New(cfg config.Config) *Client {
+	networks := cfg.OutboundBlockedNetworks
+	if networks == nil {
+		networks = config.DefaultOutboundBlockedNetworks
+	}
+	c := &Client{}
+	for _, n := range networks {
+		// Load and LoadEnv reject invalid networks.
+		if p, err := config.ParseNetwork(n); err == nil {
+			c.blocked = append(c.blocked, p)
+		}
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout, Control: c.control}
+	c.Client = &http.Client{
+		Timeout: requestTimeout,
+		Transport: &transport{
+			base: &http.Transport{
+				// Proxies from the environment would connect on our behalf,
+				// without the checks.
+				Proxy:                 nil,
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   dialTimeout,
+				ResponseHeaderTimeout: responseTimeout,
+				MaxIdleConnsPerHost:   2,
+				IdleConnTimeout:       90 * time.Second,
+			},
+			userAgent: fmt.Sprintf("Kill the Newsletter! (+https://%s/)", cfg.Hostname),
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return checkScheme(req.URL)
+		},
+	}
+	return c
+}
+
+// control runs before connecting, with the address that the host name
+// resolved to.
+func (c *Client) control(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if c.Blocked(ap.Addr()) {
+		return fmt.Errorf("%w: %s", ErrBlocked, ap.Addr())
+	}
+	return nil
+}
+
+// Blocked reports whether addr is in a blocked network.
+func (c *Client) Blocked(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range c.blocked {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckURL rejects URLs that requests would certainly fail for: those that
+// aren't HTTP or HTTPS, and those whose host is an address in a blocked
+// network or localhost. Other host names are only checked when connecting.
+func (c *Client) CheckURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if err := checkScheme(u); err != nil {
+		return err
+	}
+	host := u.Hostname()
+	if host == "" {
+		return errors.New("URL has no host")
+	}
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		host = "127.0.0.1"
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && c.Blocked(addr) {
+		return fmt.Errorf("%w: %s", ErrBlocked, addr)
+	}
+	return nil
+}
+
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	return nil
+}
+
+// transport sets the User-Agent and caps response bodies.
+type transport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength > MaxBodyBytes {
+		resp.Body.Close()
+		return nil, ErrTooLarge
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: MaxBodyBytes}
+	return resp, nil
+}
+
+// limitedBody fails reads past the cap instead of truncating the body, so
+// that a truncated body isn't mistaken for a complete one.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// Tell a body that ends exactly at the cap from a longer one.
+		var one [1]byte
+		if n, err := b.ReadCloser.Read(one[:]); n == 0 {
+			return 0, err
+		}
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// Discard reads and closes a response body, so that its connection can be
+// reused.
+func Discard(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
@@ -0,0 +1,243 @@
+// Package privacy removes tracking from sanitized email HTML: tracking
+// pixels, tracking query parameters and click-redirect wrappers around links.
+package privacy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Version identifies the cleaning rules, like sanitize.Version.
+const Version = 1
+
+// Report records what was removed from an entry.
+type Report struct {
+	Pixels     int `json:"pixels"`
+	Parameters int `json:"parameters"`
+	Redirects  int `json:"redirects"`
+}
+
+func (r Report) Empty() bool { return r == Report{} }
+
+// Summary describes the report for the entry page, e.g. "removed 2 tracking
+// pixels and 5 tracking parameters".
+func (r Report) Summary() string {
+	var parts []string
+	if r.Pixels > 0 {
+		parts = append(parts, plural(r.Pixels, "tracking pixel"))
+	}
+	if r.Parameters > 0 {
+		parts = append(parts, plural(r.Parameters, "tracking parameter"))
+	}
+	if r.Redirects > 0 {
+		parts = append(parts, plural(r.Redirects, "redirect"))
+	}
+	switch len(parts) {
+	case 0:
+		return ""
+	case 1:
+		return "removed " + parts[0]
+	}
+	return "removed " + strings.Join(parts[:len(parts)-1], ", ") + " and " + parts[len(parts)-1]
+}
+
+// ParseReport reads a report stored with Report.JSON; invalid input yields
+// an empty report.
+func ParseReport(s string) Report {
+	var r Report
+	_ = json.Unmarshal([]byte(s), &r)
+	return r
+}
+
+func (r Report) JSON() string {
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// trackingParameter reports whether a query parameter only identifies the
+// campaign or recipient.
+func trackingParameter(name string) bool {
+	name = strings.ToLower(name)
+	if strings.HasPrefix(name, "utm_") || strings.HasPrefix(name, "mc_") || strings.HasPrefix(name, "_hs") || strings.HasPrefix(name, "vero_") || strings.HasPrefix(name, "oly_") {
+		return true
+	}
+	switch name {
+	case "fbclid", "gclid", "dclid", "msclkid", "yclid", "igshid", "mkt_tok", "ck_subscriber_id", "s_cid", "rb_clickid", "wickedid", "__s":
+		return true
+	}
+	return false
+}
+
+// trackingPixelSrc matches the open-tracking endpoints of common email
+// services, which aren't always sized 1x1.
+var trackingPixelSrc = regexp.MustCompile(`(?i)/track/open|/wf/open\b|/open\.(php|aspx|gif)\b|/e/o/|//pixel\.|/pixel(\.gif|\.png)?(\?|$)|/beacon\b`)
+
+// redirectors are click-tracking and link-protection services that carry the
+// target in a query parameter, by host and path prefix.
+var redirectors = []struct{ host, path, param string }{
+	{"www.google.com", "/url", "q"},
+	{"google.com", "/url", "q"},
+	{"l.facebook.com", "/l.php", "u"},
+	{"lm.facebook.com", "/l.php", "u"},
+	{"www.youtube.com", "/redirect", "q"},
+	{"out.reddit.com", "/", "url"},
+	{"t.umblr.com", "/redirect", "z"},
+	{"slack-redir.net", "/link", "url"},
+	{"safelinks.protection.outlook.com", "/", "url"},
+}
+
+// Clean removes tracking from HTML produced by sanitize.HTML.
+func Clean(s string) (string, Report) {
+	var report Report
+	z := html.NewTokenizer(strings.NewReader(s))
+	var b strings.Builder
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return b.String(), report
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			b.Write(z.Raw())
+			continue
+		}
+		tok := z.Token()
+		switch tok.Data {
+		case "img":
+			if isTrackingPixel(tok.Attr) {
+				report.Pixels++
+				continue
+			}
+			cleanAttr(tok.Attr, "src", &report)
+		case "a", "area":
+			cleanAttr(tok.Attr, "href", &report)
+		default:
+			b.Write(z.Raw())
+			continue
+		}
+		b.WriteString("<" + tok.Data)
+		for _, a := range tok.Attr {
+			b.WriteString(" " + a.Key + `="` + html.EscapeString(a.Val) + `"`)
+		}
+		if tt == html.SelfClosingTagToken {
+			b.WriteString(" /")
+		}
+		b.WriteString(">")
+	}
+}
+
+func isTrackingPixel(attrs []html.Attribute) bool {
+	var width, height, style, src string
+	for _, a := range attrs {
+		switch a.Key {
+		case "width":
+			width = a.Val
+		case "height":
+			height = a.Val
+		case "style":
+			style = strings.ToLower(strings.ReplaceAll(a.Val, " ", ""))
+		case "src":
+			src = a.Val
+		}
+	}
+	if tiny(width) && tiny(height) {
+		return true
+	}
+	if strings.Contains(style, "display:none") || (strings.Contains(style, "width:1px") && strings.Contains(style, "height:1px")) {
+		return true
+	}
+	return trackingPixelSrc.MatchString(src)
+}
+
+func tiny(dimension string) bool {
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(dimension), "px"))
+	return err == nil && n <= 1
+}
+
+func cleanAttr(attrs []html.Attribute, key string, report *Report) {
+	for i, a := range attrs {
+		if a.Key == key {
+			attrs[i].Val = cleanURL(a.Val, report)
+		}
+	}
+}
+
+// cleanURL unwraps redirects and strips tracking parameters from u.
+func cleanURL(raw string, report *Report) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return raw
+	}
+	for range 3 { // redirects may be nested
+		target := unwrap(u)
+		if target == nil {
+			break
+		}
+		report.Redirects++
+		u = target
+	}
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	var kept []string
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		name, _, _ := strings.Cut(pair, "=")
+		if decoded, err := url.QueryUnescape(name); err == nil {
+			name = decoded
+		}
+		if trackingParameter(name) {
+			report.Parameters++
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	u.RawQuery = strings.Join(kept, "&")
+	return u.String()
+}
+
+// unwrap returns the target of a redirect URL, or nil if u isn't one.
+func unwrap(u *url.URL) *url.URL {
+	host := strings.ToLower(u.Hostname())
+	for _, r := range redirectors {
+		if (host == r.host || strings.HasSuffix(host, "."+r.host)) && strings.HasPrefix(u.Path, r.path) {
+			if target := absoluteURL(u.Query().Get(r.param)); target != nil {
+				return target
+			}
+		}
+	}
+	// Some services put the target base64-encoded in a path segment.
+	for _, segment := range strings.Split(u.Path, "/") {
+		if !strings.HasPrefix(segment, "aHR0c") { // "http" in base64
+			continue
+		}
+		for _, enc := range []*base64.Encoding{base64.RawURLEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.StdEncoding} {
+			if decoded, err := enc.DecodeString(segment); err == nil {
+				if target := absoluteURL(string(decoded)); target != nil {
+					return target
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func absoluteURL(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil
+	}
+	return u
+}
@@ -0,0 +1,21 @@
+// Package render serializes the format-neutral feed model in any of the
+// supported formats.
+package render
+
+import (
+	"github.com/jtsang4/kill-the-newsletter/internal/atom"
+	"github.com/jtsang4/kill-the-newsletter/internal/feed"
+	"github.com/jtsang4/kill-the-newsletter/internal/jsonfeed"
+	"github.com/jtsang4/kill-the-newsletter/internal/rss"
+)
+
+// Feed renders a feed document in the given format.
+func Feed(format feed.Format, f feed.Feed, entries []feed.Entry) (string, error) {
+	switch format {
+	case feed.FormatRSS:
+		return rss.BuildFeedXML(f, entries)
+	case feed.FormatJSON:
+		return jsonfeed.BuildFeedJSON(f, entries)
+	}
+	return atom.BuildFeedXML(f, entries)
+}
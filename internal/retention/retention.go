@@ -0,0 +1,74 @@
+// Package retention decides which entries of a feed to delete, combining the
+// feed's own limits with the instance defaults.
+package retention
+
+import (
+	"context"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/config"
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+)
+
+// Policy holds the effective limits for a feed; zero means unlimited.
+type Policy struct {
+	MaxBytes   int64
+	MaxEntries int64
+	MaxAgeDays int64
+}
+
+// For returns the effective policy of a feed: its overrides where set and
+// the instance defaults elsewhere.
+func For(defaults config.Retention, f *db.Feed) Policy {
+	p := Policy{MaxBytes: defaults.MaxBytes, MaxEntries: defaults.MaxEntries, MaxAgeDays: defaults.MaxAgeDays}
+	if f.RetentionMaxBytes.Valid {
+		p.MaxBytes = f.RetentionMaxBytes.Int64
+	}
+	if f.RetentionMaxEntries.Valid {
+		p.MaxEntries = f.RetentionMaxEntries.Int64
+	}
+	if f.RetentionMaxAgeDays.Valid {
+		p.MaxAgeDays = f.RetentionMaxAgeDays.Int64
+	}
+	return p
+}
+
+// Apply deletes the entries of a feed that fall outside the policy and
+// returns how many were deleted. The newest entry is never removed by the
+// size or count limits, so a single large newsletter is still delivered, but
+// it does expire by age. Enclosure files are removed later by the cleanup
+// loop once they are no longer linked.
+func Apply(ctx context.Context, tx *db.Tx, feedID int64, p Policy, now time.Time) (int, error) {
+	entries, err := db.GetEntrySizesDescTx(ctx, tx, feedID)
+	if err != nil {
+		return 0, err
+	}
+	var cutoff string
+	if p.MaxAgeDays > 0 {
+		cutoff = now.Add(-time.Duration(p.MaxAgeDays) * 24 * time.Hour).UTC().Format(time.RFC3339Nano)
+	}
+	var size int64
+	deleted := 0
+	for i, e := range entries { // from newest backwards
+		size += e.Bytes
+		expired := cutoff != "" && e.CreatedAt < cutoff
+		overSize := p.MaxBytes > 0 && size > p.MaxBytes && i > 0
+		overCount := p.MaxEntries > 0 && int64(i) >= p.MaxEntries && i > 0
+		if !expired && !overSize && !overCount {
+			continue
+		}
+		if err := db.DeleteEnclosureLinksByEntry(ctx, tx, e.ID); err != nil {
+			return deleted, err
+		}
+		if err := db.DeleteEntryByID(ctx, tx, e.ID); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		if err := db.TouchFeed(ctx, tx, feedID); err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
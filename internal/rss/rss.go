@@ -0,0 +1,124 @@
+package rss
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strconv"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/feed"
+)
+
+type rssDoc struct {
+	XMLName   xml.Name   `xml:"rss"`
+	Version   string     `xml:"version,attr"`
+	XmlnsAtom string     `xml:"xmlns:atom,attr"`
+	Channel   rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string     `xml:"title"`
+	Link          string     `xml:"link"`
+	Description   string     `xml:"description"`
+	AtomLinks     []atomLink `xml:"atom:link"`
+	LastBuildDate string     `xml:"lastBuildDate,omitempty"`
+	Image         *rssImage  `xml:"image,omitempty"`
+	Items         []rssItem  `xml:"item"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type rssImage struct {
+	URL   string `xml:"url"`
+	Title string `xml:"title"`
+	Link  string `xml:"link"`
+}
+
+type rssItem struct {
+	Title       string         `xml:"title"`
+	Link        string         `xml:"link"`
+	GUID        rssGUID        `xml:"guid"`
+	PubDate     string         `xml:"pubDate,omitempty"`
+	Author      string         `xml:"author,omitempty"`
+	Description string         `xml:"description"`
+	Enclosures  []rssEnclosure `xml:"enclosure"`
+}
+
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length string `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// BuildFeedXML returns a full RSS 2.0 document for the given items.
+// Enclosures map to <enclosure> elements, one per attachment.
+func BuildFeedXML(f feed.Feed, entries []feed.Entry) (string, error) {
+	self := f.DocumentURL(feed.FormatRSS)
+	ch := rssChannel{
+		Title:       f.Title,
+		Link:        self,
+		Description: f.Title,
+		AtomLinks: []atomLink{
+			{Rel: "self", Href: self, Type: "application/rss+xml"},
+		},
+	}
+	if f.HubURL != "" {
+		ch.AtomLinks = append(ch.AtomLinks, atomLink{Rel: "hub", Href: f.HubURL})
+	}
+	if f.Icon != nil {
+		ch.Image = &rssImage{URL: *f.Icon, Title: f.Title, Link: self}
+	}
+	if len(entries) > 0 {
+		ch.LastBuildDate = rfc1123(feed.LastUpdated(entries))
+	}
+	for _, e := range entries {
+		item := rssItem{
+			Title:       e.Title,
+			Link:        e.URL,
+			GUID:        rssGUID{IsPermaLink: "false", Value: e.ID},
+			PubDate:     rfc1123(e.PublishedAt),
+			Description: e.Content,
+		}
+		// RSS 2.0 authors are an address, optionally followed by a name.
+		if e.AuthorEmail != nil && e.Author != nil && *e.Author != *e.AuthorEmail {
+			item.Author = *e.AuthorEmail + " (" + *e.Author + ")"
+		} else if e.AuthorEmail != nil {
+			item.Author = *e.AuthorEmail
+		} else if e.Author != nil {
+			item.Author = *e.Author
+		}
+		for _, enc := range e.Enclosures {
+			item.Enclosures = append(item.Enclosures, rssEnclosure{URL: enc.URL, Length: strconv.FormatInt(enc.Length, 10), Type: enc.Type})
+		}
+		ch.Items = append(ch.Items, item)
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n")
+	enc := xml.NewEncoder(buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(rssDoc{Version: "2.0", XmlnsAtom: "http://www.w3.org/2005/Atom", Channel: ch}); err != nil {
+		return "", err
+	}
+	if err := enc.Flush(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// rfc1123 converts the stored RFC 3339 timestamps to the RFC 822 dates RSS requires.
+func rfc1123(ts string) string {
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC1123Z)
+}
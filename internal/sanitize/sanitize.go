@@ -0,0 +1,170 @@
+// Package sanitize cleans email HTML before it is stored and served. It is an
+// allowlist: elements and attributes that aren't known to be safe are
+// removed, keeping the markup newsletters use for layout (tables, inline
+// styles, <style> blocks, images and links).
+package sanitize
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Version identifies the sanitizer's rules. Bump it when they change so that
+// stored entries are sanitized again from their original content.
+const Version = 1
+
+// allowedElements are kept along with their allowed attributes. Other
+// elements are removed but their content is kept, unless they are in
+// droppedElements.
+var allowedElements = set(
+	"a", "abbr", "address", "area", "article", "aside", "b", "bdi", "bdo", "big",
+	"blockquote", "body", "br", "caption", "center", "cite", "code", "col",
+	"colgroup", "dd", "del", "details", "dfn", "div", "dl", "dt", "em",
+	"figcaption", "figure", "font", "footer", "h1", "h2", "h3", "h4", "h5", "h6",
+	"head", "header", "hr", "html", "i", "img", "ins", "kbd", "li", "main", "map",
+	"mark", "nav", "ol", "p", "pre", "q", "s", "samp", "section", "small", "span",
+	"strike", "strong", "style", "sub", "summary", "sup", "table", "tbody", "td",
+	"tfoot", "th", "thead", "time", "tr", "tt", "u", "ul", "var", "wbr",
+)
+
+// droppedElements are removed together with their content.
+var droppedElements = set(
+	"script", "noscript", "iframe", "frameset", "object", "applet", "template",
+	"title", "textarea", "select", "svg", "math", "noembed", "noframes", "xmp",
+	"plaintext",
+)
+
+var allowedAttributes = set(
+	"abbr", "align", "alt", "background", "bgcolor", "border", "cellpadding",
+	"cellspacing", "cite", "class", "color", "colspan", "coords", "datetime",
+	"dir", "face", "headers", "height", "href", "hspace", "id", "lang", "name",
+	"nowrap", "open", "rel", "role", "rowspan", "scope", "shape", "size", "span",
+	"src", "start", "style", "summary", "title", "type", "usemap", "valign",
+	"vspace", "width",
+)
+
+var urlAttributes = set("href", "src", "background", "cite")
+
+// dangerousCSS matches CSS that can run code or pull in other stylesheets in
+// some browsers, after whitespace, comments and escapes are removed.
+var dangerousCSS = regexp.MustCompile(`(?i)expression\(|javascript:|vbscript:|-moz-binding|behavior:|@import`)
+
+var cssNoise = regexp.MustCompile(`/\*.*?\*/|[\s\\]`)
+
+// HTML returns s with everything outside of the allowlist removed. The
+// output is well-formed enough to be embedded in other documents.
+func HTML(s string) string {
+	z := html.NewTokenizer(strings.NewReader(s))
+	var b strings.Builder
+	// dropping is the droppedElement being skipped, and depth counts nested
+	// elements of the same name so that its end tag is found.
+	dropping, depth := "", 0
+	inStyle := false
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return b.String()
+		}
+		tok := z.Token()
+		name := tok.Data
+		if dropping != "" {
+			switch {
+			case tt == html.StartTagToken && name == dropping:
+				depth++
+			case tt == html.EndTagToken && name == dropping:
+				if depth--; depth == 0 {
+					dropping = ""
+				}
+			}
+			continue
+		}
+		switch tt {
+		case html.DoctypeToken:
+			b.WriteString("<!DOCTYPE " + html.EscapeString(name) + ">")
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if droppedElements[name] {
+				if tt == html.StartTagToken {
+					dropping, depth = name, 1
+				}
+				continue
+			}
+			if !allowedElements[name] {
+				continue
+			}
+			inStyle = name == "style" && tt == html.StartTagToken
+			writeStartTag(&b, name, tok.Attr, tt == html.SelfClosingTagToken)
+		case html.EndTagToken:
+			if allowedElements[name] {
+				if name == "style" {
+					inStyle = false
+				}
+				b.WriteString("</" + name + ">")
+			}
+		case html.TextToken:
+			if inStyle {
+				// Style contents are raw text and must not be escaped.
+				if !dangerousCSS.MatchString(cssNoise.ReplaceAllString(tok.Data, "")) {
+					b.WriteString(tok.Data)
+				}
+				continue
+			}
+			b.WriteString(html.EscapeString(tok.Data))
+		}
+		// Comments, including Outlook's conditional comments, are removed.
+	}
+}
+
+func writeStartTag(b *strings.Builder, name string, attrs []html.Attribute, selfClosing bool) {
+	b.WriteString("<" + name)
+	for _, a := range attrs {
+		key := strings.ToLower(a.Key)
+		if a.Namespace != "" || !allowedAttributes[key] {
+			continue
+		}
+		if urlAttributes[key] && !safeURL(a.Val, name == "img" && key == "src") {
+			continue
+		}
+		if key == "style" && dangerousCSS.MatchString(cssNoise.ReplaceAllString(a.Val, "")) {
+			continue
+		}
+		b.WriteString(" " + key + `="` + html.EscapeString(a.Val) + `"`)
+	}
+	if selfClosing {
+		b.WriteString(" /")
+	}
+	b.WriteString(">")
+}
+
+// safeURL reports whether u is relative or uses a scheme that can't run code.
+// Data URLs are only allowed for images.
+func safeURL(u string, image bool) bool {
+	// Browsers ignore whitespace and control characters in schemes, as in
+	// "java\tscript:".
+	u = strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, u))
+	colon := strings.IndexByte(u, ':')
+	if colon == -1 || strings.ContainsAny(u[:colon], "/?#") {
+		return true
+	}
+	switch u[:colon] {
+	case "http", "https", "mailto", "tel":
+		return true
+	case "data":
+		return image && strings.HasPrefix(u, "data:image/") && !strings.HasPrefix(u, "data:image/svg")
+	}
+	return false
+}
+
+func set(values ...string) map[string]bool {
+	m := make(map[string]bool, len(values))
+	for _, v := range values {
+		m[v] = true
+	}
+	return m
+}
@@ -0,0 +1,34 @@
+package smtpserver
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// cidRe matches cid: URLs (RFC 2392) in attribute values and CSS.
+var cidRe = regexp.MustCompile(`(?i)cid:([^"'\s<>()]+)`)
+
+// rewriteCIDs replaces cid: references to parts of the message with the URLs
+// the parts are served at, and returns the Content-IDs that were referenced.
+// References to unknown parts are left alone.
+func rewriteCIDs(body string, urls map[string]string) (string, map[string]bool) {
+	referenced := map[string]bool{}
+	if len(urls) == 0 {
+		return body, referenced
+	}
+	body = cidRe.ReplaceAllStringFunc(body, func(ref string) string {
+		id := ref[len("cid:"):]
+		if unescaped, err := url.PathUnescape(id); err == nil {
+			id = unescaped
+		}
+		id = strings.Trim(id, "<>")
+		u, ok := urls[id]
+		if !ok {
+			return ref
+		}
+		referenced[id] = true
+		return u
+	})
+	return body, referenced
+}
@@ -0,0 +1,55 @@
+package smtpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// messageIDs extracts the ids from a header holding a list of msg-ids such as
+// Message-ID, Supersedes or References, without their angle brackets. A bare
+// id without brackets is accepted too, as some senders omit them.
+func messageIDs(header string) []string {
+	var ids []string
+	rest := header
+	for {
+		start := strings.IndexByte(rest, '<')
+		if start == -1 {
+			break
+		}
+		end := strings.IndexByte(rest[start:], '>')
+		if end == -1 {
+			break
+		}
+		if id := strings.TrimSpace(rest[start+1 : start+end]); id != "" {
+			ids = append(ids, id)
+		}
+		rest = rest[start+end+1:]
+	}
+	if len(ids) == 0 {
+		ids = strings.Fields(header)
+	}
+	return ids
+}
+
+func firstMessageID(header string) string {
+	if ids := messageIDs(header); len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
+
+// contentHash identifies what a message contributes to an entry, so that a
+// message delivered twice is recognized even if its transport headers differ.
+func contentHash(author, authorEmail, title, htmlBody string, attachments []*enmime.Part) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00", author, authorEmail, title, htmlBody)
+	for _, a := range attachments {
+		sum := sha256.Sum256(a.Content)
+		fmt.Fprintf(h, "%s\x00%s\x00%x\x00", a.FileName, a.ContentType, sum)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
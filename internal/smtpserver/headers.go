@@ -0,0 +1,40 @@
+package smtpserver
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// Date headers further than this ahead of the time the message was received
+// are considered clock skew, and so are those older than maxDateAge, which
+// is more than any delivery retries would account for.
+const (
+	maxDateSkew = 24 * time.Hour
+	maxDateAge  = 30 * 24 * time.Hour
+)
+
+// sender returns the display name and address from the From header, falling
+// back to the envelope sender when it is missing or can't be parsed. The
+// name is the address when there is no display name.
+func sender(env *enmime.Envelope, envelopeFrom string) (string, string) {
+	if list, err := env.AddressList("From"); err == nil && len(list) > 0 && list[0].Address != "" {
+		name := strings.TrimSpace(list[0].Name)
+		if name == "" {
+			name = list[0].Address
+		}
+		return name, list[0].Address
+	}
+	return envelopeFrom, envelopeFrom
+}
+
+// publishedAt returns the Date header as an RFC 3339 timestamp, or "" if it
+// is missing or implausibly far from the time the message was received.
+func publishedAt(env *enmime.Envelope, received time.Time) string {
+	date, err := env.Date()
+	if err != nil || date.After(received.Add(maxDateSkew)) || date.Before(received.Add(-maxDateAge)) {
+		return ""
+	}
+	return date.UTC().Format(time.RFC3339Nano)
+}
@@ -20,12 +20,16 @@ import (
 
 	"github.com/jtsang4/kill-the-newsletter/internal/config"
 	"github.com/jtsang4/kill-the-newsletter/internal/db"
+	"github.com/jtsang4/kill-the-newsletter/internal/events"
+	"github.com/jtsang4/kill-the-newsletter/internal/feedcache"
+	"github.com/jtsang4/kill-the-newsletter/internal/retention"
 	"github.com/jtsang4/kill-the-newsletter/internal/util"
 )
 
 type Backend struct {
-	cfg config.Config
-	db  *db.DB
+	cfg   config.Config
+	db    *db.DB
+	cache *feedcache.Cache
 }
 
 type session struct {
@@ -35,7 +39,9 @@ type session struct {
 	rcpts []string
 }
 
-func NewBackend(cfg config.Config, dbx *db.DB) *Backend { return &Backend{cfg: cfg, db: dbx} }
+func NewBackend(cfg config.Config, dbx *db.DB) *Backend {
+	return &Backend{cfg: cfg, db: dbx, cache: feedcache.New(cfg.DataDirectory)}
+}
 
 func (b *Backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
 	return &session{b: b, ctx: context.Background()}, nil
@@ -87,10 +93,10 @@ func (s *session) Data(r io.Reader) error {
 	// Map recipients to feeds
 	feeds := make([]db.Feed, 0)
 	for _, rcpt := range s.rcpts {
-		pub := strings.Split(rcpt, "@")[0]
-		f, err := db.GetFeedByPublicID(s.ctx, s.b.db.SQL, pub)
+		emailID := strings.Split(rcpt, "@")[0]
+		f, err := db.GetFeedByEmailID(s.ctx, s.b.db.Read, emailID)
 		if err != nil {
-			return err
+			return dbError(err)
 		}
 		if f != nil {
 			feeds = append(feeds, *f)
@@ -102,15 +108,68 @@ func (s *session) Data(r io.Reader) error {
 	// Prepare attachments (both attachments and inlines)
 	attachments := append([]*enmime.Part{}, env.Attachments...)
 	attachments = append(attachments, env.Inlines...)
+	received := time.Now()
+	author, authorEmail := sender(env, s.from)
+	title := env.GetHeader("Subject")
+	if strings.TrimSpace(title) == "" {
+		title = "Untitled"
+	}
+	htmlBody := env.HTML
+	if strings.TrimSpace(htmlBody) == "" {
+		if env.Text != "" {
+			htmlBody = "<pre>" + html.EscapeString(env.Text) + "</pre>"
+		} else {
+			htmlBody = "No content."
+		}
+	}
+	// A message replaces the entry of an earlier message with the same
+	// Message-ID, or of one it declares it supersedes.
+	messageID := firstMessageID(env.GetHeader("Message-ID"))
+	replaces := messageIDs(env.GetHeader("Supersedes"))
+	if messageID != "" {
+		replaces = append([]string{messageID}, replaces...)
+	}
+	content := db.EntryContent{
+		PublishedAt:     publishedAt(env, received),
+		Author:          author,
+		AuthorEmail:     authorEmail,
+		Title:           title,
+		OriginalContent: htmlBody,
+		MessageID:       messageID,
+		ContentHash:     contentHash(author, authorEmail, title, htmlBody, attachments),
+	}
+	duplicates := 0
 	for _, f := range feeds {
+		duplicate := false
 		if err := s.b.db.Tx(s.ctx, func(tx *db.Tx) error {
+			existing, err := db.GetEntryByMessageIDTx(s.ctx, tx, f.ID, replaces)
+			if err != nil {
+				return err
+			}
+			if existing != nil && messageID != "" && existing.MessageID.String == messageID && existing.ContentHash.String == content.ContentHash {
+				// The same message delivered again, e.g. after a retry or through another route.
+				duplicate = true
+				return nil
+			}
+			if messageID == "" {
+				// Without a Message-ID, the same content is the same message.
+				same, err := db.GetEntryByContentHashTx(s.ctx, tx, f.ID, content.ContentHash)
+				if err != nil {
+					return err
+				}
+				if same != nil {
+					duplicate = true
+					return nil
+				}
+			}
 			// update emailIcon using sender domain favicon
 			domain := strings.Split(strings.ToLower(s.from), "@")[1]
 			if err := db.UpdateFeedEmailIcon(s.ctx, tx, f.ID, fmt.Sprintf("https://%s/favicon.ico", domain)); err != nil {
 				return err
 			}
-			// store enclosures
+			// store enclosures, remembering where parts referenced by cid: are served
 			enclosureIDs := make([]int64, 0, len(attachments))
+			cidURLs := map[string]string{}
 			for _, a := range attachments {
 				// resolve filename
 				name := a.FileName
@@ -136,69 +195,96 @@ func (s *session) Data(r io.Reader) error {
 					return err
 				}
 				enclosureIDs = append(enclosureIDs, id)
-			}
-			// create entry
-			pid, _ := util.RandID(20)
-			createdAt := time.Now().UTC().Format(time.RFC3339Nano)
-			author := s.from
-			title := env.GetHeader("Subject")
-			if strings.TrimSpace(title) == "" {
-				title = "Untitled"
-			}
-			htmlBody := env.HTML
-			if strings.TrimSpace(htmlBody) == "" {
-				if env.Text != "" {
-					htmlBody = "<pre>" + html.EscapeString(env.Text) + "</pre>"
-				} else {
-					htmlBody = "No content."
+				if a.ContentID != "" {
+					cidURLs[a.ContentID] = fmt.Sprintf("https://%s/files/%s/%s", s.b.cfg.Hostname, pid, name)
 				}
 			}
-			entryID, err := db.InsertEntry(s.ctx, tx, pid, f.ID, createdAt, author, title, htmlBody)
-			if err != nil {
-				return err
+			entry := content
+			entry.CleanPrivacy = f.PrivacyCleaning
+			var referenced map[string]bool
+			entry.OriginalContent, referenced = rewriteCIDs(content.OriginalContent, cidURLs)
+			now := received.UTC().Format(time.RFC3339Nano)
+			var entryID int64
+			if existing != nil {
+				// update the entry in place; the previous enclosures are removed by
+				// the cleanup loop once they are no longer linked
+				entryID = existing.ID
+				if err := db.DeleteEnclosureLinksByEntry(s.ctx, tx, entryID); err != nil {
+					return err
+				}
+				if err := db.UpdateEntry(s.ctx, tx, entryID, now, entry); err != nil {
+					return err
+				}
+			} else {
+				pid, _ := util.RandID(20)
+				entryID, err = db.InsertEntry(s.ctx, tx, pid, f.ID, now, entry)
+				if err != nil {
+					return err
+				}
 			}
-			for _, eid := range enclosureIDs {
-				if err := db.LinkEnclosure(s.ctx, tx, entryID, eid); err != nil {
+			for i, eid := range enclosureIDs {
+				if err := db.LinkEnclosure(s.ctx, tx, entryID, eid, referenced[attachments[i].ContentID]); err != nil {
 					return err
 				}
 			}
-			// trim feed to ~512KB
-			entriesAsc, err := db.GetAllEntriesAscTx(s.ctx, tx, f.ID)
-			if err != nil {
+			// apply the feed's retention policy now that the new entry is stored
+			if _, err := retention.Apply(s.ctx, tx, f.ID, retention.For(s.b.cfg.Retention, &f), time.Now()); err != nil {
 				return err
 			}
-			var size int
-			for i := len(entriesAsc) - 1; i >= 0; i-- { // from newest backwards
-				size += len(entriesAsc[i].Title) + len(entriesAsc[i].Content)
-				if size > 1<<19 { // stop here; entries [0..i] should be deleted
-					for j := 0; j <= i; j++ {
-						if err := db.DeleteEnclosureLinksByEntry(s.ctx, tx, entriesAsc[j].ID); err != nil {
-							return err
-						}
-						if err := db.DeleteEntryByID(s.ctx, tx, entriesAsc[j].ID); err != nil {
-							return err
-						}
-					}
-					break
-				}
-			}
-			// enqueue websub dispatch for last 24h subscriptions
-			subs, err := db.GetWebSubSubscriptionsRecentTx(s.ctx, tx, f.ID, time.Now().Add(-24*time.Hour).UTC().Format(time.RFC3339Nano))
+			// enqueue websub dispatch for subscriptions whose lease hasn't ended
+			subs, err := db.GetActiveWebSubSubscriptionsTx(s.ctx, tx, f.ID, time.Now().UTC().Format(time.RFC3339Nano))
 			if err == nil {
 				for _, sub := range subs {
 					params := fmt.Sprintf(`{"feedId":%d,"feedEntryId":%d,"feedWebSubSubscriptionId":%d}`, f.ID, entryID, sub.ID)
 					_ = db.EnqueueJobTx(s.ctx, tx, "feedWebSubSubscriptions.dispatch", time.Now().UTC().Format(time.RFC3339Nano), params)
 				}
 			}
+			// enqueue delivery to the feed's webhooks
+			event := "entry.created"
+			if existing != nil {
+				event = "entry.updated"
+			}
+			hooks, err := db.GetFeedWebhooksTx(s.ctx, tx, f.ID)
+			if err != nil {
+				return err
+			}
+			for _, h := range hooks {
+				params := fmt.Sprintf(`{"feedId":%d,"feedEntryId":%d,"feedWebhookId":%d,"event":%q}`, f.ID, entryID, h.ID, event)
+				if err := db.EnqueueJobTx(s.ctx, tx, "feedWebhooks.deliver", time.Now().UTC().Format(time.RFC3339Nano), params); err != nil {
+					return err
+				}
+			}
 			return nil
 		}); err != nil {
-			return err
+			return dbError(err)
+		}
+		if duplicate {
+			duplicates++
+			continue
 		}
+		if err := s.b.cache.Invalidate(f.ReadToken); err != nil {
+			log.Printf("feed cache: %v", err)
+		}
+		events.Publish(f.ID)
+	}
+	if duplicates > 0 {
+		log.Printf("EMAIL DUPLICATE from=%s messageId=%s feeds=%d", s.from, messageID, duplicates)
 	}
-	log.Printf("EMAIL SUCCESS from=%s feeds=%d", s.from, len(feeds))
+	log.Printf("EMAIL SUCCESS from=%s feeds=%d", s.from, len(feeds)-duplicates)
 	return nil
 }
 
+// dbError turns a busy database into a temporary failure, which the sending
+// server retries later. Feeds that already stored the message recognize the
+// retry by its Message-ID.
+func dbError(err error) error {
+	if db.IsBusy(err) {
+		log.Println("EMAIL DEFERRED database busy:", err)
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Busy, try again later"}
+	}
+	return err
+}
+
 func (s *session) Reset()        { s.from = ""; s.rcpts = nil }
 func (s *session) Logout() error { return nil }
 
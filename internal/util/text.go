@@ -0,0 +1,46 @@
+package util
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// HTMLToText extracts the visible text of an HTML document, separating block
+// content with spaces. Scripts, styles and other non-rendered elements are
+// skipped.
+func HTMLToText(s string) string {
+	z := html.NewTokenizer(strings.NewReader(s))
+	var b strings.Builder
+	skip := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return strings.Join(strings.Fields(b.String()), " ")
+		case html.StartTagToken:
+			if name, _ := z.TagName(); isNonRendered(string(name)) {
+				skip++
+			}
+			b.WriteByte(' ')
+		case html.EndTagToken:
+			if name, _ := z.TagName(); isNonRendered(string(name)) && skip > 0 {
+				skip--
+			}
+			b.WriteByte(' ')
+		case html.SelfClosingTagToken:
+			b.WriteByte(' ')
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(z.Text())
+			}
+		}
+	}
+}
+
+func isNonRendered(tag string) bool {
+	switch tag {
+	case "script", "style", "head", "title", "template", "noscript":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jtsang4/kill-the-newsletter/internal/config"
+	"github.com/jtsang4/kill-the-newsletter/internal/db"
+	"github.com/jtsang4/kill-the-newsletter/internal/jobs"
+	"github.com/jtsang4/kill-the-newsletter/internal/outbound"
+	"github.com/jtsang4/kill-the-newsletter/internal/util"
+)
+
+// WebhookJob delivers an entry to a feed's webhook.
+type WebhookJob struct {
+	FeedID        int64 `json:"feedId"`
+	FeedEntryID   int64 `json:"feedEntryId"`
+	FeedWebhookID int64 `json:"feedWebhookId"`
+	// Event is "entry.created", or "entry.updated" when a message replaced
+	// the entry.
+	Event string `json:"event"`
+}
+
+// WebhookPayload is the JSON body of webhook deliveries.
+type WebhookPayload struct {
+	Event       string  `json:"event"`
+	FeedID      string  `json:"feedId"`
+	FeedTitle   string  `json:"feedTitle"`
+	EntryID     string  `json:"entryId"`
+	EntryURL    string  `json:"entryUrl"`
+	ReceivedAt  string  `json:"receivedAt"`
+	PublishedAt *string `json:"publishedAt"`
+	Subject     string  `json:"subject"`
+	Sender      struct {
+		Name    *string `json:"name"`
+		Address *string `json:"address"`
+	} `json:"sender"`
+	Text       string                    `json:"text"`
+	HTML       string                    `json:"html"`
+	Enclosures []WebhookPayloadEnclosure `json:"enclosures"`
+}
+
+type WebhookPayloadEnclosure struct {
+	URL    string `json:"url"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Length int64  `json:"length"`
+	// Inline enclosures are images shown in the HTML body.
+	Inline bool `json:"inline"`
+}
+
+// Headers of webhook deliveries. The signature is the HMAC-SHA256, keyed by
+// the webhook's secret, of the timestamp, a dot and the body, so that
+// endpoints can refuse old deliveries replayed by someone who captured them.
+const (
+	WebhookEventHeader     = "X-KTN-Event"
+	WebhookDeliveryHeader  = "X-KTN-Delivery"
+	WebhookTimestampHeader = "X-KTN-Timestamp"
+	WebhookSignatureHeader = "X-KTN-Signature"
+)
+
+// WebhookSignature returns the X-KTN-Signature of a delivery.
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// processWebhook POSTs an entry to a webhook, and records the attempt in the
+// webhook's delivery log.
+func processWebhook(ctx context.Context, cfg config.Config, client *outbound.Client, dbx *db.DB, job *db.Job) error {
+	var params WebhookJob
+	if err := json.Unmarshal([]byte(job.Parameters), &params); err != nil {
+		return jobs.Permanent(err)
+	}
+	hook, err := db.GetWebhookByID(ctx, dbx.Read, params.FeedWebhookID)
+	if err != nil {
+		return err
+	}
+	// Jobs of deleted webhooks, feeds and entries are done: they have
+	// nothing left to deliver, and retrying them won't change that.
+	if hook == nil {
+		log.Printf("webhook job %d: webhook was deleted", job.ID)
+		return nil
+	}
+	f, err := db.GetFeedByID(ctx, dbx.Read, params.FeedID)
+	if err != nil {
+		return err
+	}
+	entry, err := db.GetEntryByID(ctx, dbx.Read, params.FeedEntryID)
+	if err != nil {
+		return err
+	}
+	if f == nil || entry == nil {
+		log.Printf("webhook job %d: feed or entry was deleted", job.ID)
+		return nil
+	}
+	body, err := webhookPayload(ctx, cfg, dbx, params.Event, f, entry)
+	if err != nil {
+		return err
+	}
+	delivery := db.WebhookDelivery{
+		CreatedAt:     time.Now().UTC().Format(time.RFC3339Nano),
+		Event:         params.Event,
+		EntryPublicID: entry.PublicID,
+		Attempt:       job.Retries + 1,
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, params.Event)
+	// The job id stays the same across retries, so endpoints can tell a
+	// retry of a delivery they got from a new one.
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(job.ID, 10))
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, WebhookSignature(hook.Secret, timestamp, body))
+	start := time.Now()
+	resp, err := client.Do(req)
+	delivery.DurationMilliseconds = time.Since(start).Milliseconds()
+	if err == nil {
+		outbound.Discard(resp)
+		delivery.Status = sql.NullInt64{Int64: int64(resp.StatusCode), Valid: true}
+		err = statusError(resp)
+	} else {
+		err = requestError(err)
+	}
+	if err != nil {
+		delivery.Error = sql.NullString{String: err.Error(), Valid: true}
+	}
+	if logErr := dbx.Tx(ctx, func(tx *db.Tx) error { return db.InsertWebhookDelivery(ctx, tx, hook.ID, delivery) }); logErr != nil {
+		return errors.Join(err, fmt.Errorf("record delivery: %w", logErr))
+	}
+	return err
+}
+
+func webhookPayload(ctx context.Context, cfg config.Config, dbx *db.DB, event string, f *db.Feed, e *db.FeedEntry) ([]byte, error) {
+	p := WebhookPayload{
+		Event:      event,
+		FeedID:     f.PublicID,
+		FeedTitle:  f.Title,
+		EntryID:    e.PublicID,
+		EntryURL:   fmt.Sprintf("https://%s/feeds/%s/entries/%s.html", cfg.Hostname, f.ReadToken, e.PublicID),
+		ReceivedAt: e.CreatedAt,
+		Subject:    e.Title,
+		Text:       util.HTMLToText(e.Content),
+		HTML:       e.Content,
+		Enclosures: []WebhookPayloadEnclosure{},
+	}
+	if e.PublishedAt.Valid {
+		p.PublishedAt = &e.PublishedAt.String
+	}
+	if e.Author.Valid {
+		p.Sender.Name = &e.Author.String
+	}
+	if e.AuthorEmail.Valid {
+		p.Sender.Address = &e.AuthorEmail.String
+	}
+	enclosures, err := db.GetEnclosuresForEntry(ctx, dbx.Read, e.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, x := range enclosures {
+		p.Enclosures = append(p.Enclosures, WebhookPayloadEnclosure{
+			URL:    fmt.Sprintf("https://%s/files/%s/%s", cfg.Hostname, x.PublicID, x.Name),
+			Type:   x.Type,
+			Name:   x.Name,
+			Length: x.Length,
+			Inline: x.Inline,
+		})
+	}
+	return json.Marshal(p)
+}
@@ -3,31 +3,48 @@ package worker
 import (
 	"context"
 	"crypto/hmac"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/jtsang4/kill-the-newsletter/internal/atom"
 	"github.com/jtsang4/kill-the-newsletter/internal/config"
 	"github.com/jtsang4/kill-the-newsletter/internal/db"
+	"github.com/jtsang4/kill-the-newsletter/internal/events"
+	"github.com/jtsang4/kill-the-newsletter/internal/feed"
+	"github.com/jtsang4/kill-the-newsletter/internal/feedcache"
+	"github.com/jtsang4/kill-the-newsletter/internal/jobs"
+	"github.com/jtsang4/kill-the-newsletter/internal/outbound"
+	"github.com/jtsang4/kill-the-newsletter/internal/render"
+	"github.com/jtsang4/kill-the-newsletter/internal/retention"
+	"github.com/jtsang4/kill-the-newsletter/internal/util"
 )
 
+// VerifyJob is a subscription request to verify, or with HubMode "denied",
+// one to deny.
 type VerifyJob struct {
 	FeedID      int64   `json:"feedId"`
 	HubMode     string  `json:"hub.mode"`
 	HubTopic    string  `json:"hub.topic"`
 	HubCallback string  `json:"hub.callback"`
 	HubSecret   *string `json:"hub.secret"`
+	// HubLeaseSeconds is the lease that the subscriber asked for, if any.
+	HubLeaseSeconds int `json:"hub.lease_seconds,omitempty"`
+	// HubReason is why the request is denied.
+	HubReason string `json:"hub.reason,omitempty"`
 }
 
 type DispatchJob struct {
@@ -36,199 +53,230 @@ type DispatchJob struct {
 	FeedWebSubSubscriptionID int64 `json:"feedWebSubSubscriptionId"`
 }
 
+// Job types.
+const (
+	verifyJobType   = "feedWebSubSubscriptions.verify"
+	dispatchJobType = "feedWebSubSubscriptions.dispatch"
+	webhookJobType  = "feedWebhooks.deliver"
+)
+
+// defaultConcurrency is how many jobs of each type run at the same time,
+// unless configured otherwise.
+var defaultConcurrency = map[string]int{
+	verifyJobType:   8,
+	dispatchJobType: 4,
+	webhookJobType:  4,
+}
+
+var retryPolicies = map[string]jobs.RetryPolicy{
+	// Subscribers wait for verification, so it isn't retried for long.
+	verifyJobType: {Retries: 5, Base: 10 * time.Second, Max: 10 * time.Minute},
+	// One to two days in total, so that subscribers that are down for a
+	// while still get the entry.
+	dispatchJobType: {Retries: 14, Base: 30 * time.Second, Max: 6 * time.Hour},
+	webhookJobType:  {Retries: 14, Base: 30 * time.Second, Max: 6 * time.Hour},
+}
+
 func Start(ctx context.Context, cfg config.Config, dbx *db.DB) {
-	// Verify workers (parallel 8)
-	for i := 0; i < 8; i++ {
-		go verifyLoop(ctx, cfg, dbx)
-	}
-	// Dispatch workers (parallel 4)
-	for i := 0; i < 4; i++ {
-		go dispatchLoop(ctx, cfg, dbx)
+	client := outbound.New(cfg)
+	runner := jobs.NewRunner(dbx)
+	log.Printf("background worker %s", runner.ID())
+	register := func(typ string, h jobs.Handler) {
+		concurrency := defaultConcurrency[typ]
+		if n, ok := cfg.JobConcurrency[typ]; ok {
+			concurrency = n
+		}
+		runner.Register(typ, h, concurrency, retryPolicies[typ])
 	}
+	register(verifyJobType, jobs.JSON(func(ctx context.Context, job VerifyJob) error {
+		return processVerify(ctx, cfg, client, dbx, job)
+	}))
+	register(dispatchJobType, jobs.JSON(func(ctx context.Context, job DispatchJob) error {
+		return processDispatch(ctx, cfg, client, dbx, job)
+	}))
+	register(webhookJobType, jobs.HandlerFunc(func(ctx context.Context, job *db.Job) error {
+		return processWebhook(ctx, cfg, client, dbx, job)
+	}))
+	runner.Start(ctx)
 	// Cleanup ticker
 	go cleanupLoop(ctx, dbx, cfg)
+	// Retention ticker, so age limits apply even when no new mail arrives
+	go retentionLoop(ctx, dbx, cfg)
 }
 
-func verifyLoop(ctx context.Context, cfg config.Config, dbx *db.DB) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-		var id int64
-		var params string
-		// Dequeue and mark as running inside a short transaction
-		_ = dbx.Tx(ctx, func(tx *db.Tx) error {
-			jid, p, err := db.DequeueJob(ctx, tx, "feedWebSubSubscriptions.verify", time.Now().UTC().Format(time.RFC3339Nano))
-			if err != nil {
-				return err
-			}
-			id, params = jid, p
-			return nil
-		})
-		if id == 0 {
-			time.Sleep(50 * time.Millisecond)
-			continue
-		}
-		// Parse outside transaction
-		var job VerifyJob
-		if err := json.Unmarshal([]byte(params), &job); err != nil {
-			_ = dbx.Tx(ctx, func(tx *db.Tx) error { return db.FinishJob(ctx, tx, id, false) })
-			time.Sleep(50 * time.Millisecond)
-			continue
+// processVerify asks the callback to confirm a subscription request, or
+// tells it that a request was denied.
+func processVerify(ctx context.Context, cfg config.Config, client *outbound.Client, dbx *db.DB, job VerifyJob) error {
+	if job.HubMode == "denied" {
+		return sendDenial(ctx, client, job)
+	}
+	f, err := db.GetFeedByID(ctx, dbx.Read, job.FeedID)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		if job.HubMode == "subscribe" {
+			job.HubReason = "The feed was deleted."
+			return sendDenial(ctx, client, job)
 		}
-		// Process outside transaction
-		ok := processVerify(ctx, cfg, dbx, job)
-		// Finish in a short transaction
-		_ = dbx.Tx(ctx, func(tx *db.Tx) error { return db.FinishJob(ctx, tx, id, ok) })
-		time.Sleep(50 * time.Millisecond)
+		return nil
 	}
-}
-
-func processVerify(ctx context.Context, cfg config.Config, dbx *db.DB, job VerifyJob) bool {
-	f, err := db.GetFeedByID(ctx, dbx.SQL, job.FeedID)
-	if err != nil || f == nil {
-		return false
+	challenge, err := util.RandID(32)
+	if err != nil {
+		return err
 	}
-	challenge := fmt.Sprintf("%x", sha256.Sum256([]byte(time.Now().String())))
 	u, err := url.Parse(job.HubCallback)
 	if err != nil {
-		return false
+		return jobs.Permanent(err)
 	}
 	q := u.Query()
 	q.Set("hub.mode", job.HubMode)
 	q.Set("hub.topic", job.HubTopic)
 	q.Set("hub.challenge", challenge)
+	// Jobs enqueued before leases were negotiated have none.
+	lease := cfg.WebSub.LeaseSeconds(job.HubLeaseSeconds)
 	if job.HubMode == "subscribe" {
-		q.Set("hub.lease_seconds", strconv.Itoa(24*60*60))
+		q.Set("hub.lease_seconds", strconv.Itoa(lease))
 	}
 	u.RawQuery = q.Encode()
 	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
-		return false
+		return requestError(err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return false
+	defer outbound.Discard(resp)
+	if err := statusError(resp); err != nil {
+		return err
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return requestError(err)
 	}
-	b, _ := io.ReadAll(resp.Body)
 	if string(b) != challenge {
-		return false
+		// The subscriber didn't confirm the request.
+		return jobs.Permanent(errors.New("callback didn't echo the challenge"))
 	}
 	return dbx.Tx(ctx, func(tx *db.Tx) error {
 		if job.HubMode == "subscribe" {
-			return db.UpsertWebSubSubscription(ctx, tx, f.ID, time.Now().UTC().Format(time.RFC3339Nano), job.HubCallback, job.HubSecret)
-		}
-		// unsubscribe
-		sub, err := db.GetWebSubSubscriptionsRecentTx(ctx, tx, f.ID, "1970-01-01T00:00:00Z")
-		if err != nil {
-			return err
+			// The lease starts when the subscriber confirms it.
+			now := time.Now()
+			expiresAt := now.Add(time.Duration(lease) * time.Second).UTC().Format(time.RFC3339Nano)
+			return db.UpsertWebSubSubscription(ctx, tx, f.ID, now.UTC().Format(time.RFC3339Nano), job.HubCallback, string(topicFormat(job.HubTopic)), job.HubSecret, expiresAt)
 		}
-		for _, s := range sub {
-			if s.Callback == job.HubCallback {
-				return db.DeleteWebSubSubscription(ctx, tx, s.ID)
-			}
-		}
-		return nil
-	}) == nil
+		return db.DeleteWebSubSubscriptionByCallback(ctx, tx, f.ID, job.HubCallback)
+	})
 }
 
-func dispatchLoop(ctx context.Context, cfg config.Config, dbx *db.DB) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-		var id int64
-		var params string
-		// Dequeue and mark as running inside a short transaction
-		_ = dbx.Tx(ctx, func(tx *db.Tx) error {
-			jid, p, err := db.DequeueJob(ctx, tx, "feedWebSubSubscriptions.dispatch", time.Now().UTC().Format(time.RFC3339Nano))
-			if err != nil {
-				return err
-			}
-			id, params = jid, p
-			return nil
-		})
-		if id == 0 {
-			time.Sleep(50 * time.Millisecond)
-			continue
-		}
-		// Parse outside transaction
-		var job DispatchJob
-		if err := json.Unmarshal([]byte(params), &job); err != nil {
-			_ = dbx.Tx(ctx, func(tx *db.Tx) error { return db.FinishJob(ctx, tx, id, false) })
-			time.Sleep(50 * time.Millisecond)
-			continue
-		}
-		// Process outside transaction (performs DB reads and network I/O)
-		ok := processDispatch(ctx, cfg, dbx, job)
-		// Finish in a short transaction
-		_ = dbx.Tx(ctx, func(tx *db.Tx) error { return db.FinishJob(ctx, tx, id, ok) })
-		time.Sleep(50 * time.Millisecond)
+// sendDenial tells the callback of a subscription request that the hub
+// won't honor it, and why.
+func sendDenial(ctx context.Context, client *outbound.Client, job VerifyJob) error {
+	u, err := url.Parse(job.HubCallback)
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	q := u.Query()
+	q.Set("hub.mode", "denied")
+	q.Set("hub.topic", job.HubTopic)
+	if job.HubReason != "" {
+		q.Set("hub.reason", job.HubReason)
+	}
+	u.RawQuery = q.Encode()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return requestError(err)
+	}
+	defer outbound.Discard(resp)
+	return statusError(resp)
+}
+
+// signatureHashes are the hashes of config.WebSubSignatureAlgorithms.
+var signatureHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// signature returns the X-Hub-Signature of a notification body, with which
+// subscribers check that it comes from the hub they gave secret to.
+func signature(algorithm, secret, body string) string {
+	h := hmac.New(signatureHashes[algorithm], []byte(secret))
+	h.Write([]byte(body))
+	return algorithm + "=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// requestError returns the error of a request that failed, which is
+// permanent if the callback is in a blocked network or responds with too
+// much: retrying won't change either.
+func requestError(err error) error {
+	if errors.Is(err, outbound.ErrBlocked) || errors.Is(err, outbound.ErrTooLarge) {
+		return jobs.Permanent(err)
 	}
+	return err
 }
 
-func processDispatch(ctx context.Context, cfg config.Config, dbx *db.DB, job DispatchJob) bool {
-	feed, err := db.GetFeedByID(ctx, dbx.SQL, job.FeedID)
-	if err != nil || feed == nil {
-		return false
-	}
-	entry, err := db.GetEntryByID(ctx, dbx.SQL, job.FeedEntryID)
-	if err != nil || entry == nil {
-		return false
-	}
-	sub, err := db.GetWebSubSubscriptionByID(ctx, dbx.SQL, job.FeedWebSubSubscriptionID)
-	if err != nil || sub == nil {
-		return false
-	}
-	// Build one-entry Atom body
-	var icon *string
-	if feed.Icon.Valid {
-		icon = &feed.Icon.String
-	}
-	var emailIcon *string
-	if feed.EmailIcon.Valid {
-		emailIcon = &feed.EmailIcon.String
-	}
-	var author *string
-	if entry.Author.Valid {
-		author = &entry.Author.String
-	}
-	encls, _ := db.GetEnclosuresForEntry(ctx, dbx.SQL, entry.ID)
-	var arr []atom.Enclosure
-	for _, e := range encls {
-		arr = append(arr, atom.Enclosure{PublicID: e.PublicID, Type: e.Type, Length: e.Length, Name: e.Name})
-	}
-	body, err := atom.BuildFeedXML(cfg.Hostname, atom.Feed{PublicID: feed.PublicID, Title: feed.Title, Icon: icon, EmailIcon: emailIcon}, []atom.Entry{{ID: entry.ID, PublicID: entry.PublicID, CreatedAt: entry.CreatedAt, Author: author, Title: entry.Title, Content: entry.Content, Enclosures: arr}})
+// statusError returns an error for responses that aren't successful, which
+// is permanent for client errors other than timeouts and rate limiting.
+func statusError(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err := fmt.Errorf("callback responded %s", resp.Status)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return jobs.Permanent(err)
+	}
+	return err
+}
+
+func processDispatch(ctx context.Context, cfg config.Config, client *outbound.Client, dbx *db.DB, job DispatchJob) error {
+	f, err := db.GetFeedByID(ctx, dbx.Read, job.FeedID)
 	if err != nil {
-		return false
+		return err
+	}
+	entry, err := db.GetEntryByID(ctx, dbx.Read, job.FeedEntryID)
+	if err != nil {
+		return err
+	}
+	sub, err := db.GetWebSubSubscriptionByID(ctx, dbx.Read, job.FeedWebSubSubscriptionID)
+	if err != nil {
+		return err
+	}
+	if f == nil || entry == nil || sub == nil {
+		// Nothing left to deliver, which retrying won't change.
+		log.Printf("websub dispatch: feed %d, entry %d or subscription %d was deleted", job.FeedID, job.FeedEntryID, job.FeedWebSubSubscriptionID)
+		return nil
+	}
+	// Build a one-entry document in the format the subscriber asked for
+	format, ok := feed.ParseFormat(sub.Format)
+	if !ok {
+		format = feed.FormatAtom
+	}
+	model := feed.FromDB(cfg.Hostname, f)
+	items, err := feed.EntriesFromDB(ctx, dbx.Read, cfg.Hostname, f, []db.FeedEntry{*entry})
+	if err != nil {
+		return err
+	}
+	body, err := render.Feed(format, model, items)
+	if err != nil {
+		return jobs.Permanent(err)
 	}
 	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, sub.Callback, strings.NewReader(body))
-	req.Header.Set("Content-Type", "application/atom+xml; charset=utf-8")
-	req.Header.Set("Link", fmt.Sprintf("<https://%s/feeds/%s.xml>; rel=\"self\", <https://%s/feeds/%s/websub>; rel=\"hub\"", cfg.Hostname, feed.PublicID, cfg.Hostname, feed.PublicID))
+	req.Header.Set("Content-Type", format.ContentType())
+	req.Header.Set("Link", fmt.Sprintf("<%s>; rel=\"self\", <%s>; rel=\"hub\"", model.DocumentURL(format), model.HubURL))
 	if sub.Secret != nil {
-		h := hmac.New(sha256.New, []byte(*sub.Secret))
-		h.Write([]byte(body))
-		req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(h.Sum(nil)))
+		req.Header.Set("X-Hub-Signature", signature(cfg.WebSub.Algorithm(), *sub.Secret, body))
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
-		return false
+		return requestError(err)
 	}
-	defer resp.Body.Close()
+	defer outbound.Discard(resp)
 	if resp.StatusCode == http.StatusGone {
-		_ = dbx.Tx(ctx, func(tx *db.Tx) error { return db.DeleteWebSubSubscription(ctx, tx, sub.ID) })
-		return true
+		// The subscriber is gone for good.
+		return dbx.Tx(ctx, func(tx *db.Tx) error { return db.DeleteWebSubSubscription(ctx, tx, sub.ID) })
 	}
-	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
-		log.Printf("websub dispatch client error: %s", resp.Status)
-		return true
-	}
-	return resp.StatusCode >= 200 && resp.StatusCode < 300
+	return statusError(resp)
 }
 
 func cleanupLoop(ctx context.Context, dbx *db.DB, cfg config.Config) {
@@ -241,17 +289,72 @@ func cleanupLoop(ctx context.Context, dbx *db.DB, cfg config.Config) {
 		case <-t.C:
 		}
 		olderViz := time.Now().Add(-1 * time.Hour).UTC().Format(time.RFC3339Nano)
-		_ = db.DeleteOldVisualizations(ctx, dbx.SQL, olderViz)
-		olderSubs := time.Now().Add(-24 * time.Hour).UTC().Format(time.RFC3339Nano)
-		_ = db.DeleteOldWebSubs(ctx, dbx.SQL, olderSubs)
+		_ = db.DeleteOldVisualizations(ctx, dbx.Write, olderViz)
+		_ = db.DeleteExpiredWebSubs(ctx, dbx.Write, time.Now().UTC().Format(time.RFC3339Nano))
+		_ = db.DeleteOldFeedEvents(ctx, dbx.Write, time.Now().Add(-events.MaxAge).UTC().Format(time.RFC3339Nano))
 		// delete orphan enclosure files and records
-		orphans, _ := db.GetOrphanEnclosures(ctx, dbx.SQL)
+		orphans, _ := db.GetOrphanEnclosures(ctx, dbx.Read)
 		for _, o := range orphans {
 			_ = os.RemoveAll(filepath.Join(cfg.DataDirectory, "files", o.PublicID))
-			_ = db.DeleteEnclosureByID(ctx, dbx.SQL, o.ID)
+			_ = db.DeleteEnclosureByID(ctx, dbx.Write, o.ID)
+		}
+	}
+}
+
+func retentionLoop(ctx context.Context, dbx *db.DB, cfg config.Config) {
+	t := time.NewTicker(1 * time.Hour)
+	defer t.Stop()
+	for {
+		applyRetention(ctx, dbx, cfg)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func applyRetention(ctx context.Context, dbx *db.DB, cfg config.Config) {
+	feeds, err := db.ListFeeds(ctx, dbx.Read)
+	if err != nil {
+		log.Printf("retention: list feeds: %v", err)
+		return
+	}
+	cache := feedcache.New(cfg.DataDirectory)
+	now := time.Now()
+	for i := range feeds {
+		p := retention.For(cfg.Retention, &feeds[i])
+		if p.MaxAgeDays == 0 {
+			continue
+		}
+		var deleted int
+		err := dbx.Tx(ctx, func(tx *db.Tx) error {
+			n, err := retention.Apply(ctx, tx, feeds[i].ID, p, now)
+			deleted = n
+			return err
+		})
+		if err != nil {
+			log.Printf("retention: feed %d: %v", feeds[i].ID, err)
+			continue
+		}
+		if deleted > 0 {
+			log.Printf("retention: deleted %d entries from feed %d", deleted, feeds[i].ID)
+			if err := cache.Invalidate(feeds[i].ReadToken); err != nil {
+				log.Printf("feed cache: %v", err)
+			}
+			events.Publish(feeds[i].ID)
 		}
 	}
 }
 
 // helpers
+
+// topicFormat returns the format of a topic URL that handleWebSub accepted.
+func topicFormat(topic string) feed.Format {
+	if format, ok := feed.ParseFormat(strings.TrimPrefix(path.Ext(topic), ".")); ok {
+		return format
+	}
+	return feed.FormatAtom
+}
+
 func urlQueryEscape(s string) string { return (&url.URL{Path: s}).EscapedPath() }